@@ -68,6 +68,10 @@ var (
 	pyMain           = flag.String("pm", "", "__main__.py file to insert in par")
 	prefix           = flag.String("prefix", "", "A file to prefix to the zip file")
 	ignoreDuplicates = flag.Bool("ignore-duplicates", false, "take each entry from the first zip it exists in and don't warn")
+	normalizeDirs    = flag.Bool("normalize-dirs", false, "replace the directory entries of the input zips with new ones for every directory, with uniform modes and timestamps")
+	verifyCRCs       = flag.Bool("verify-crc", false, "decompress every copied entry and check it against the CRC32 of the input zip before copying it")
+	mergeManifests   = flag.Bool("merge-manifests", false, "with -j, merge the manifests of -m and the input jars instead of keeping only the first one")
+	manifestConflict = flag.String("manifest-conflict", "error", "with -merge-manifests, which value of an attribute in two manifests wins: first, last, or error to fail")
 )
 
 func init() {
@@ -138,6 +142,26 @@ func main() {
 		log.Fatal(errors.New("must specify -j when specifying a manifest via -m"))
 	}
 
+	if *normalizeDirs && *stripDirEntries {
+		log.Fatal(errors.New("can't specify both -normalize-dirs and -D"))
+	}
+
+	if *mergeManifests && !*emulateJar {
+		log.Fatal(errors.New("must specify -j when merging manifests via -merge-manifests"))
+	}
+
+	var conflict jar.ManifestConflict
+	switch *manifestConflict {
+	case "error":
+		conflict = jar.ManifestConflictError
+	case "first":
+		conflict = jar.ManifestConflictFirst
+	case "last":
+		conflict = jar.ManifestConflictLast
+	default:
+		log.Fatalf("-manifest-conflict must be first, last or error, not %q", *manifestConflict)
+	}
+
 	if *pyMain != "" && !*emulatePar {
 		log.Fatal(errors.New("must specify -p when specifying a Python __main__.py via -pm"))
 	}
@@ -146,7 +170,8 @@ func main() {
 
 	// do merge
 	err = mergeZips(readers, writer, *manifest, *pyMain, *sortEntries, *emulateJar, *emulatePar,
-		*stripDirEntries, *ignoreDuplicates, []string(stripFiles), []string(stripDirs), map[string]bool(zipsToNotStrip))
+		*stripDirEntries, *normalizeDirs, *ignoreDuplicates, *verifyCRCs, *mergeManifests, conflict,
+		[]string(stripFiles), []string(stripDirs), map[string]bool(zipsToNotStrip))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -169,9 +194,15 @@ func (p zipEntryPath) String() string {
 }
 
 // a zipEntry is a zipSource that pulls its content from another zip
+//
+// Its compressed data is copied without being decompressed, so the CRC32 of the input zip
+// is trusted, and corrupt data or a wrong CRC32 is copied into the output unnoticed unless
+// verifyCRC is set.  Input zips written by the build itself are trusted by default because
+// checking them would mean inflating everything that is merged.
 type zipEntry struct {
-	path    zipEntryPath
-	content *zip.File
+	path      zipEntryPath
+	content   *zip.File
+	verifyCRC bool
 }
 
 func (ze zipEntry) String() string {
@@ -191,9 +222,36 @@ func (ze zipEntry) Size() uint64 {
 }
 
 func (ze zipEntry) WriteToZip(dest string, zw *zip.Writer) error {
+	if ze.verifyCRC && !ze.IsDir() {
+		if err := verifyCRC(ze.content); err != nil {
+			return fmt.Errorf("%s: %s", ze, err)
+		}
+	}
 	return zw.CopyFrom(ze.content, dest)
 }
 
+// verifyCRC decompresses f, which fails with zip.ErrChecksum if its data doesn't match its
+// CRC32.
+func verifyCRC(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// readZipFile returns the uncompressed contents of f.
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 // a bufferEntry is a zipSource that pulls its content from a []byte
 type bufferEntry struct {
 	fh      *zip.FileHeader
@@ -247,7 +305,8 @@ type fileMapping struct {
 }
 
 func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain string,
-	sortEntries, emulateJar, emulatePar, stripDirEntries, ignoreDuplicates bool,
+	sortEntries, emulateJar, emulatePar, stripDirEntries, normalizeDirs, ignoreDuplicates, verifyCRCs bool,
+	mergeManifests bool, manifestConflict jar.ManifestConflict,
 	stripFiles, stripDirs []string, zipsToNotStrip map[string]bool) error {
 
 	sourceByDest := make(map[string]zipSource, 0)
@@ -265,19 +324,72 @@ func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain st
 		return nil
 	}
 
+	// with normalizeDirs, addDirs adds a new entry for dir and each of its parents unless
+	// they already have one, parents first
+	addDirs := func(dir string) error {
+		var dirs []string
+		for dir = filepath.Clean(dir); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+			dirs = append([]string{dir}, dirs...)
+		}
+		for _, dir := range dirs {
+			source := bufferEntry{normalizedDirHeader(dir+"/", emulateJar), nil}
+			if existingSource := addMapping(dir+"/", source); existingSource != nil && !existingSource.IsDir() {
+				return fmt.Errorf("Directory/file mismatch at %v from %v and %v\n",
+					dir+"/", existingSource, source)
+			}
+		}
+		return nil
+	}
+
+	var manifests [][]byte
+	var manifestNames []string
 	if manifest != "" {
+		contents, err := ioutil.ReadFile(manifest)
+		if err != nil {
+			return err
+		}
+
+		_, buf, err := jar.ManifestFileContents(contents)
+		if err != nil {
+			return err
+		}
+		manifests = append(manifests, buf)
+		manifestNames = append(manifestNames, manifest)
+	}
+
+	if mergeManifests {
+		for _, namedReader := range readers {
+			for _, file := range namedReader.reader.File {
+				if file.Name != jar.ManifestFile {
+					continue
+				}
+				buf, err := readZipFile(file)
+				if err != nil {
+					return fmt.Errorf("%s: %s", namedReader.path, err)
+				}
+				manifests = append(manifests, buf)
+				manifestNames = append(manifestNames, namedReader.path)
+			}
+		}
+	}
+
+	// Without mergeManifests there is at most the manifest from -m, which is used as it is.
+	if len(manifests) > 0 {
 		if !stripDirEntries {
 			dirHeader := jar.MetaDirFileHeader()
 			dirSource := bufferEntry{dirHeader, nil}
 			addMapping(jar.MetaDir, dirSource)
 		}
 
-		contents, err := ioutil.ReadFile(manifest)
-		if err != nil {
-			return err
+		buf := manifests[0]
+		if mergeManifests {
+			var err error
+			if buf, err = jar.MergeManifests(manifests, manifestNames, manifestConflict); err != nil {
+				return err
+			}
 		}
 
-		fh, buf, err := jar.ManifestFileContents(contents)
+		fh, buf, err := jar.ManifestFileContents(buf)
 		if err != nil {
 			return err
 		}
@@ -345,6 +457,11 @@ func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain st
 			fh.SetMode(0700)
 			fh.SetModTime(jar.DefaultTime)
 			fileSource := bufferEntry{fh, emptyBuf}
+			if normalizeDirs {
+				if err := addDirs(pkg); err != nil {
+					return err
+				}
+			}
 			addMapping(filepath.Join(pkg, "__init__.py"), fileSource)
 		}
 	}
@@ -363,11 +480,25 @@ func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain st
 				continue
 			}
 
+			if normalizeDirs {
+				// directory entries are replaced instead of copied, even the first one
+				if file.FileInfo().IsDir() {
+					if err := addDirs(file.Name); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := addDirs(filepath.Dir(file.Name)); err != nil {
+					return err
+				}
+			}
+
 			// check for other files or directories destined for the same path
 			dest := file.Name
 
 			// make a new entry to add
-			source := zipEntry{path: zipEntryPath{zipName: namedReader.path, entryName: file.Name}, content: file}
+			source := zipEntry{path: zipEntryPath{zipName: namedReader.path, entryName: file.Name}, content: file,
+				verifyCRC: verifyCRCs}
 
 			if existingSource := addMapping(dest, source); existingSource != nil {
 				// handle duplicates
@@ -387,6 +518,7 @@ func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain st
 				}
 
 				if source.IsDir() {
+					// keep the mode and timestamp of the first entry for a directory
 					continue
 				}
 
@@ -415,6 +547,21 @@ func mergeZips(readers []namedZipReader, writer *zip.Writer, manifest, pyMain st
 	return nil
 }
 
+// normalizedDirHeader returns the header of a directory entry that doesn't depend on the
+// input zips.
+func normalizedDirHeader(name string, emulateJar bool) *zip.FileHeader {
+	if emulateJar && name == jar.MetaDir {
+		return jar.MetaDirFileHeader()
+	}
+	fh := &zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	fh.SetMode(os.ModeDir | 0755)
+	fh.SetModTime(jar.DefaultTime)
+	return fh
+}
+
 // Sets the given directory and all its ancestor directories as Python packages.
 func populateNewPyPkgs(pkgPath string, existingPyPkgSet map[string]bool, newPyPkgs *[]string) {
 	for pkgPath != "" {
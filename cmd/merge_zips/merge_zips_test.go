@@ -17,10 +17,12 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"android/soong/jar"
 	"android/soong/third_party/zip"
@@ -38,6 +40,7 @@ var (
 	a2    = testZipEntry{"a", 0755, []byte("FOO2")}
 	a3    = testZipEntry{"a", 0755, []byte("Foo3")}
 	bDir  = testZipEntry{"b/", os.ModeDir | 0755, nil}
+	bDir2 = testZipEntry{"b/", os.ModeDir | 0700, nil}
 	bbDir = testZipEntry{"b/b/", os.ModeDir | 0755, nil}
 	bbb   = testZipEntry{"b/b/b", 0755, nil}
 	ba    = testZipEntry{"b/a", 0755, []byte("foob")}
@@ -133,6 +136,14 @@ func TestMergeZips(t *testing.T) {
 			},
 			out: []testZipEntry{bDir, be, bc, A},
 		},
+		{
+			name: "merge dirs take first",
+			in: [][]testZipEntry{
+				{bDir, be},
+				{bDir2, bc},
+			},
+			out: []testZipEntry{bDir, be, bc},
+		},
 		{
 			name: "strip dir entries",
 			in: [][]testZipEntry{
@@ -222,7 +233,8 @@ func TestMergeZips(t *testing.T) {
 			writer := zip.NewWriter(out)
 
 			err := mergeZips(readers, writer, "", "",
-				test.sort, test.jar, false, test.stripDirEntries, test.ignoreDuplicates,
+				test.sort, test.jar, false, test.stripDirEntries, false, test.ignoreDuplicates, false,
+				false, jar.ManifestConflictError,
 				test.stripFiles, test.stripDirs, test.zipsToNotStrip)
 
 			closeErr := writer.Close()
@@ -248,6 +260,125 @@ func TestMergeZips(t *testing.T) {
 	}
 }
 
+func TestMergeZipsNormalizeDirs(t *testing.T) {
+	type dirEntry struct {
+		name    string
+		mode    os.FileMode
+		modTime time.Time
+	}
+
+	testCases := []struct {
+		name string
+		in   [][]testZipEntry
+		jar  bool
+
+		out []dirEntry
+		err string
+	}{
+		{
+			name: "differing modes",
+			in: [][]testZipEntry{
+				{bDir2, be},
+				{bDir, bbDir, bbb},
+			},
+			out: []dirEntry{
+				{"b/", os.ModeDir | 0755, jar.DefaultTime},
+				{"b/e", 0700, time.Time{}},
+				{"b/b/", os.ModeDir | 0755, jar.DefaultTime},
+				{"b/b/b", 0755, time.Time{}},
+			},
+		},
+		{
+			name: "implied dirs",
+			in: [][]testZipEntry{
+				{bbb, a},
+			},
+			out: []dirEntry{
+				{"b/", os.ModeDir | 0755, jar.DefaultTime},
+				{"b/b/", os.ModeDir | 0755, jar.DefaultTime},
+				{"b/b/b", 0755, time.Time{}},
+				{"a", 0755, time.Time{}},
+			},
+		},
+		{
+			name: "jar",
+			in: [][]testZipEntry{
+				{manifestFile, a},
+			},
+			jar: true,
+			out: []dirEntry{
+				{jar.MetaDir, jar.MetaDirFileHeader().Mode(), jar.DefaultTime},
+				{jar.ManifestFile, 0755, time.Time{}},
+				{"a", 0755, time.Time{}},
+			},
+		},
+		{
+			name: "file and dir",
+			in: [][]testZipEntry{
+				{testZipEntry{"b", 0755, []byte("foo")}},
+				{bc},
+			},
+			err: "Directory/file mismatch",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var readers []namedZipReader
+			for i, in := range test.in {
+				readers = append(readers, namedZipReader{
+					path:   "in" + strconv.Itoa(i),
+					reader: testZipEntriesToZipReader(in),
+				})
+			}
+
+			out := &bytes.Buffer{}
+			writer := zip.NewWriter(out)
+
+			err := mergeZips(readers, writer, "", "",
+				false, test.jar, false, false, true, false, false,
+				false, jar.ManifestConflictError,
+				nil, nil, nil)
+
+			if closeErr := writer.Close(); closeErr != nil {
+				t.Fatal(closeErr)
+			}
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error containing %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []dirEntry
+			for _, f := range zr.File {
+				e := dirEntry{f.Name, f.Mode(), time.Time{}}
+				if f.FileInfo().IsDir() {
+					e.modTime = f.ModTime()
+				}
+				got = append(got, e)
+			}
+
+			if len(got) != len(test.out) {
+				t.Fatalf("want entries %v, got %v", test.out, got)
+			}
+			for i := range got {
+				if got[i].name != test.out[i].name || got[i].mode != test.out[i].mode ||
+					!got[i].modTime.Equal(test.out[i].modTime) {
+					t.Errorf("want entry %v, got %v", test.out[i], got[i])
+				}
+			}
+		})
+	}
+}
+
 func testZipEntriesToBuf(entries []testZipEntry) []byte {
 	b := &bytes.Buffer{}
 	zw := zip.NewWriter(b)
@@ -304,3 +435,146 @@ func dumpZip(buf []byte) string {
 
 	return ret
 }
+
+func TestMergeZipsVerifyCRC(t *testing.T) {
+	for _, verify := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verify=%v", verify), func(t *testing.T) {
+			zr := testZipEntriesToZipReader([]testZipEntry{a, ba})
+			// Corrupt the CRC32 of the second entry, as if it had been written wrong.
+			zr.File[1].CRC32 ^= 1
+
+			out := &bytes.Buffer{}
+			writer := zip.NewWriter(out)
+			err := mergeZips([]namedZipReader{{path: "in", reader: zr}}, writer, "", "",
+				false, false, false, false, false, false, verify,
+				false, jar.ManifestConflictError,
+				nil, nil, nil)
+			if closeErr := writer.Close(); closeErr != nil {
+				t.Fatal(closeErr)
+			}
+
+			if verify {
+				if err == nil || !strings.Contains(err.Error(), "in/b/a: "+zip.ErrChecksum.Error()) {
+					t.Errorf("want checksum error for in/b/a, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("want the CRC32 of the input to be trusted, got %v", err)
+			}
+		})
+	}
+}
+
+func BenchmarkMergeZipsVerifyCRC(b *testing.B) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	data := bytes.Repeat([]byte("merge_zips benchmark data "), 40000)
+	for i := 0; i < 16; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: strconv.Itoa(i), Method: zip.Deflate})
+		if err != nil {
+			b.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		b.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, verify := range []bool{false, true} {
+		b.Run(fmt.Sprintf("verify=%v", verify), func(b *testing.B) {
+			b.SetBytes(int64(16 * len(data)))
+			for i := 0; i < b.N; i++ {
+				writer := zip.NewWriter(ioutil.Discard)
+				err := mergeZips([]namedZipReader{{path: "in", reader: zr}}, writer, "", "",
+					false, false, false, false, false, false, verify,
+					false, jar.ManifestConflictError,
+					nil, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				writer.Close()
+			}
+		})
+	}
+}
+
+func TestMergeZipsMergeManifests(t *testing.T) {
+	manifestA := testZipEntry{jar.ManifestFile, 0755,
+		[]byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nX-Custom: a\n\n")}
+	manifestB := testZipEntry{jar.ManifestFile, 0755,
+		[]byte("Manifest-Version: 1.0\nCreated-By: javac\nX-Custom: b\nX-Other: b\n\n")}
+
+	testCases := []struct {
+		name     string
+		conflict jar.ManifestConflict
+		want     string
+		err      string
+	}{
+		{
+			name: "error",
+			err:  `Created-By in the main section is "soong_zip" in in0 and "javac" in in1`,
+		},
+		{
+			name:     "first",
+			conflict: jar.ManifestConflictFirst,
+			want:     "Manifest-Version: 1.0\nCreated-By: soong_zip\nX-Custom: a\nX-Other: b\n\n",
+		},
+		{
+			name:     "last",
+			conflict: jar.ManifestConflictLast,
+			want:     "Manifest-Version: 1.0\nCreated-By: javac\nX-Custom: b\nX-Other: b\n\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			readers := []namedZipReader{
+				{path: "in0", reader: testZipEntriesToZipReader([]testZipEntry{metainfDir, manifestA, a})},
+				{path: "in1", reader: testZipEntriesToZipReader([]testZipEntry{metainfDir, manifestB, ba})},
+			}
+
+			out := &bytes.Buffer{}
+			writer := zip.NewWriter(out)
+			err := mergeZips(readers, writer, "", "",
+				false, true, false, false, false, false, false,
+				true, test.conflict,
+				nil, nil, nil)
+			if closeErr := writer.Close(); closeErr != nil {
+				t.Fatal(closeErr)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			var got []byte
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+				if f.Name == jar.ManifestFile {
+					if got, err = readZipFile(f); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if want := []string{jar.MetaDir, jar.ManifestFile, "a", "b/a"}; strings.Join(names, " ") != strings.Join(want, " ") {
+				t.Errorf("want entries %q, got %q", want, names)
+			}
+			if string(got) != test.want {
+				t.Errorf("want manifest:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+}
@@ -18,8 +18,11 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"android/soong/third_party/zip"
 )
@@ -28,6 +31,10 @@ const (
 	MetaDir         = "META-INF/"
 	ManifestFile    = MetaDir + "MANIFEST.MF"
 	ModuleInfoClass = "module-info.class"
+
+	// VersionsDir holds the versioned entries of a multi-release jar, in
+	// META-INF/versions/<version>/.
+	VersionsDir = MetaDir + "versions/"
 )
 
 var DefaultTime = time.Date(2008, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -44,6 +51,60 @@ func EntryNamesLess(filepathA string, filepathB string) (less bool) {
 	return diff < 0
 }
 
+// MultiReleaseEntryNamesLess is like EntryNamesLess, but for a multi-release jar, where the
+// versioned entries follow all of the base entries, ordered by version.
+func MultiReleaseEntryNamesLess(filepathA string, filepathB string) (less bool) {
+	versionA, nameA, versionedA := splitVersionedEntry(filepathA)
+	versionB, nameB, versionedB := splitVersionedEntry(filepathB)
+	switch {
+	case versionedA && versionedB:
+		if versionA != versionB {
+			return versionA < versionB
+		}
+		return nameA < nameB
+	case versionedA || versionedB:
+		return versionedB
+	default:
+		return EntryNamesLess(filepathA, filepathB)
+	}
+}
+
+// splitVersionedEntry returns the version and the base name of an entry in VersionsDir, and
+// false if the entry isn't in a version directory.
+func splitVersionedEntry(name string) (version int, base string, versioned bool) {
+	if !strings.HasPrefix(name, VersionsDir) {
+		return 0, "", false
+	}
+	rest := strings.TrimPrefix(name, VersionsDir)
+	i := strings.IndexByte(rest, '/')
+	if i <= 0 || strings.Trim(rest[:i], "0123456789") != "" {
+		return 0, "", false
+	}
+	version, err := strconv.Atoi(rest[:i])
+	if err != nil {
+		return 0, "", false
+	}
+	return version, rest[i+1:], true
+}
+
+// VersionedEntry returns the version and the base name of an entry of a multi-release jar, like
+// 11 and "com/example/A.class" for "META-INF/versions/11/com/example/A.class".  It returns
+// false if the entry isn't versioned, and an error if it is in VersionsDir but isn't a valid
+// versioned entry.
+func VersionedEntry(name string) (version int, base string, versioned bool, err error) {
+	if !strings.HasPrefix(name, VersionsDir) {
+		return 0, "", false, nil
+	}
+	version, base, versioned = splitVersionedEntry(name)
+	if !versioned || base == "" {
+		return 0, "", false, fmt.Errorf("%q is not in a version directory %s<version>/", name, VersionsDir)
+	}
+	if version < 9 {
+		return 0, "", false, fmt.Errorf("%q has version %d, multi-release jars start at version 9", name, version)
+	}
+	return version, base, true, nil
+}
+
 // Treats trailing * as a prefix match
 func patternMatch(pattern, name string) bool {
 	if strings.HasSuffix(pattern, "*") {
@@ -101,7 +162,7 @@ func ManifestFileContents(contents []byte) (*zip.FileHeader, []byte, error) {
 // Create manifest contents, using the provided contents if any.
 func manifestContents(contents []byte) ([]byte, error) {
 	manifestMarker := []byte("Manifest-Version:")
-	header := append(manifestMarker, []byte(" 1.0\nCreated-By: soong_zip\n")...)
+	header := []byte(manifestLine("Manifest-Version", "1.0") + manifestLine("Created-By", "soong_zip"))
 
 	var finalBytes []byte
 	if !bytes.Contains(contents, manifestMarker) {
@@ -112,3 +173,264 @@ func manifestContents(contents []byte) ([]byte, error) {
 
 	return finalBytes, nil
 }
+
+// A ManifestAttribute is a main attribute to add to a manifest.
+type ManifestAttribute struct {
+	Name  string
+	Value string
+}
+
+// AddManifestAttributes returns manifest with attrs added to the end of its main section.  It
+// fails if the main section already has one of the attributes.
+func AddManifestAttributes(manifest []byte, attrs []ManifestAttribute) ([]byte, error) {
+	// The main section ends at the first blank line, or at the end of the manifest.
+	end := len(manifest)
+	for start := 0; start < len(manifest); {
+		lineEnd := bytes.IndexByte(manifest[start:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(manifest)
+		} else {
+			lineEnd += start
+		}
+		line := bytes.TrimSuffix(manifest[start:lineEnd], []byte("\r"))
+		if len(line) == 0 {
+			end = start
+			break
+		}
+
+		if colon := bytes.IndexByte(line, ':'); colon > 0 && line[0] != ' ' {
+			for _, attr := range attrs {
+				if strings.EqualFold(string(line[:colon]), attr.Name) {
+					return nil, fmt.Errorf("manifest already has a %s attribute", attr.Name)
+				}
+			}
+		}
+		start = lineEnd + 1
+	}
+
+	ret := append([]byte(nil), manifest[:end]...)
+	if len(ret) > 0 && ret[len(ret)-1] != '\n' {
+		ret = append(ret, '\n')
+	}
+	for _, attr := range attrs {
+		ret = append(ret, manifestLine(attr.Name, attr.Value)...)
+	}
+	return append(ret, manifest[end:]...), nil
+}
+
+// maxManifestLineLength is the maximum length in bytes of a line of a manifest, not counting
+// the line ending.
+const maxManifestLineLength = 72
+
+// manifestLine returns the manifest line for an attribute, wrapped by wrapManifestLine.
+func manifestLine(name, value string) string {
+	return wrapManifestLine(name+": "+value, "\n")
+}
+
+// wrapManifestLine wraps line onto continuation lines starting with a space so that no line is
+// longer than maxManifestLineLength, and ends each line with newline.  Lines are only split
+// between UTF-8 characters.
+func wrapManifestLine(line, newline string) string {
+	b := &strings.Builder{}
+	limit := maxManifestLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		if i == 0 {
+			// Not UTF-8, split anywhere.
+			i = limit
+		}
+		b.WriteString(line[:i])
+		b.WriteString(newline)
+		b.WriteString(" ")
+		line = line[i:]
+		// Continuation lines have room for one less byte after the leading space.
+		limit = maxManifestLineLength - 1
+	}
+	b.WriteString(line)
+	b.WriteString(newline)
+	return b.String()
+}
+
+// WrapManifestLines returns manifest with all of its lines rewrapped by wrapManifestLine, for
+// manifests written without regard to the line length limit.  Existing continuation lines are
+// joined before rewrapping, and line endings are kept.
+func WrapManifestLines(manifest []byte) []byte {
+	var ret []byte
+	var logical []byte
+	for len(manifest) > 0 {
+		var line, newline []byte
+		if i := bytes.IndexByte(manifest, '\n'); i >= 0 {
+			line, manifest = manifest[:i], manifest[i+1:]
+			newline = []byte("\n")
+			if bytes.HasSuffix(line, []byte("\r")) {
+				line = line[:len(line)-1]
+				newline = []byte("\r\n")
+			}
+		} else {
+			line, manifest = manifest, nil
+		}
+
+		logical = append(logical, line...)
+		if len(line) > 0 && len(manifest) > 0 && manifest[0] == ' ' {
+			// The next line continues this one, drop its leading space and join them.
+			manifest = manifest[1:]
+			continue
+		}
+
+		if newline == nil {
+			// The last line has no line ending, but continuation lines still need one.
+			ret = append(ret, strings.TrimSuffix(wrapManifestLine(string(logical), "\n"), "\n")...)
+		} else {
+			ret = append(ret, wrapManifestLine(string(logical), string(newline))...)
+		}
+		logical = logical[:0]
+	}
+	return ret
+}
+
+// ValidateClassName returns an error if name isn't a valid fully qualified Java class name,
+// like com.example.Main.
+func ValidateClassName(name string) error {
+	for _, ident := range strings.Split(name, ".") {
+		valid := ident != ""
+		for i, r := range ident {
+			if !(unicode.IsLetter(r) || r == '_' || r == '$' || (i > 0 && unicode.IsDigit(r))) {
+				valid = false
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%q is not a valid class name", name)
+		}
+	}
+	return nil
+}
+
+// A ManifestConflict decides what MergeManifests does with an attribute that has different
+// values in the same section of two manifests.
+type ManifestConflict int
+
+const (
+	// ManifestConflictError fails the merge.
+	ManifestConflictError ManifestConflict = iota
+	// ManifestConflictFirst keeps the value from the first manifest that has the attribute.
+	ManifestConflictFirst
+	// ManifestConflictLast keeps the value from the last manifest that has the attribute.
+	ManifestConflictLast
+)
+
+// manifestSection is a section of a manifest, with its attributes in order.  Attribute names
+// are compared without regard to case, and the first spelling is kept.
+type manifestSection struct {
+	name   string
+	attrs  []ManifestAttribute
+	from   []string
+	byName map[string]int
+}
+
+// parseManifestSections splits manifest into its main section and its named sections, with
+// continuation lines joined.
+func parseManifestSections(manifest []byte) ([][]ManifestAttribute, error) {
+	var sections [][]ManifestAttribute
+	var section []ManifestAttribute
+	lines := strings.Split(strings.ReplaceAll(string(manifest), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, " ") {
+			if len(section) == 0 {
+				return nil, fmt.Errorf("line %d: continuation line without an attribute", i+1)
+			}
+			section[len(section)-1].Value += line[1:]
+			continue
+		}
+		if line == "" {
+			if section != nil {
+				sections = append(sections, section)
+				section = nil
+			} else if len(sections) == 0 {
+				// An empty main section.
+				sections = append(sections, []ManifestAttribute{})
+			}
+			continue
+		}
+		colon := strings.Index(line, ": ")
+		if colon <= 0 {
+			return nil, fmt.Errorf("line %d: %q is not an attribute", i+1, line)
+		}
+		section = append(section, ManifestAttribute{Name: line[:colon], Value: line[colon+2:]})
+	}
+	if section != nil {
+		sections = append(sections, section)
+	}
+	if len(sections) == 0 {
+		sections = append(sections, []ManifestAttribute{})
+	}
+	return sections, nil
+}
+
+// MergeManifests returns a manifest with the attributes of the main sections of manifests in
+// its main section, and the attributes of their named sections in one section per Name, with
+// sections and attributes in the order they first appear.  An attribute that has different
+// values in the same section of two manifests is resolved by conflict.  names are the names of
+// the manifests for errors.
+func MergeManifests(manifests [][]byte, names []string, conflict ManifestConflict) ([]byte, error) {
+	main := &manifestSection{byName: make(map[string]int)}
+	named := make(map[string]*manifestSection)
+	var order []*manifestSection
+
+	for i, manifest := range manifests {
+		sections, err := parseManifestSections(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", names[i], err)
+		}
+		for j, attrs := range sections {
+			section := main
+			if j > 0 {
+				if len(attrs) == 0 || !strings.EqualFold(attrs[0].Name, "Name") {
+					return nil, fmt.Errorf("%s: section %d has no Name attribute", names[i], j)
+				}
+				section = named[attrs[0].Value]
+				if section == nil {
+					section = &manifestSection{name: attrs[0].Value, byName: make(map[string]int)}
+					named[section.name] = section
+					order = append(order, section)
+				}
+			}
+			for _, attr := range attrs {
+				key := strings.ToLower(attr.Name)
+				k, exists := section.byName[key]
+				if !exists {
+					section.byName[key] = len(section.attrs)
+					section.attrs = append(section.attrs, attr)
+					section.from = append(section.from, names[i])
+					continue
+				}
+				if section.attrs[k].Value == attr.Value {
+					continue
+				}
+				switch conflict {
+				case ManifestConflictLast:
+					section.attrs[k].Value = attr.Value
+					section.from[k] = names[i]
+				case ManifestConflictError:
+					where := "the main section"
+					if section != main {
+						where = fmt.Sprintf("section %q", section.name)
+					}
+					return nil, fmt.Errorf("%s in %s is %q in %s and %q in %s",
+						section.attrs[k].Name, where, section.attrs[k].Value, section.from[k], attr.Value, names[i])
+				}
+			}
+		}
+	}
+
+	b := &strings.Builder{}
+	for _, section := range append([]*manifestSection{main}, order...) {
+		for _, attr := range section.attrs {
+			b.WriteString(manifestLine(attr.Name, attr.Value))
+		}
+		b.WriteString("\n")
+	}
+	return []byte(b.String()), nil
+}
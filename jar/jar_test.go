@@ -0,0 +1,277 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jar
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestManifestLine(t *testing.T) {
+	testCases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "short",
+			value: "soong_zip",
+			want:  "Created-By: soong_zip\n",
+		},
+		{
+			name:  "exactly 72 bytes",
+			value: strings.Repeat("x", 72-len("Created-By: ")),
+			want:  "Created-By: " + strings.Repeat("x", 60) + "\n",
+		},
+		{
+			name:  "73 bytes",
+			value: strings.Repeat("x", 73-len("Created-By: ")),
+			want:  "Created-By: " + strings.Repeat("x", 60) + "\n x\n",
+		},
+		{
+			name:  "several continuations",
+			value: strings.Repeat("x", 60+71+71+1),
+			want: "Created-By: " + strings.Repeat("x", 60) + "\n " + strings.Repeat("x", 71) + "\n " +
+				strings.Repeat("x", 71) + "\n x\n",
+		},
+		{
+			// The 72nd byte is the middle of a 2 byte character, which must go on the next line.
+			name:  "utf-8",
+			value: strings.Repeat("é", 35),
+			want:  "Created-By: " + strings.Repeat("é", 30) + "\n " + strings.Repeat("é", 5) + "\n",
+		},
+		{
+			name:  "utf-8 split",
+			value: "x" + strings.Repeat("€", 30),
+			want:  "Created-By: x" + strings.Repeat("€", 19) + "\n " + strings.Repeat("€", 11) + "\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got := manifestLine("Created-By", test.value)
+			if got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+				if len(line) > maxManifestLineLength {
+					t.Errorf("line %q is longer than %d bytes", line, maxManifestLineLength)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapManifestLines(t *testing.T) {
+	long := "Class-Path: " + strings.Repeat("lib.jar ", 12)
+	wrapped := long[:72] + "\n " + long[72:]
+
+	testCases := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "empty",
+			in:   "",
+			want: "",
+		},
+		{
+			name: "short lines",
+			in:   "Manifest-Version: 1.0\nCreated-By: soong_zip\n\n",
+			want: "Manifest-Version: 1.0\nCreated-By: soong_zip\n\n",
+		},
+		{
+			name: "long line",
+			in:   "Manifest-Version: 1.0\n" + long + "\n\n",
+			want: "Manifest-Version: 1.0\n" + wrapped + "\n\n",
+		},
+		{
+			name: "already wrapped",
+			in:   "Manifest-Version: 1.0\n" + wrapped + "\n\n",
+			want: "Manifest-Version: 1.0\n" + wrapped + "\n\n",
+		},
+		{
+			name: "badly wrapped",
+			in:   "Manifest-Version: 1.0\n" + long[:20] + "\n " + long[20:] + "\n",
+			want: "Manifest-Version: 1.0\n" + wrapped + "\n",
+		},
+		{
+			name: "crlf",
+			in:   "Manifest-Version: 1.0\r\n" + long + "\r\n\r\n",
+			want: "Manifest-Version: 1.0\r\n" + long[:72] + "\r\n " + long[72:] + "\r\n\r\n",
+		},
+		{
+			name: "no trailing newline",
+			in:   long,
+			want: long[:72] + "\n " + long[72:],
+		},
+		{
+			name: "sections",
+			in:   "Manifest-Version: 1.0\n\nName: a\n" + long + "\n",
+			want: "Manifest-Version: 1.0\n\nName: a\n" + wrapped + "\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got := string(WrapManifestLines([]byte(test.in)))
+			if got != test.want {
+				t.Errorf("want %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestMultiReleaseEntryNamesLess(t *testing.T) {
+	names := []string{
+		"META-INF/versions/11/a/A.class",
+		"b/B.class",
+		"META-INF/versions/9/b/B.class",
+		"META-INF/services/a.A",
+		"META-INF/versions/9/a/A.class",
+		"a/A.class",
+		ManifestFile,
+		"META-INF/",
+	}
+	want := []string{
+		"META-INF/",
+		ManifestFile,
+		"META-INF/services/a.A",
+		"a/A.class",
+		"b/B.class",
+		"META-INF/versions/9/a/A.class",
+		"META-INF/versions/9/b/B.class",
+		"META-INF/versions/11/a/A.class",
+	}
+
+	sort.SliceStable(names, func(i, j int) bool { return MultiReleaseEntryNamesLess(names[i], names[j]) })
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want order %q, got %q", want, names)
+	}
+}
+
+func TestVersionedEntry(t *testing.T) {
+	testCases := []struct {
+		name      string
+		version   int
+		base      string
+		versioned bool
+		err       bool
+	}{
+		{name: "a/A.class"},
+		{name: "META-INF/services/a.A"},
+		{name: "META-INF/versions/9/a/A.class", version: 9, base: "a/A.class", versioned: true},
+		{name: "META-INF/versions/11/A.class", version: 11, base: "A.class", versioned: true},
+		{name: "META-INF/versions/8/a/A.class", err: true},
+		{name: "META-INF/versions/java9/a/A.class", err: true},
+		{name: "META-INF/versions/+9/a/A.class", err: true},
+		{name: "META-INF/versions/A.class", err: true},
+		{name: "META-INF/versions/9/", err: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			version, base, versioned, err := VersionedEntry(test.name)
+			if test.err {
+				if err == nil {
+					t.Errorf("want an error, got version %d %q", version, base)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.version || base != test.base || versioned != test.versioned {
+				t.Errorf("want %d %q %v, got %d %q %v", test.version, test.base, test.versioned, version, base, versioned)
+			}
+		})
+	}
+}
+
+func TestMergeManifests(t *testing.T) {
+	a := "Manifest-Version: 1.0\nCreated-By: soong_zip\nX-Custom: a\n\nName: com/example/\nSealed: true\n\n"
+	b := "Manifest-Version: 1.0\r\nCreated-By: javac\r\nX-Other: b\r\n\r\nName: com/example/\r\nSealed: false\r\n\r\nName: org/\r\nX-Long: " +
+		strings.Repeat("x", 70) + "\r\n " + strings.Repeat("y", 10) + "\r\n\r\n"
+
+	testCases := []struct {
+		name      string
+		manifests []string
+		conflict  ManifestConflict
+		want      string
+		err       string
+	}{
+		{
+			name:      "no conflict",
+			manifests: []string{"Manifest-Version: 1.0\nX-Custom: a\n", "Manifest-Version: 1.0\nx-custom: a\nX-Other: b\n"},
+			want:      "Manifest-Version: 1.0\nX-Custom: a\nX-Other: b\n\n",
+		},
+		{
+			name:      "error",
+			manifests: []string{a, b},
+			err:       `Created-By in the main section is "soong_zip" in a and "javac" in b`,
+		},
+		{
+			name:      "error in named section",
+			manifests: []string{a, strings.Replace(b, "javac", "soong_zip", 1)},
+			err:       `Sealed in section "com/example/" is "true" in a and "false" in b`,
+		},
+		{
+			name:      "first",
+			manifests: []string{a, b},
+			conflict:  ManifestConflictFirst,
+			want: "Manifest-Version: 1.0\nCreated-By: soong_zip\nX-Custom: a\nX-Other: b\n\n" +
+				"Name: com/example/\nSealed: true\n\n" +
+				"Name: org/\n" + manifestLine("X-Long", strings.Repeat("x", 70)+strings.Repeat("y", 10)) + "\n",
+		},
+		{
+			name:      "last",
+			manifests: []string{a, b},
+			conflict:  ManifestConflictLast,
+			want: "Manifest-Version: 1.0\nCreated-By: javac\nX-Custom: a\nX-Other: b\n\n" +
+				"Name: com/example/\nSealed: false\n\n" +
+				"Name: org/\n" + manifestLine("X-Long", strings.Repeat("x", 70)+strings.Repeat("y", 10)) + "\n",
+		},
+		{
+			name:      "section without name",
+			manifests: []string{"Manifest-Version: 1.0\n\nSealed: true\n"},
+			err:       "a: section 1 has no Name attribute",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var manifests [][]byte
+			for _, m := range test.manifests {
+				manifests = append(manifests, []byte(m))
+			}
+			got, err := MergeManifests(manifests, []string{"a", "b"}[:len(manifests)], test.conflict)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("want:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+}
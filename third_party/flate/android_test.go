@@ -0,0 +1,79 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flate
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+// fixture returns deterministic input with a mix of repeated text and noise.
+func fixture() []byte {
+	buf := &bytes.Buffer{}
+	seed := uint32(1)
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(buf, "line %d of the fixture for the pinned flate encoder\n", i%37)
+		for j := 0; j < 16; j++ {
+			seed = seed*1103515245 + 12345
+			buf.WriteByte(byte(seed >> 16))
+		}
+	}
+	return buf.Bytes()
+}
+
+// The compressed output of the fixture must never change, that's the point of pinning the
+// encoder.  If this test fails after updating the package, any archives built with
+// -stable-deflate will change too.
+func TestPinnedOutput(t *testing.T) {
+	golden := map[int]string{
+		1: "3457f5a8557c3e388e0c237d09b52c420baf7401b44efb77e9279b866df7281e",
+		2: "aa1f6364d1484a421852d19fa070d2b252388622041dc422c721d213edb058d2",
+		3: "c03145d02455e5d2e92abff6b25d95e7f8b679faa81f114f92366e5c290d8c74",
+		4: "5d80d880a9a734a44d752e2739f6f19c99586f9b82d94ddfa8008238aa6dc74d",
+		5: "1b158b63cff09edc56790ef21498a17c847101f76b498a8490bd46d181a41e90",
+		6: "4cc76fc6338a23598e0ed62b17d9827966fe4764ba8bec1145f92a1e50f4d47e",
+		7: "ee58838aa42bd41ca84b4aa10354dda8102b9ed02f3b3c655b82b7492542a218",
+		8: "344ea1e4d06a83a510761b0be1a89be63025aefdb0d4386b6c908743d173921e",
+		9: "d7178d3aed6aad8d36a196bd1df8a399dfff8e83a563eae638d820bfe1c1d0eb",
+	}
+
+	input := fixture()
+	for level := BestSpeed; level <= BestCompression; level++ {
+		buf := &bytes.Buffer{}
+		w, err := NewWriter(buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(input)
+		w.Close()
+
+		got := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+		if got != golden[level] {
+			t.Errorf("level %d: want output hash %s, got %s", level, golden[level], got)
+		}
+
+		out, err := ioutil.ReadAll(flate.NewReader(buf))
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		if !bytes.Equal(out, input) {
+			t.Errorf("level %d: output does not decompress to the input", level)
+		}
+	}
+}
@@ -15,8 +15,11 @@
 package zip
 
 import (
+	"bufio"
 	"errors"
+	"fmt"
 	"io"
+	"time"
 )
 
 const DataDescriptorFlag = 0x8
@@ -107,6 +110,93 @@ func stripExtras(input []byte) []byte {
 	return ret
 }
 
+// NewWriterSize returns a new Writer writing a zip file to w, buffering writes to w in a buffer
+// of at least size bytes instead of the default 4096.
+func NewWriterSize(w io.Writer, size int) *Writer {
+	return &Writer{cw: &countWriter{w: bufio.NewWriterSize(w, size)}}
+}
+
+// LastEntryOffset returns the offset in the zip file of the local file header of the entry
+// that was created last, or -1 if no entry has been created.
+func (w *Writer) LastEntryOffset() int64 {
+	if len(w.dir) == 0 {
+		return -1
+	}
+	return int64(w.dir[len(w.dir)-1].offset)
+}
+
+// Offset returns the offset in the zip file that the next byte written will be at, including
+// the bytes still buffered by the Writer.  Once the last entry has been closed, it is the
+// offset of the end of that entry, where the central directory will start.
+func (w *Writer) Offset() int64 {
+	return w.cw.count
+}
+
+// SetCentralDirectoryWriter makes Close also write the central directory, followed by the
+// end of central directory records, to cdw.  The zip file itself is unchanged.
+func (w *Writer) SetCentralDirectoryWriter(cdw io.Writer) {
+	w.centralDirectory = cdw
+}
+
+// SetForceZip64 makes Close write the central directory entry of every entry with the zip64
+// extra holding its sizes and offset, and the zip64 end of central directory records, even
+// when the zip doesn't need them, for readers that can't handle a mix of zip64 and regular
+// records.  Local headers and data descriptors still only use zip64 when the entry needs it.
+func (w *Writer) SetForceZip64(force bool) {
+	w.forceZip64 = force
+}
+
+// ExtendedTimestamp returns an extended-timestamp extra block for a Local File Header with
+// the given modification, access and change times.  The Central Directory Header written
+// by Close only keeps the modification time.
+func ExtendedTimestamp(modTime, accessTime, changeTime time.Time) []byte {
+	buf := make([]byte, 4+1+3*4)
+	b := writeBuf(buf)
+	b.uint16(ExtendedTimeStampTag)
+	b.uint16(uint16(len(buf) - 4))
+	b[0] = 7 // modtime, actime and changetime are present
+	b = b[1:]
+	b.uint32(uint32(modTime.Unix()))
+	b.uint32(uint32(accessTime.Unix()))
+	b.uint32(uint32(changeTime.Unix()))
+	return buf
+}
+
+// centralDirectoryExtra returns the extras to write in the Central Directory Header for
+// a Local File Header with the given extras.  The extended-timestamp extra is cut down to
+// its flags and modification time, the other times are only in the Local File Header.
+func centralDirectoryExtra(input []byte) []byte {
+	ret := []byte{}
+
+	for len(input) >= 4 {
+		r := readBuf(input)
+		tag := r.uint16()
+		size := r.uint16()
+		if int(size) > len(r) {
+			break
+		}
+		block := input[:4+size]
+		if tag == ExtendedTimeStampTag && size > 0 {
+			centralSize := uint16(1)
+			if block[4]&1 != 0 {
+				centralSize += 4
+			}
+			if centralSize < size {
+				block = append([]byte(nil), block[:4+centralSize]...)
+				b := writeBuf(block[2:])
+				b.uint16(centralSize)
+			}
+		}
+		ret = append(ret, block...)
+		input = input[4+size:]
+	}
+
+	// Keep any trailing data
+	ret = append(ret, input...)
+
+	return ret
+}
+
 // CreateCompressedHeader adds a file to the zip file using the provied
 // FileHeader for the file metadata.
 // It returns a Writer to which the already compressed file contents
@@ -161,13 +251,62 @@ func (w *Writer) CreateCompressedHeader(fh *FileHeader) (io.WriteCloser, error)
 func (w *Writer) CreateHeaderAndroid(fh *FileHeader) (io.Writer, error) {
 	writeDataDescriptor := fh.Method != Store
 	if writeDataDescriptor {
-		fh.Flags &= DataDescriptorFlag
+		fh.Flags |= DataDescriptorFlag
 	} else {
 		fh.Flags &= ^uint16(DataDescriptorFlag)
 	}
 	return w.createHeaderImpl(fh)
 }
 
+// CreateHeaderWithDataDescriptor is CreateHeaderAndroid, but also writes a data descriptor after
+// a stored entry, with zeros for the CRC32 and sizes in its local header, for consumers that
+// expect every entry to have one.  The CRC32 and sizes of fh don't have to be filled out, and
+// a stored entry may need zip64.  The returned writer closes the entry, which otherwise stays
+// open until the next entry is created or the Writer is closed.
+func (w *Writer) CreateHeaderWithDataDescriptor(fh *FileHeader) (io.WriteCloser, error) {
+	fh.Flags |= DataDescriptorFlag
+	fw, err := w.createHeaderImpl(fh)
+	if err != nil {
+		return nil, err
+	}
+	return fileWriteCloser{fw.(*fileWriter)}, nil
+}
+
+// fileWriteCloser closes the entry of a fileWriter.
+type fileWriteCloser struct {
+	*fileWriter
+}
+
+func (w fileWriteCloser) Close() error {
+	return w.close()
+}
+
+// localHeaderSizes returns the sizes written to the local header of an entry that doesn't have a
+// data descriptor.
+func localHeaderSizes(fh *FileHeader) (compressed, uncompressed uint32) {
+	compressed = uint32(fh.CompressedSize64)
+	if compressed == 0 {
+		compressed = fh.CompressedSize
+	}
+	uncompressed = uint32(fh.UncompressedSize64)
+	if uncompressed == 0 {
+		uncompressed = fh.UncompressedSize
+	}
+	return compressed, uncompressed
+}
+
+// checkLocalHeader returns an error if the crc and sizes written to the local header of an entry
+// that doesn't have a data descriptor don't match its contents.  Readers that stream the local
+// headers instead of reading the central directory rely on them.
+func checkLocalHeader(fh *FileHeader, crc uint32, compressed, uncompressed int64) error {
+	localCompressed, localUncompressed := localHeaderSizes(fh)
+	if fh.CRC32 != crc || int64(localCompressed) != compressed || int64(localUncompressed) != uncompressed {
+		return fmt.Errorf("zip: local header of %q has crc32 %08x and sizes %d/%d, but its contents have crc32 %08x and sizes %d/%d",
+			fh.Name, fh.CRC32, localCompressed, localUncompressed, crc, compressed, uncompressed)
+	}
+	return nil
+}
+
 type compressedFileWriter struct {
 	fileWriter
 }
@@ -16,6 +16,8 @@ package zip
 
 import (
 	"bytes"
+	"hash/crc32"
+	"io/ioutil"
 	"testing"
 )
 
@@ -74,3 +76,262 @@ func TestStripZip64Extras(t *testing.T) {
 		}
 	}
 }
+
+var centralDirectoryExtraTestcases = []struct {
+	name string
+	in   []byte
+	out  []byte
+}{
+	{
+		name: "empty",
+		in:   []byte{},
+		out:  []byte{},
+	},
+	{
+		name: "non-timestamp extras",
+		in:   []byte{2, 0, 2, 0, 1, 2, 1, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8},
+		out:  []byte{2, 0, 2, 0, 1, 2, 1, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8},
+	},
+	{
+		name: "all times",
+		in:   []byte{85, 84, 13, 0, 7, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		out:  []byte{85, 84, 5, 0, 7, 1, 2, 3, 4},
+	},
+	{
+		name: "modtime only",
+		in:   []byte{85, 84, 5, 0, 1, 1, 2, 3, 4},
+		out:  []byte{85, 84, 5, 0, 1, 1, 2, 3, 4},
+	},
+	{
+		name: "access time only",
+		in:   []byte{85, 84, 5, 0, 2, 1, 2, 3, 4},
+		out:  []byte{85, 84, 1, 0, 2},
+	},
+	{
+		name: "timestamp between other extras",
+		in:   []byte{2, 0, 0, 0, 85, 84, 9, 0, 3, 1, 2, 3, 4, 5, 6, 7, 8, 2, 0, 1, 0, 9},
+		out:  []byte{2, 0, 0, 0, 85, 84, 5, 0, 3, 1, 2, 3, 4, 2, 0, 1, 0, 9},
+	},
+	{
+		name: "invalid extra",
+		in:   []byte{85, 84, 13, 0, 7, 1},
+		out:  []byte{85, 84, 13, 0, 7, 1},
+	},
+}
+
+func TestCentralDirectoryExtra(t *testing.T) {
+	for _, testcase := range centralDirectoryExtraTestcases {
+		got := centralDirectoryExtra(testcase.in)
+		if !bytes.Equal(got, testcase.out) {
+			t.Errorf("Failed testcase %s\ninput: %v\n want: %v\n  got: %v\n", testcase.name, testcase.in, testcase.out, got)
+		}
+	}
+}
+
+func TestCreateHeaderAndroid(t *testing.T) {
+	contents := []byte("stored contents")
+	crc := crc32.ChecksumIEEE(contents)
+	size := uint64(len(contents))
+
+	testcases := []struct {
+		name string
+		fh   FileHeader
+		ok   bool
+	}{
+		{
+			name: "stored",
+			fh:   FileHeader{Method: Store, CRC32: crc, CompressedSize64: size, UncompressedSize64: size},
+			ok:   true,
+		},
+		{
+			name: "deflated",
+			fh:   FileHeader{Method: Deflate, Flags: 0x800},
+			ok:   true,
+		},
+		{
+			name: "stored with wrong crc",
+			fh:   FileHeader{Method: Store, CRC32: crc + 1, CompressedSize64: size, UncompressedSize64: size},
+		},
+		{
+			name: "stored with wrong size",
+			fh:   FileHeader{Method: Store, CRC32: crc, CompressedSize64: size - 1, UncompressedSize64: size - 1},
+		},
+	}
+
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := NewWriter(buf)
+			fh := testcase.fh
+			fh.Name = "file"
+			fw, err := w.CreateHeaderAndroid(&fh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fw.Write(contents); err != nil {
+				t.Fatal(err)
+			}
+			err = w.Close()
+			if !testcase.ok {
+				if err == nil {
+					t.Fatal("expected an error for a local header that doesn't match the contents")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := r.File[0]
+			if wantDataDescriptor := fh.Method != Store; f.hasDataDescriptor() != wantDataDescriptor {
+				t.Errorf("want data descriptor %v, got flags %#x", wantDataDescriptor, f.Flags)
+			}
+			if f.Flags&0x800 != fh.Flags&0x800 {
+				t.Errorf("want flags %#x preserved, got %#x", fh.Flags&0x800, f.Flags)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("want contents %q, got %q", contents, got)
+			}
+		})
+	}
+}
+
+func TestCreateHeaderWithDataDescriptor(t *testing.T) {
+	contents := []byte("stored contents")
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	fw, err := w.CreateHeaderWithDataDescriptor(&FileHeader{Name: "file", Method: Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data descriptor is written by Close, before the next entry.
+	want := len(contents) + dataDescriptorLen
+	if got := int(w.cw.count) - fileHeaderLen - len("file"); got != want {
+		t.Errorf("want %d bytes of contents and data descriptor, got %d", want, got)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := r.File[0]
+	if !f.hasDataDescriptor() || f.Method != Store {
+		t.Errorf("want a stored entry with a data descriptor, got method %d and flags %#x", f.Method, f.Flags)
+	}
+	if f.CRC32 != crc32.ChecksumIEEE(contents) || f.UncompressedSize64 != uint64(len(contents)) {
+		t.Errorf("want crc %#x and size %d, got %#x and %d", crc32.ChecksumIEEE(contents), len(contents),
+			f.CRC32, f.UncompressedSize64)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Errorf("want contents %q, got %q", contents, got)
+	}
+}
+
+func TestSetForceZip64(t *testing.T) {
+	files := []struct {
+		name     string
+		method   uint16
+		contents []byte
+	}{
+		{"stored", Store, []byte("stored contents")},
+		{"deflated", Deflate, bytes.Repeat([]byte("deflated contents"), 10)},
+	}
+
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.SetForceZip64(true)
+	var offsets []int64
+	for _, file := range files {
+		fw, err := w.CreateHeader(&FileHeader{Name: file.name, Method: file.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, w.LastEntryOffset())
+		if _, err := fw.Write(file.contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The end of central directory record points to the zip64 records.
+	end := buf.Bytes()[buf.Len()-directoryEndLen:]
+	eb := readBuf(end[8:])
+	if records := eb.uint16(); records != uint16max {
+		t.Errorf("want %#x records in the end of central directory record, got %#x", uint16max, records)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.File) != len(files) {
+		t.Fatalf("want %d entries, got %d", len(files), len(r.File))
+	}
+	for i, f := range r.File {
+		if f.CompressedSize != uint32max || f.UncompressedSize != uint32max || f.ReaderVersion != zipVersion45 {
+			t.Errorf("%s: want 32-bit sizes %#x and version %d, got %#x, %#x and %d", f.Name, uint32max,
+				zipVersion45, f.CompressedSize, f.UncompressedSize, f.ReaderVersion)
+		}
+		if f.headerOffset != offsets[i] {
+			t.Errorf("%s: want offset %d, got %d", f.Name, offsets[i], f.headerOffset)
+		}
+
+		want := make([]byte, 28)
+		b := writeBuf(want)
+		b.uint16(zip64ExtraId)
+		b.uint16(24)
+		b.uint64(f.UncompressedSize64)
+		b.uint64(f.CompressedSize64)
+		b.uint64(uint64(offsets[i]))
+		if !bytes.Equal(f.Extra, want) {
+			t.Errorf("%s: want zip64 extra %v, got %v", f.Name, want, f.Extra)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, files[i].contents) {
+			t.Errorf("%s: want contents %q, got %q", f.Name, files[i].contents, got)
+		}
+	}
+}
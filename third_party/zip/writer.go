@@ -22,6 +22,12 @@ type Writer struct {
 	last        *fileWriter
 	closed      bool
 	compressors map[uint16]Compressor
+
+	// ANDROID CHANGE: see SetCentralDirectoryWriter
+	centralDirectory io.Writer
+
+	// ANDROID CHANGE: see SetForceZip64
+	forceZip64 bool
 }
 
 type header struct {
@@ -65,9 +71,23 @@ func (w *Writer) Close() error {
 	}
 	w.closed = true
 
+	// BEGIN ANDROID CHANGE optionally copy the central directory to another writer
+	cw := w.cw
+	if w.centralDirectory != nil {
+		cw = &countWriter{w: io.MultiWriter(w.cw, w.centralDirectory), count: w.cw.count}
+	}
+	// END ANDROID CHANGE
+
 	// write central directory
-	start := w.cw.count
+	start := cw.count
 	for _, h := range w.dir {
+		h.Extra = centralDirectoryExtra(h.Extra)
+
+		// ANDROID CHANGE: optionally use zip64 for every entry, see SetForceZip64
+		if w.forceZip64 {
+			h.ReaderVersion = zipVersion45
+		}
+
 		var buf [directoryHeaderLen]byte
 		b := writeBuf(buf[:])
 		b.uint32(uint32(directoryHeaderSignature))
@@ -78,7 +98,7 @@ func (w *Writer) Close() error {
 		b.uint16(h.ModifiedTime)
 		b.uint16(h.ModifiedDate)
 		b.uint32(h.CRC32)
-		if h.isZip64() || h.offset >= uint32max {
+		if h.isZip64() || h.offset >= uint32max || w.forceZip64 {
 			// the file needs a zip64 header. store maxint in both
 			// 32 bit size fields (and offset later) to signal that the
 			// zip64 extra header should be used.
@@ -103,31 +123,31 @@ func (w *Writer) Close() error {
 		b.uint16(uint16(len(h.Comment)))
 		b = b[4:] // skip disk number start and internal file attr (2x uint16)
 		b.uint32(h.ExternalAttrs)
-		if h.offset > uint32max {
+		if h.offset > uint32max || w.forceZip64 {
 			b.uint32(uint32max)
 		} else {
 			b.uint32(uint32(h.offset))
 		}
-		if _, err := w.cw.Write(buf[:]); err != nil {
+		if _, err := cw.Write(buf[:]); err != nil {
 			return err
 		}
-		if _, err := io.WriteString(w.cw, h.Name); err != nil {
+		if _, err := io.WriteString(cw, h.Name); err != nil {
 			return err
 		}
-		if _, err := w.cw.Write(h.Extra); err != nil {
+		if _, err := cw.Write(h.Extra); err != nil {
 			return err
 		}
-		if _, err := io.WriteString(w.cw, h.Comment); err != nil {
+		if _, err := io.WriteString(cw, h.Comment); err != nil {
 			return err
 		}
 	}
-	end := w.cw.count
+	end := cw.count
 
 	records := uint64(len(w.dir))
 	size := uint64(end - start)
 	offset := uint64(start)
 
-	if records > uint16max || size > uint32max || offset > uint32max {
+	if records > uint16max || size > uint32max || offset > uint32max || w.forceZip64 {
 		var buf [directory64EndLen + directory64LocLen]byte
 		b := writeBuf(buf[:])
 
@@ -149,7 +169,7 @@ func (w *Writer) Close() error {
 		b.uint64(uint64(end)) // relative offset of the zip64 end of central directory record
 		b.uint32(1)           // total number of disks
 
-		if _, err := w.cw.Write(buf[:]); err != nil {
+		if _, err := cw.Write(buf[:]); err != nil {
 			return err
 		}
 
@@ -170,7 +190,7 @@ func (w *Writer) Close() error {
 	b.uint32(uint32(size))    // size of directory
 	b.uint32(uint32(offset))  // start of directory
 	// skipped size of comment (always zero)
-	if _, err := w.cw.Write(buf[:]); err != nil {
+	if _, err := cw.Write(buf[:]); err != nil {
 		return err
 	}
 
@@ -279,15 +299,7 @@ func writeHeader(w io.Writer, h *FileHeader) error {
 		if h.CompressedSize64 > uint32max || h.UncompressedSize64 > uint32max {
 			panic("skipping writing the data descriptor for a 64-bit value is not yet supported")
 		}
-		compressedSize := uint32(h.CompressedSize64)
-		if compressedSize == 0 {
-			compressedSize = h.CompressedSize
-		}
-
-		uncompressedSize := uint32(h.UncompressedSize64)
-		if uncompressedSize == 0 {
-			uncompressedSize = h.UncompressedSize
-		}
+		compressedSize, uncompressedSize := localHeaderSizes(h)
 
 		b.uint32(compressedSize)
 		b.uint32(uncompressedSize)
@@ -354,6 +366,13 @@ func (w *fileWriter) close() (err error) {
 
 	// update FileHeader
 	fh := w.header.FileHeader
+	// BEGIN ANDROID CHANGE the local header already has the crc and sizes if there is no data descriptor
+	if fh.Flags&DataDescriptorFlag == 0 {
+		if err := checkLocalHeader(fh, w.crc32.Sum32(), w.compCount.count, w.rawCount.count); err != nil {
+			return err
+		}
+	}
+	// END ANDROID CHANGE
 	fh.CRC32 = w.crc32.Sum32()
 	fh.CompressedSize64 = uint64(w.compCount.count)
 	fh.UncompressedSize64 = uint64(w.rawCount.count)
@@ -0,0 +1,89 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+const (
+	// adaptiveSampleSize is the size of the sample deflated by sampleLevel.  Files smaller than
+	// twice the sample use the configured level, since sampling them would cost about as much
+	// as compressing them.
+	adaptiveSampleSize = 64 * 1024
+
+	// adaptiveMinGain is the fraction of the sample that a slower level must save over the
+	// previous level to be picked.
+	adaptiveMinGain = 0.01
+)
+
+// adaptiveLevels are the levels tried by sampleLevel, from fastest to slowest.  Each one takes
+// roughly twice as long as the one before it.
+var adaptiveLevels = []int{1, 6, 9}
+
+// sampleLevel returns the compression level to use for a file of size bytes read from r, and
+// leaves r at the start of the file.  It
+// deflates a sample from the middle of the file at each of adaptiveLevels, and picks the slowest
+// level that still saves at least adaptiveMinGain of the sample over the next faster one.  Files
+// that don't compress or that compress well at any level use a fast level, while files where the
+// slower levels make a difference use them.
+//
+// The choice only depends on the sizes of the samples, not on how long they took, so the output
+// is still reproducible.  Sampling costs two or three extra compressions of adaptiveSampleSize
+// bytes per file, usually a few milliseconds, but up to about 25ms when level 9 is tried on very
+// repetitive text.
+func (z *ZipWriter) sampleLevel(r io.ReadSeeker, size int64) (int, error) {
+	if size < 2*adaptiveSampleSize {
+		return z.compLevel, nil
+	}
+
+	sample := make([]byte, adaptiveSampleSize)
+	if _, err := r.Seek((size-adaptiveSampleSize)/2, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, sample); err != nil {
+		return 0, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	deflatedSize := func(level int) (int, error) {
+		buf, err := z.compressBlock(bytes.NewReader(sample), nil, level, true, time.Time{})
+		if err != nil {
+			return 0, err
+		}
+		return buf.Len(), nil
+	}
+
+	level := adaptiveLevels[0]
+	prevSize, err := deflatedSize(level)
+	if err != nil {
+		return 0, err
+	}
+	for _, l := range adaptiveLevels[1:] {
+		size, err := deflatedSize(l)
+		if err != nil {
+			return 0, err
+		}
+		if float64(prevSize-size) < adaptiveMinGain*float64(len(sample)) {
+			break
+		}
+		level, prevSize = l, size
+	}
+	return level, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"android/soong/jar"
+	"android/soong/third_party/zip"
+)
+
+// appendedEntry is an entry of one of ZipArgs.AppendZips, whose data is read from r, the zip
+// file it is in.
+type appendedEntry struct {
+	f *zip.File
+	r io.ReaderAt
+}
+
+func (e *appendedEntry) isDir() bool {
+	return strings.HasSuffix(e.f.Name, "/")
+}
+
+// appendZipMappings opens the zip file src and returns a mapping for each of its entries at the
+// same path in the zip.  The file stays open until the zip has been written.  With --jar the
+// manifest of the appended zip is skipped, since the jar gets its own.
+func (z *ZipWriter) appendZipMappings(src string) ([]pathMapping, error) {
+	f, err := z.fs.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("appended zip %q: %s", src, err)
+	}
+	z.appendedZips = append(z.appendedZips, f)
+
+	mappings := make([]pathMapping, 0, len(zr.File))
+	for _, zf := range zr.File {
+		if zf.Method != zip.Store && zf.Method != zip.Deflate {
+			return nil, fmt.Errorf("%q in appended zip %q has unsupported compression method %d",
+				zf.Name, src, zf.Method)
+		}
+		dest := zipPath(strings.TrimSuffix(zf.Name, "/"))
+		if z.emulateJar && dest == jar.ManifestFile {
+			z.exclude(src+"!"+zf.Name, "jar manifest")
+			continue
+		}
+		mappings = append(mappings, pathMapping{
+			dest:      dest,
+			src:       src + "!" + zf.Name,
+			zipMethod: zf.Method,
+			appended:  &appendedEntry{f: zf, r: f},
+		})
+	}
+	return mappings, nil
+}
+
+// closeAppendedZips closes the zip files opened by appendZipMappings.
+func (z *ZipWriter) closeAppendedZips() {
+	for _, f := range z.appendedZips {
+		f.Close()
+	}
+	z.appendedZips = nil
+}
+
+// addZipEntry copies the entry e of an appended zip to dest, with its compressed data, method,
+// CRC32 and modification time as they are.  The CRC32 is checked against ZipArgs.ExcludedCRCs
+// like the one of any other entry.  Directory entries are only added with
+// ZipArgs.AddDirectoryEntriesToZip, like source directories.
+func (z *ZipWriter) addZipEntry(dest, src string, e *appendedEntry, emulateJar bool) error {
+	orig := e.f.FileHeader
+	if e.isDir() {
+		if z.directories {
+			z.explicitDirs[path.Clean(dest)] = true
+			var mode os.FileMode
+			if z.preserveDirModes {
+				mode = orig.Mode().Perm()
+			}
+			return z.writeDirectory(dest, src, mode, orig.ModTime(), emulateJar)
+		}
+		return nil
+	}
+
+	if err := z.writeDirectory(path.Dir(dest), src, 0, z.time, emulateJar); err != nil {
+		return err
+	}
+
+	if prev, exists := z.createdDirs[dest]; exists {
+		return fmt.Errorf("destination %q is both a directory %q and a file %q", dest, prev, src)
+	}
+	if prev, exists := z.createdFiles[dest]; exists {
+		return fmt.Errorf("destination %q has two files %q and %q", dest, prev, src)
+	}
+
+	z.createdFiles[dest] = src
+
+	offset, err := e.f.DataOffset()
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+
+	header := &zip.FileHeader{
+		Name:               dest,
+		CreatorVersion:     orig.CreatorVersion,
+		Method:             orig.Method,
+		CRC32:              orig.CRC32,
+		CompressedSize64:   orig.CompressedSize64,
+		UncompressedSize64: orig.UncompressedSize64,
+		ExternalAttrs:      orig.ExternalAttrs,
+	}
+	z.setModTime(header, orig.ModTime())
+	if err := z.checkCRC(header); err != nil {
+		return err
+	}
+
+	compressChan := make(chan *zipEntry, 1)
+	if err := z.queue(compressChan); err != nil {
+		return err
+	}
+
+	// The compressed data is written as is, so the entry is ready right away.
+	resultChan := make(chan io.Reader, 1)
+	resultChan <- io.NewSectionReader(e.r, offset, int64(orig.CompressedSize64))
+	ze := &zipEntry{
+		fh:            header,
+		futureReaders: make(chan chan io.Reader, 1),
+		src:           src,
+	}
+	ze.futureReaders <- resultChan
+	close(ze.futureReaders)
+	compressChan <- ze
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// tempOutputs are the temporary files of ZipArgs.AtomicWrite that haven't been renamed to their
+// outputs or removed yet, for RemoveTempOutputs.
+var tempOutputs = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// createTempOutput creates the temporary file that a zip with ZipArgs.AtomicWrite is written to
+// before it is renamed to output.  It is in the directory of output so that the rename is atomic,
+// and its name is output with the pid and a random suffix, so that soong_zip processes writing
+// to the same directory, or even to the same output, never write to the same file.  It must be
+// released with releaseTempOutput.
+func createTempOutput(output string) (*os.File, string, error) {
+	for {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, "", err
+		}
+		path := fmt.Sprintf("%s.tmp.%d.%s", output, os.Getpid(), hex.EncodeToString(suffix))
+
+		tempOutputs.Lock()
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			tempOutputs.paths[path] = true
+		}
+		tempOutputs.Unlock()
+
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return nil, "", err
+		}
+		return f, path, nil
+	}
+}
+
+// releaseTempOutput forgets path once it has been renamed or removed.
+func releaseTempOutput(path string) {
+	tempOutputs.Lock()
+	defer tempOutputs.Unlock()
+	delete(tempOutputs.paths, path)
+}
+
+// RemoveTempOutputs removes the temporary files of the zips with ZipArgs.AtomicWrite that are
+// still being written.  It is meant to be called when the process is interrupted by a signal,
+// which doesn't run the cleanup of Zip, just before it exits.
+func RemoveTempOutputs() {
+	tempOutputs.Lock()
+	defer tempOutputs.Unlock()
+	for path := range tempOutputs.paths {
+		os.Remove(path)
+		delete(tempOutputs.paths, path)
+	}
+}
+
+// writeFileAtomicallyIfChanged writes contents to output through a temporary file like
+// ZipArgs.AtomicWrite, unless output already has those contents.
+func writeFileAtomicallyIfChanged(output string, contents []byte) (err error) {
+	if old, err := ioutil.ReadFile(output); err == nil && bytes.Equal(old, contents) {
+		return nil
+	}
+
+	f, path, err := createTempOutput(output)
+	if err != nil {
+		return err
+	}
+	defer releaseTempOutput(path)
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	if _, err = f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path, output)
+}
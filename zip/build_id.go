@@ -0,0 +1,106 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"android/soong/third_party/zip"
+)
+
+// Zip files written with ZipArgs.BuildID have a stored entry BuildIDName whose central
+// directory header has a BuildIDTag extra field holding the raw bytes of the build ID.  The
+// entry's contents are the build ID in hex followed by a newline, so that it can also be read
+// with standard tools.  Use ReadBuildID to extract it.
+const (
+	BuildIDName = ".soong_zip_build_id"
+	BuildIDTag  = 0x4942
+)
+
+// maxBuildIDSize is the largest build ID accepted, which is large enough for any hash.
+const maxBuildIDSize = 64
+
+// ParseBuildID decodes a build ID written as an even number of hex digits.
+func ParseBuildID(s string) ([]byte, error) {
+	id, err := hex.DecodeString(s)
+	if err != nil || len(id) == 0 {
+		return nil, fmt.Errorf("build ID %q is not an even number of hex digits", s)
+	}
+	if len(id) > maxBuildIDSize {
+		return nil, fmt.Errorf("build ID %q is longer than %d bytes", s, maxBuildIDSize)
+	}
+	return id, nil
+}
+
+// buildIDMapping returns the mapping that stores id at BuildIDName.
+func buildIDMapping(id []byte) pathMapping {
+	return pathMapping{
+		dest:      BuildIDName,
+		src:       BuildIDName,
+		zipMethod: zip.Store,
+		contents:  []byte(hex.EncodeToString(id) + "\n"),
+	}
+}
+
+// buildIDExtra returns the extra field that holds id.
+func buildIDExtra(id []byte) []byte {
+	extra := make([]byte, 4+len(id))
+	binary.LittleEndian.PutUint16(extra[0:], BuildIDTag)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(id)))
+	copy(extra[4:], id)
+	return extra
+}
+
+// ReadBuildID returns the build ID of a zip file written with ZipArgs.BuildID, or nil if it
+// doesn't have one.  The extra field is preferred, but the contents of the entry are used if
+// the extra field was lost, for example by a tool that rewrote the zip.
+func ReadBuildID(r *zip.Reader) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != BuildIDName {
+			continue
+		}
+
+		extra := f.Extra
+		for len(extra) >= 4 {
+			tag := binary.LittleEndian.Uint16(extra[0:])
+			size := int(binary.LittleEndian.Uint16(extra[2:]))
+			if 4+size > len(extra) {
+				break
+			}
+			if tag == BuildIDTag {
+				return append([]byte(nil), extra[4:4+size]...), nil
+			}
+			extra = extra[4+size:]
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		contents, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		if len(contents) > 0 && contents[len(contents)-1] == '\n' {
+			contents = contents[:len(contents)-1]
+		}
+		return ParseBuildID(string(contents))
+	}
+	return nil, nil
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// caseRename records a path in the zip that was given a suffix by ZipArgs.CanonicalizeCase.
+type caseRename struct {
+	src, orig, dest string
+}
+
+// caseCanonicalizer gives distinct paths to the files whose lowercased paths collide with
+// ZipArgs.CanonicalizeCase.  It is only used by fillPathPairs.
+type caseCanonicalizer struct {
+	// taken maps each lowercased path given to a file to the path it had before it was
+	// lowercased.
+	taken   map[string]string
+	renames []caseRename
+}
+
+func newCaseCanonicalizer() *caseCanonicalizer {
+	return &caseCanonicalizer{taken: make(map[string]string)}
+}
+
+// canonicalize returns the path for the file src whose path orig was lowercased to dest.  If
+// dest was already given to a file whose path differs from orig, which is usually only by
+// case, it returns dest with the smallest suffix ~2, ~3, ... inserted before the extension of
+// its last element that isn't taken, like res/icon~2.png.  The same path listed twice keeps
+// it, and is an error like any other duplicate.
+func (c *caseCanonicalizer) canonicalize(src, orig, dest string) string {
+	prev, exists := c.taken[dest]
+	if !exists || prev == orig {
+		c.taken[dest] = orig
+		return dest
+	}
+
+	base := path.Base(dest)
+	ext := path.Ext(base)
+	if ext == base {
+		// A dot file like .gitignore has no extension to keep.
+		ext = ""
+	}
+	stem := strings.TrimSuffix(dest, ext)
+	for n := 2; ; n++ {
+		renamed := stem + "~" + strconv.Itoa(n) + ext
+		if _, exists := c.taken[renamed]; !exists {
+			c.taken[renamed] = orig
+			c.renames = append(c.renames, caseRename{src: src, orig: orig, dest: renamed})
+			return renamed
+		}
+	}
+}
+
+// writeCaseRenames writes one tab separated line per renamed file to file with the source
+// path, its path in the zip before it was lowercased and its path in the zip.
+func writeCaseRenames(file string, renames []caseRename) error {
+	buf := &bytes.Buffer{}
+	for _, r := range renames {
+		fmt.Fprintf(buf, "%s\t%s\t%s\n", r.src, r.orig, r.dest)
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0666)
+}
@@ -0,0 +1,120 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"android/soong/third_party/zip"
+)
+
+const (
+	directoryEndLen         = 22
+	directoryEndSignature   = 0x06054b50
+	directory64LocLen       = 20
+	directory64LocSignature = 0x07064b50
+	directory64EndLen       = 56
+	directory64EndSignature = 0x06064b50
+)
+
+var errCentralDirectory = errors.New("not a central directory written by soong_zip")
+
+// NewCentralDirectoryReader returns a reader for the zip file data using the copy of its
+// central directory written to ZipArgs.CentralDirectoryFilePath.  The central directory in
+// data is never read, entries are located using cdir and their contents are read from data.
+//
+// The copy is supplementary: the zip file written alongside it is a normal, complete zip
+// file that can be read without it.
+func NewCentralDirectoryReader(cdir []byte, data io.ReaderAt) (*zip.Reader, error) {
+	offset, err := centralDirectoryOffset(cdir)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &centralDirectoryReaderAt{data: data, cdir: cdir, offset: offset}
+	return zip.NewReader(r, offset+int64(len(cdir)))
+}
+
+// centralDirectoryOffset returns the offset that the central directory was written at in
+// the zip file, from the end of central directory records at the end of cdir.  soong_zip
+// never writes a zip file comment, so the end record is the last thing in the file.
+func centralDirectoryOffset(cdir []byte) (int64, error) {
+	if len(cdir) < directoryEndLen {
+		return 0, errCentralDirectory
+	}
+	end := cdir[len(cdir)-directoryEndLen:]
+	if binary.LittleEndian.Uint32(end) != directoryEndSignature {
+		return 0, errCentralDirectory
+	}
+	if offset := binary.LittleEndian.Uint32(end[16:]); offset != 0xffffffff {
+		return int64(offset), nil
+	}
+
+	// The offset is in the zip64 end of central directory record, which precedes the zip64
+	// locator and the end record.
+	if len(cdir) < directoryEndLen+directory64LocLen+directory64EndLen {
+		return 0, errCentralDirectory
+	}
+	loc := cdir[len(cdir)-directoryEndLen-directory64LocLen:]
+	end64 := cdir[len(cdir)-directoryEndLen-directory64LocLen-directory64EndLen:]
+	if binary.LittleEndian.Uint32(loc) != directory64LocSignature ||
+		binary.LittleEndian.Uint32(end64) != directory64EndSignature {
+		return 0, errCentralDirectory
+	}
+	return int64(binary.LittleEndian.Uint64(end64[48:])), nil
+}
+
+// centralDirectoryReaderAt reads a zip file from data, with everything from offset onwards
+// replaced by cdir.
+type centralDirectoryReaderAt struct {
+	data   io.ReaderAt
+	cdir   []byte
+	offset int64
+}
+
+func (r *centralDirectoryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < r.offset {
+		dataLen := len(p)
+		if int64(dataLen) > r.offset-off {
+			dataLen = int(r.offset - off)
+		}
+		var err error
+		n, err = r.data.ReadAt(p[:dataLen], off)
+		if n < dataLen {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		p = p[n:]
+		off += int64(n)
+	}
+
+	if len(p) == 0 {
+		return n, nil
+	}
+	if off-r.offset >= int64(len(r.cdir)) {
+		return n, io.EOF
+	}
+	copied := copy(p, r.cdir[off-r.offset:])
+	n += copied
+	if copied < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"android/soong/third_party/zip"
+)
+
+// PartialSuffix is added to ZipArgs.OutputFilePath for the file that a zip with
+// ZipArgs.Checkpoint is written to until it is complete.
+const PartialSuffix = ".partial"
+
+// checkpointOutput flushes the entries written so far to the output, and syncs the output to
+// disk if it is a file.  It is called between entries, so the output then ends with a
+// complete entry.
+func (z *ZipWriter) checkpointOutput(zipw *zip.Writer) error {
+	if err := zipw.Flush(); err != nil {
+		return err
+	}
+	if z.syncer != nil {
+		return z.syncer.Sync()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+)
+
+// The chunk map written to ZipArgs.ChunkMapFilePath splits the zip file into consecutive
+// chunks of at most ZipArgs.ChunkSize bytes that can be uploaded in parallel and concatenated
+// in order.  It has one tab separated line per chunk with the offset of the chunk in the zip
+// file, its size, and what is at its end:
+//
+//	entry              the local header of the next entry
+//	central-directory  the central directory
+//	end                the end of the zip file
+//	split              the middle of an entry, because the entry is larger than a chunk
+//
+// Each chunk ends at the last of these boundaries that fits in it, so chunks are only split
+// inside an entry when no boundary fits.
+const (
+	chunkEndEntry            = "entry"
+	chunkEndCentralDirectory = "central-directory"
+	chunkEndFile             = "end"
+	chunkEndSplit            = "split"
+)
+
+// chunk is a line of the chunk map.
+type chunk struct {
+	offset, size int64
+	end          string
+}
+
+// chunkBoundary is an offset in the zip file that a chunk can end at.
+type chunkBoundary struct {
+	offset int64
+	end    string
+}
+
+// chunkMap splits a zip file of size bytes whose entries start at the increasing offsets
+// entries, and whose central directory starts at centralDirectory, into chunks of at most
+// chunkSize bytes.
+func chunkMap(entries []int64, centralDirectory, size, chunkSize int64) []chunk {
+	var boundaries []chunkBoundary
+	for _, offset := range entries {
+		if offset > 0 {
+			boundaries = append(boundaries, chunkBoundary{offset, chunkEndEntry})
+		}
+	}
+	if centralDirectory > 0 && centralDirectory < size {
+		boundaries = append(boundaries, chunkBoundary{centralDirectory, chunkEndCentralDirectory})
+	}
+	boundaries = append(boundaries, chunkBoundary{size, chunkEndFile})
+
+	var chunks []chunk
+	var offset int64
+	for offset < size {
+		next := chunkBoundary{offset + chunkSize, chunkEndSplit}
+		for len(boundaries) > 0 && boundaries[0].offset <= offset+chunkSize {
+			next = boundaries[0]
+			boundaries = boundaries[1:]
+		}
+		chunks = append(chunks, chunk{offset, next.offset - offset, next.end})
+		offset = next.offset
+	}
+	return chunks
+}
+
+// writeChunkMap writes chunks to file in the format described above.
+func writeChunkMap(file string, chunks []chunk) error {
+	buf := &bytes.Buffer{}
+	for _, c := range chunks {
+		fmt.Fprintf(buf, "%d\t%d\t%s\n", c.offset, c.size, c.end)
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0666)
+}
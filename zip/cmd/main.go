@@ -15,15 +15,19 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"android/soong/zip"
 )
@@ -58,6 +62,14 @@ type listFiles struct{}
 func (listFiles) String() string { return `""` }
 
 func (listFiles) Set(s string) error {
+	if s == "-" {
+		if listFromStdin {
+			return errors.New("the file list can only be read from stdin once")
+		}
+		listFromStdin = true
+		fileArgsBuilder.ListReader(os.Stdin)
+		return nil
+	}
 	fileArgsBuilder.List(s)
 	return nil
 }
@@ -91,6 +103,16 @@ func (junkPaths) Set(s string) error {
 	return err
 }
 
+type junkLevels struct{}
+
+func (junkLevels) String() string { return "" }
+
+func (junkLevels) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	fileArgsBuilder.JunkLevels(v)
+	return err
+}
+
 type rootPrefix struct{}
 
 func (rootPrefix) String() string { return "" }
@@ -100,11 +122,241 @@ func (rootPrefix) Set(s string) error {
 	return nil
 }
 
+type pipes []zip.PipeArg
+
+func (p *pipes) String() string { return `""` }
+
+func (p *pipes) Set(s string) error {
+	// The path may contain '=' or ':', so dest:path is used whenever dest has no '='.
+	if j := strings.Index(s, ":"); j > 0 && !strings.Contains(s[:j], "=") {
+		if j == len(s)-1 {
+			return fmt.Errorf("pipe %q must be of the form dest=size or dest:path", s)
+		}
+		*p = append(*p, zip.PipeArg{Dest: s[:j], Path: s[j+1:]})
+		return nil
+	}
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("pipe %q must be of the form dest=size or dest:path", s)
+	}
+	size, err := strconv.ParseInt(s[i+1:], 10, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("pipe %q has invalid size %q", s, s[i+1:])
+	}
+	*p = append(*p, zip.PipeArg{Dest: s[:i], Size: size})
+	return nil
+}
+
+// fromStdin returns whether any of the pipes are read from stdin.
+func (p pipes) fromStdin() bool {
+	for _, pa := range p {
+		if pa.Path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// urls is a flag for entries downloaded from URLs.
+type urls []zip.URLArg
+
+func (u *urls) String() string { return `""` }
+
+func (u *urls) Set(s string) error {
+	// The URL may contain '=' in its query, but the destination may not.
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("url %q must be of the form dest=url", s)
+	}
+	*u = append(*u, zip.URLArg{Dest: s[:i], URL: s[i+1:]})
+	return nil
+}
+
+// urlSHA256 is a flag for the expected SHA-256 of the contents of the preceding -url.
+type urlSHA256 struct{}
+
+func (urlSHA256) String() string { return `""` }
+
+func (urlSHA256) Set(s string) error {
+	if len(urlArgs) == 0 {
+		return fmt.Errorf("must pass -url before -url-sha256")
+	}
+	urlArgs[len(urlArgs)-1].SHA256 = s
+	return nil
+}
+
+// destRewrites is a repeatable flag for substitutions applied to the paths in the zip, which
+// are parsed while the flags are so that a bad regular expression fails before zipping.
+type destRewrites []*zip.DestRewrite
+
+func (d *destRewrites) String() string { return `""` }
+
+func (d *destRewrites) Set(s string) error {
+	r, err := zip.ParseDestRewrite(s)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, r)
+	return nil
+}
+
+// globs is a repeatable flag for a list of patterns.
+type globs []string
+
+func (g *globs) String() string { return `""` }
+
+func (g *globs) Set(s string) error {
+	*g = append(*g, s)
+	return nil
+}
+
+// zips is a repeatable flag for a list of zip files.
+type zips []string
+
+func (z *zips) String() string { return `""` }
+
+func (z *zips) Set(s string) error {
+	*z = append(*z, s)
+	return nil
+}
+
+// levels is a flag for compression levels of the entries matching a pattern.
+type levels []zip.LevelPattern
+
+func (l *levels) String() string { return `""` }
+
+func (l *levels) Set(s string) error {
+	p, err := zip.ParseLevelPattern(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+// execBit selects which execute permission bits of a source file make it executable in the zip.
+type execBit os.FileMode
+
+var execBits = map[string]os.FileMode{
+	"owner": 0100,
+	"group": 0010,
+	"any":   0111,
+}
+
+func (e *execBit) String() string { return "owner" }
+
+func (e *execBit) Set(s string) error {
+	bits, ok := execBits[s]
+	if !ok {
+		return fmt.Errorf("exec bit %q must be owner, group or any", s)
+	}
+	*e = execBit(bits)
+	return nil
+}
+
+// sizeOrder selects the order of the entries by size.
+type sizeOrder zip.SizeOrder
+
+var sizeOrders = map[string]zip.SizeOrder{
+	"asc":  zip.SmallestFirst,
+	"desc": zip.LargestFirst,
+}
+
+func (o *sizeOrder) String() string { return "" }
+
+func (o *sizeOrder) Set(s string) error {
+	order, ok := sizeOrders[s]
+	if !ok {
+		return fmt.Errorf("size order %q must be asc or desc", s)
+	}
+	*o = sizeOrder(order)
+	return nil
+}
+
+// format selects the container format of the output.
+type format zip.Format
+
+var formats = map[string]zip.Format{
+	"zip":    zip.ZipFormat,
+	"tar":    zip.TarFormat,
+	"tar.gz": zip.TarGzFormat,
+}
+
+func (f *format) String() string { return "zip" }
+
+func (f *format) Set(s string) error {
+	v, ok := formats[s]
+	if !ok {
+		return fmt.Errorf("format %q must be zip, tar or tar.gz", s)
+	}
+	*f = format(v)
+	return nil
+}
+
+// nonUTF8 selects what to do with names that aren't valid UTF-8.
+type nonUTF8 zip.NonUTF8Policy
+
+var nonUTF8Policies = map[string]zip.NonUTF8Policy{
+	"passthrough":   zip.NonUTF8Passthrough,
+	"reject":        zip.NonUTF8Reject,
+	"transliterate": zip.NonUTF8Transliterate,
+}
+
+func (p *nonUTF8) String() string { return "passthrough" }
+
+func (p *nonUTF8) Set(s string) error {
+	v, ok := nonUTF8Policies[s]
+	if !ok {
+		return fmt.Errorf("non-utf8 policy %q must be reject, passthrough or transliterate", s)
+	}
+	*p = nonUTF8(v)
+	return nil
+}
+
+// fileMode is a flag for permission bits in octal.
+type fileMode os.FileMode
+
+func (m *fileMode) String() string { return fmt.Sprintf("%#o", os.FileMode(*m)) }
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v == 0 || v > 0777 {
+		return fmt.Errorf("mode %q must be octal permissions from 1 to 0777", s)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
 var (
 	fileArgsBuilder  = zip.NewFileArgsBuilder()
 	nonDeflatedFiles = make(uniqueSet)
+	pipeArgs         pipes
+	listFromStdin    bool
+	urlArgs          urls
+	destRegexes      destRewrites
+	parallelGlobs    globs
+	levelPatterns    levels
+	excludeGlobs     globs
+	appendZips       zips
+	executableBits   execBit
+	orderBySize      sizeOrder
+	outputFormat     format
+	nonUTF8Policy    nonUTF8
+	dirMode          = fileMode(0700)
+	symlinkMode      = fileMode(0777)
 )
 
+// isFlagSet returns true if the flag named name was passed on the command line.
+func isFlagSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: soong_zip -o zipfile [-m manifest] [-C dir] [-f|-l file] [-D dir]...\n")
 	flag.PrintDefaults()
@@ -127,29 +379,142 @@ func main() {
 		}
 	}
 
+	// The flag package can't parse -L:pattern=level, since the name of a flag ends at the '='.
+	for i, arg := range expandedArgs {
+		if p := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"); p != arg && strings.HasPrefix(p, "L:") {
+			expandedArgs[i] = "-level-pattern=" + strings.TrimPrefix(p, "L:")
+		}
+	}
+
 	flags := flag.NewFlagSet("flags", flag.ExitOnError)
 	flags.Usage = usage
 
-	out := flags.String("o", "", "file to write zip file to")
+	out := flags.String("o", "", "file to write zip file to, or - to write it to stdout")
 	manifest := flags.String("m", "", "input jar manifest file name")
+	fixManifest := flags.Bool("fix-manifest", false, "rewrap lines of the -m manifest that are longer than 72 bytes")
+	plainManifest := flags.Bool("plain-manifest", false, "add the -m manifest as is to a plain zip, without the manifest defaults and entry order of -jar")
+	mainClass := flags.String("main-class", "", "Main-Class attribute to add to the jar manifest")
+	classPath := flags.String("class-path", "", "Class-Path attribute to add to the jar manifest")
 	directories := flags.Bool("d", false, "include directories in zip")
-	compLevel := flags.Int("L", 5, "deflate compression level (0-9)")
+	multiRelease := flags.Bool("multi-release", false, "mark the jar as a multi-release jar and order the entries in META-INF/versions/ after the base entries (requires --jar)")
+	sharedDictAuto := flags.Bool("shared-dict-auto", false, "deflate small files with a dictionary trained from the inputs; the zip can't be read by standard readers")
+	reportAllDupes := flags.Bool("report-all-dupes", false, "check all the destinations first, and report every one with more than one source before failing")
+	errorOnEmptyGlob := flags.Bool("error-on-empty-glob", false, "fail if a -D directory or a -f glob matches nothing, even with -ignore_missing_files")
+	includeRootDir := flags.Bool("include-root-dir", false, "with -d, add an entry for each -D directory itself even if it is empty")
+	preserveMode := flags.Bool("preserve-mode", false, "give directories passed with -f or found under -D the permissions of the source directory")
+	compLevel := flags.Int("L", 5, "deflate compression level (0-9), defaults to $SOONG_ZIP_LEVEL if set")
+	flags.Var(&levelPatterns, "level-pattern", "pattern=level compression level of the entries whose paths in the zip match the pattern, which may use **, "+
+		"instead of -L; the first matching pattern wins, level 0 stores the entries; can be repeated, also given as -L:pattern=level")
+	adaptiveLevel := flags.Bool("adaptive-level", false, "pick the compression level of each file of at least 128KB from a sample of it instead of using -L")
+	metadata := flags.String("metadata", "", "write a JSON description of the zip entries to file")
+	since := flags.String("since", "", "only add the entries that differ from the ones in a -metadata file from an earlier run")
+	recordMethods := flags.String("record-method-decisions", "", "write the requested and final compression method of each file, and the reason for the final method, to file")
+	selfCheck := flags.Bool("self-check", false, "inflate each entry as it is written and check it against its header and the blocks it was compressed from")
+	prevalidate := flags.Bool("prevalidate", false, "check all input files before writing the zip, and report all invalid ones at once")
+	cdirOut := flags.String("cdir-out", "", "also write a copy of the zip's central directory to file")
+	extendedTimestamps := flags.Bool("extended-timestamps", false, "store Unix modification, access and change times in an extended-timestamp extra field")
+	var preserveTimestamps bool
+	flags.BoolVar(&preserveTimestamps, "t", false, "stamp entries with the modification times of their sources instead of a fixed time, "+
+		"no later than $SOURCE_DATE_EPOCH if it is set, which makes the zip not reproducible")
+	flags.BoolVar(&preserveTimestamps, "preserve-timestamps", false, "same as -t")
+	clampOlderTimestamps := flags.Bool("clamp-older-timestamps", false, "with -t, also raise the times of sources "+
+		"earlier than $SOURCE_DATE_EPOCH to it, which must be set")
+	excludeCRC := flags.String("exclude-crc", "", "file listing CRC32s in hex of file contents that must not be added to the zip")
+	commentHash := flags.Bool("comment-source-hash", false, "set the comment of each file entry to the SHA-256 of its contents")
+	modeMapFile := flags.String("mode-map", "", "file with lines of a path prefix in the zip and the octal mode of the files and directories under it; the longest prefix wins")
+	verifyInputs := flags.String("verify-inputs", "", "file in sha256sum format listing the SHA-256 that every source file must have")
+	compressFallback := flags.Bool("compress-fallback-store", false, "retry compressing a file that fails to compress, then store it; the output is no longer reproducible")
+	compressDeadline := flags.Duration("compress-deadline", 0, "store files that take longer than this to compress; the output is no longer reproducible")
+	timeBudget := flags.Duration("time-budget", 0, "lower the compression level as needed to finish zipping within this time; the output is no longer reproducible")
+	stableDeflate := flags.Bool("stable-deflate", false, "deflate with an encoder pinned in the source tree so output doesn't change with the Go version")
+	deflateMinSize := flags.Int64("deflate-min-size", 0, "store files smaller than this many bytes without trying to deflate them")
+	maxRatio := flags.Float64("max-ratio", 0, "warn about entries that compress more than N:1, which may be degenerate or zip-bomb-like inputs (100 to 200 is a reasonable limit)")
+	maxRatioFail := flags.Bool("max-ratio-fail", false, "fail instead of warning about entries over -max-ratio")
+	maxPerDir := flags.Int("max-per-dir", 0, "warn about directories with more than N direct entries")
+	maxPerDirFail := flags.Bool("max-per-dir-fail", false, "fail instead of warning about directories over -max-per-dir")
+	lowercaseNames := flags.Bool("lowercase-names", false, "lowercase the paths in the zip of all files from -f, -l and -D; files whose paths differ only by case conflict")
+	canonicalizeCase := flags.Bool("canonicalize-case", false, "lowercase the paths in the zip like -lowercase-names, but give files whose paths differ only by case a ~2, ~3, ... suffix before the extension instead of failing")
+	caseRenames := flags.String("case-renames", "", "write the files renamed by -canonicalize-case to file, with their source, their path before lowercasing and their path in the zip")
+	onlyExt := flags.String("only-ext", "", "comma-separated list of extensions, like .so,.dex, of the only files to add to the zip")
+	deflateStats := flags.String("deflate-stats", "", "write the level, number of blocks, stored blocks, dictionary, sizes and ratio of each deflated entry to file")
+	excludedOut := flags.String("excluded-out", "", "write the sources that were skipped, and the reason each was skipped, to file")
+	requireSavings := flags.Float64("require-savings", 0, "fail if the zip file isn't at least this percent smaller than the total size of its entries")
+	clusterByExt := flags.Bool("cluster-by-ext", false, "group entries by file extension instead of keeping the order of the arguments (ignored with -jar)")
+	sortEntries := flags.Bool("sort", false, "sort entries by name instead of keeping the order of the arguments (ignored with -jar)")
 	emulateJar := flags.Bool("jar", false, "modify the resultant .zip to emulate the output of 'jar'")
 	writeIfChanged := flags.Bool("write_if_changed", false, "only update resultant .zip if it has changed")
+	compressCache := flags.Bool("compress-cache", false, "reuse the compressed contents of small files for later files with the same contents")
+	postFilter := flags.String("post-filter", "", "shell command to pipe the zip file through before writing its output to -o, like a signer; it runs with the same permissions and the output is only as reproducible as the command")
+	chunkSize := flags.Int64("chunk-size", 0, "write a -chunk-map splitting the zip into chunks of at most this many bytes, ending between entries where possible, for parallel uploads")
+	chunkMap := flags.String("chunk-map", "", "write the offset, size and end of each -chunk-size chunk of the zip to file")
+	storedDescriptors := flags.Bool("stored-data-descriptors", false, "write a data descriptor after stored entries too, for consumers that expect one on every entry")
+	forceZip64 := flags.Bool("zip64", false, "write zip64 central directory records even if the zip doesn't need them")
+	atomicWrite := flags.Bool("atomic", false, "write the output to a uniquely named temporary file and rename it to the output path once it is complete")
+	checkpoint := flags.Int("checkpoint", 0, "flush and sync the output after every this many entries, and write it to the output path with "+zip.PartialSuffix+" until it is complete")
+	recoverZip := flags.String("recover", "", "salvage the complete entries of a truncated zip file into the file given by -o, instead of creating a zip file")
+	emitIndex := flags.Bool("emit-index", false, "add an index of the entries sorted by name as the last entry, "+zip.IndexName)
+	storeXattrs := flags.Bool("store-xattrs", false, "store the extended attributes of source files, like SELinux labels, in an extra field of their entries")
+	werror := flags.Bool("werror", false, "fail instead of printing any warning, including for missing -C directories")
+	verifyOutput := flags.Bool("verify", false, "read the zip back after writing it and check the CRC32 of every entry, deleting it if one is wrong")
+	verbose := flags.Bool("v", false, "print each entry as it is written and the sources that are skipped, then the number of entries and their total sizes")
+	strictRelativeRoots := flags.Bool("strict-relative-roots", false, "fail instead of warning if a -C directory does not exist")
+	drainPipes := flags.Bool("drain-pipes", false, "add named pipes as files with the contents read from them, buffered in memory")
+	drainTimeout := flags.Duration("drain-timeout", 0, "fail if a named pipe added with -drain-pipes isn't closed within this time")
 	ignoreMissingFiles := flags.Bool("ignore_missing_files", false, "continue if a requested file does not exist")
 	symlinks := flags.Bool("symlinks", true, "store symbolic links in zip instead of following them")
+	dereference := flags.Bool("dereference", false, "follow symbolic links and store the files they point to, the same as -symlinks=false")
+	maxSymlinkDepth := flags.Int("max-symlink-depth", zip.DefaultMaxSymlinkDepth, "fail on a source that is a chain of more than this many symlinks when they are followed with -symlinks=false")
+	inlineSymlinksUnder := flags.Int64("inline-symlinks-under", 0, "store the contents of symlinked files smaller than this many bytes instead of the symlinks")
+	license := flags.String("auto-license", "", "license file to store in the zip if it exists")
+	licensePath := flags.String("auto-license-path", zip.DefaultLicensePath, "path within the zip at which to store the -auto-license file")
+	requireLicense := flags.Bool("require-license", false, "fail instead of warning if the -auto-license file does not exist")
+	urlTimeout := flags.Duration("url-timeout", zip.DefaultURLTimeout, "time allowed for each attempt to download a -url")
+	urlRetries := flags.Int("url-retries", 3, "number of times to retry a failed -url download")
+	insecureURLs := flags.Bool("allow-insecure-urls", false, "allow -url to download over plain http")
+	buildID := flags.String("build-id", "", "identifier of the build, in hex, to store in the "+zip.BuildIDName+" entry")
+	provenance := flags.String("provenance", "", "JSON provenance document to store in the zip")
+	provenancePath := flags.String("provenance-path", zip.DefaultProvenancePath, "path within the zip at which to store the -provenance document")
 
 	parallelJobs := flags.Int("parallel", runtime.NumCPU(), "number of parallel threads to use")
+	splitEntriesOver := flags.Int64("split-entries-over", 0, "store files larger than this many bytes as several entries of at most this many bytes, with a .parts entry describing them")
+	queueDepth := flags.Int("queue-depth", zip.DefaultQueueDepth, "number of entries that can be queued ahead of the one being written")
+	outBuffer := flags.Int("out-buffer", 0, "size in bytes of the buffer for writes to the output file (default 4096)")
+	batchTinyFiles := flags.Int64("batch-tiny-files", 0, "compress files smaller than this many bytes in batches instead of one goroutine per file, for zips of very many tiny files")
+	singleThreadLargeFiles := flags.Bool("single-thread-large-files", false, "compress each file as a single deflate stream instead of splitting large files into parallel blocks")
+	lowMemory := flags.Bool("low-memory", false, "compress at most -parallel blocks of a large file ahead of the output to bound memory use, at some cost in speed")
+	walkJobs := flags.Int("walk-jobs", 0, "number of directories under -D to read in parallel (default one at a time)")
+	maxOpenFiles := flags.Int("max-open-files", 0, "maximum number of input files to keep open at once (default half of the open file limit)")
 	cpuProfile := flags.String("cpuprofile", "", "write cpu profile to file")
 	traceFile := flags.String("trace", "", "write trace to file")
 
 	flags.Var(&rootPrefix{}, "P", "path prefix within the zip at which to place files")
-	flags.Var(&listFiles{}, "l", "file containing list of .class files")
+	flags.Var(&listFiles{}, "l", "file containing list of .class files, or - to read the list from stdin")
 	flags.Var(&dir{}, "D", "directory to include in zip")
 	flags.Var(&file{}, "f", "file to include in zip")
 	flags.Var(&nonDeflatedFiles, "s", "file path to be stored within the zip without compression")
 	flags.Var(&relativeRoot{}, "C", "path to use as relative root of files in following -f, -l, or -D arguments")
 	flags.Var(&junkPaths{}, "j", "junk paths, zip files without directory names")
+	flags.Var(&junkLevels{}, "junk-levels", "number of leading directories to drop from the paths of following -f, -l, or -D arguments")
+	flags.Var(&nonUTF8Policy, "non-utf8", "what to do with names that aren't valid UTF-8: passthrough stores them unchanged, reject fails, transliterate replaces invalid bytes with _")
+	flags.Var(&outputFormat, "format", "format of the output, zip, tar or tar.gz, which compresses the whole tar archive at -L")
+	flags.Var(&orderBySize, "order-by-size", "order the entries by the size of their sources, asc or desc, instead of the order of the arguments")
+	flags.Var(&dirMode, "dir-mode", "permissions in octal of directory entries")
+	flags.Var(&symlinkMode, "symlink-mode", "permissions in octal of symlink entries")
+	flags.Var(&executableBits, "exec-bit", "which execute permission of an input file marks it executable in the zip: owner, group or any")
+	flags.Var(&parallelGlobs, "parallel-pattern", "compress the files larger than 1MB whose paths in the zip match this pattern, which may use **, in parallel blocks, "+
+		"and every other file as a single deflate stream regardless of its size; can be repeated")
+	flags.Var(&excludeGlobs, "x", "skip the files from -f, -l and -D whose source paths, or the directories they are in, match this pattern, which may use **, "+
+		"like -x '**/*.pyc' or -x '**/.git'; can be repeated")
+	flags.Var(&excludeGlobs, "exclude", "same as -x")
+	flags.Var(&appendZips, "a", "copy the entries of this zip file into the output without recompressing them, can be repeated")
+	flags.Var(&destRegexes, "dest-regex", "s/pattern/replacement/ substitution, with an optional g flag, applied to the paths in the zip of files from -f, -l and -D; "+
+		"the pattern is a Go regexp, $1 in the replacement is its first group, and it can be repeated to apply several in order")
+	flags.Var(&urlArgs, "url", "dest=url of an entry whose contents are downloaded from an https url; makes the zip depend on the network")
+	flags.Var(&urlSHA256{}, "url-sha256", "expected sha256 in hex of the contents of the preceding -url")
+	flags.Var(&pipeArgs, "pipe", "dest=size of an entry whose contents are read from stdin; "+
+		"the contents of multiple pipes are concatenated on stdin in the order they are specified; "+
+		"dest:path, used when the text before the first ':' has no '=', reads the entry from the named pipe or "+
+		"other file at path until it is closed instead, buffered in memory")
 
 	flags.Parse(expandedArgs[1:])
 
@@ -158,6 +523,44 @@ func main() {
 		flags.Usage()
 	}
 
+	if !isFlagSet(flags, "L") {
+		if level, ok := os.LookupEnv("SOONG_ZIP_LEVEL"); ok {
+			l, err := strconv.Atoi(level)
+			if err != nil || l < 0 || l > 9 {
+				fmt.Fprintf(os.Stderr, "invalid SOONG_ZIP_LEVEL %q, must be a compression level from 0 to 9\n", level)
+				os.Exit(1)
+			}
+			*compLevel = l
+		}
+	} else if *compLevel < 0 || *compLevel > 9 {
+		fmt.Fprintf(os.Stderr, "invalid -L %d, must be a compression level from 0 to 9\n", *compLevel)
+		os.Exit(1)
+	}
+
+	var modTime time.Time
+	if epoch, ok := os.LookupEnv("SOURCE_DATE_EPOCH"); ok {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil || secs < 0 {
+			fmt.Fprintf(os.Stderr, "invalid SOURCE_DATE_EPOCH %q, must be a number of seconds since 1970\n", epoch)
+			os.Exit(1)
+		}
+		modTime = time.Unix(secs, 0).UTC()
+	}
+
+	if *recoverZip != "" {
+		if *out == "" {
+			fmt.Fprintln(os.Stderr, "error: -recover requires -o")
+			os.Exit(1)
+		}
+		n, err := zip.RecoverFile(*recoverZip, *out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "recovered %d entries from %s\n", n, *recoverZip)
+		return
+	}
+
 	if *cpuProfile != "" {
 		f, err := os.Create(*cpuProfile)
 		if err != nil {
@@ -184,23 +587,195 @@ func main() {
 		defer trace.Stop()
 	}
 
+	if listFromStdin && pipeArgs.fromStdin() {
+		fmt.Fprintln(os.Stderr, "error: can't read both a file list and pipes from stdin")
+		os.Exit(1)
+	}
+
 	if fileArgsBuilder.Error() != nil {
 		fmt.Fprintln(os.Stderr, fileArgsBuilder.Error())
 		os.Exit(1)
 	}
 
+	if errs := fileArgsBuilder.RelativeRootErrors(); len(errs) > 0 {
+		strict := *strictRelativeRoots || *werror
+		for _, err := range errs {
+			if strict {
+				fmt.Fprintln(os.Stderr, "error:", err)
+			} else {
+				fmt.Fprintln(os.Stderr, "warning:", err)
+			}
+		}
+		if strict {
+			os.Exit(1)
+		}
+	}
+
+	var excludedCRCs map[uint32]bool
+	if *excludeCRC != "" {
+		f, err := os.Open(*excludeCRC)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		excludedCRCs, err = zip.ReadCRCList(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *excludeCRC, err)
+			os.Exit(1)
+		}
+	}
+
+	var inputSHA256s map[string][]byte
+	if *verifyInputs != "" {
+		f, err := os.Open(*verifyInputs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		inputSHA256s, err = zip.ReadSHA256Manifest(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *verifyInputs, err)
+			os.Exit(1)
+		}
+	}
+
+	var modeMap map[string]os.FileMode
+	if *modeMapFile != "" {
+		f, err := os.Open(*modeMapFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		modeMap, err = zip.ReadModeMap(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *modeMapFile, err)
+			os.Exit(1)
+		}
+	}
+
+	var onlyExtensions []string
+	for _, ext := range strings.Split(*onlyExt, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			onlyExtensions = append(onlyExtensions, ext)
+		}
+	}
+
+	if *atomicWrite {
+		// Don't leave the temporary file behind when the build is interrupted.
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			<-signals
+			zip.RemoveTempOutputs()
+			os.Exit(1)
+		}()
+	}
+
 	err := zip.Zip(zip.ZipArgs{
 		FileArgs:                 fileArgsBuilder.FileArgs(),
 		OutputFilePath:           *out,
 		EmulateJar:               *emulateJar,
 		AddDirectoryEntriesToZip: *directories,
 		CompressionLevel:         *compLevel,
+		ClusterByExtension:       *clusterByExt,
+		SortEntries:              *sortEntries,
+		OrderBySize:              zip.SizeOrder(orderBySize),
+		Format:                   zip.Format(outputFormat),
+		OnlyExtensions:           onlyExtensions,
+		LowercaseNames:           *lowercaseNames,
+		DestRewrites:             destRegexes,
+		CanonicalizeCase:         *canonicalizeCase,
+		CaseRenamesFilePath:      *caseRenames,
+		NonUTF8:                  zip.NonUTF8Policy(nonUTF8Policy),
 		ManifestSourcePath:       *manifest,
+		ManifestMainClass:        *mainClass,
+		FixManifest:              *fixManifest,
+		PlainManifest:            *plainManifest,
+		ManifestClassPath:        *classPath,
 		NumParallelJobs:          *parallelJobs,
+		QueueDepth:               *queueDepth,
 		NonDeflatedFiles:         nonDeflatedFiles,
 		WriteIfChanged:           *writeIfChanged,
-		StoreSymlinks:            *symlinks,
+		StoreSymlinks:            *symlinks && !*dereference,
+		MaxSymlinkDepth:          *maxSymlinkDepth,
+		InlineSymlinksUnder:      *inlineSymlinksUnder,
 		IgnoreMissingFiles:       *ignoreMissingFiles,
+		PipeArgs:                 pipeArgs,
+		URLArgs:                  urlArgs,
+		URLTimeout:               *urlTimeout,
+		URLRetries:               *urlRetries,
+		AllowInsecureURLs:        *insecureURLs,
+		BuildID:                  *buildID,
+		ProvenanceSourcePath:     *provenance,
+		ProvenancePath:           *provenancePath,
+		LicenseSourcePath:        *license,
+		LicensePath:              *licensePath,
+		RequireLicense:           *requireLicense,
+		DeflateMinSize:           *deflateMinSize,
+		SplitEntriesOver:         *splitEntriesOver,
+		BatchTinyFiles:           *batchTinyFiles,
+		AdaptiveLevel:            *adaptiveLevel,
+		DrainPipes:               *drainPipes,
+		DrainTimeout:             *drainTimeout,
+		MaxCompressionRatio:      *maxRatio,
+		FailOnMaxRatio:           *maxRatioFail,
+		MaxEntriesPerDir:         *maxPerDir,
+		FailOnMaxEntriesPerDir:   *maxPerDirFail,
+		RequiredSavings:          *requireSavings,
+		StableDeflate:            *stableDeflate,
+		CompressDeadline:         *compressDeadline,
+		TimeBudget:               *timeBudget,
+		ExcludedCRCs:             excludedCRCs,
+		InputSHA256s:             inputSHA256s,
+		CommentSourceHash:        *commentHash,
+		ExtendedTimestamps:       *extendedTimestamps,
+		PreserveTimestamps:       preserveTimestamps,
+		ClampOlderTimestamps:     *clampOlderTimestamps,
+		ModTime:                  modTime,
+		CentralDirectoryFilePath: *cdirOut,
+		Prevalidate:              *prevalidate,
+		SelfCheck:                *selfCheck,
+		ExecutableBits:           os.FileMode(executableBits),
+		DirectoryMode:            os.FileMode(dirMode),
+		SymlinkMode:              os.FileMode(symlinkMode),
+		ModeMap:                  modeMap,
+		StoreXattrs:              *storeXattrs,
+		EmitIndex:                *emitIndex,
+		StoredDataDescriptors:    *storedDescriptors,
+		ForceZip64:               *forceZip64,
+		ChunkSize:                *chunkSize,
+		ChunkMapFilePath:         *chunkMap,
+		CompressFallbackStore:    *compressFallback,
+		Checkpoint:               *checkpoint,
+		AtomicWrite:              *atomicWrite,
+		PostFilter:               *postFilter,
+		CompressCache:            *compressCache,
+		WarningsAsErrors:         *werror,
+		Verbose:                  *verbose,
+		VerifyOutput:             *verifyOutput,
+		PreserveDirectoryModes:   *preserveMode,
+		IncludeRootDir:           *includeRootDir,
+		ErrorOnEmptyGlob:         *errorOnEmptyGlob,
+		ReportAllDuplicates:      *reportAllDupes,
+		SharedDictionaryAuto:     *sharedDictAuto,
+		MultiRelease:             *multiRelease,
+		MetadataFilePath:         *metadata,
+		SinceMetadataFilePath:    *since,
+		MethodDecisionsFilePath:  *recordMethods,
+		ExcludedFilePath:         *excludedOut,
+		DeflateStatsFilePath:     *deflateStats,
+		MaxOpenFiles:             *maxOpenFiles,
+		WalkJobs:                 *walkJobs,
+		LowMemory:                *lowMemory,
+		SingleThreadLargeFiles:   *singleThreadLargeFiles,
+		ParallelPatterns:         parallelGlobs,
+		LevelPatterns:            levelPatterns,
+		ExcludePatterns:          excludeGlobs,
+		AppendZips:               appendZips,
+		OutputBufferSize:         *outBuffer,
 	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err.Error())
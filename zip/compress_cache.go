@@ -0,0 +1,152 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+// compressCacheMaxSize is the largest file whose compressed contents are cached with
+// ZipArgs.CompressCache.
+const compressCacheMaxSize = 64 * 1024
+
+// compressCacheKey identifies the compressed contents of a file.  The contents themselves are
+// the key, which is exact and cheap to hash for small files.
+type compressCacheKey struct {
+	level    int
+	contents string
+}
+
+// compressCacheEntry is the result of compressing a file, shared by the entries of every
+// file with the same contents.  compressed is nil if the file is stored.
+type compressCacheEntry struct {
+	crc        uint32
+	compressed []byte
+	reason     string
+}
+
+// compressCache holds the compressed contents of the small files added to the zip for
+// ZipArgs.CompressCache.  It is used by all of the compression goroutines.
+type compressCache struct {
+	lock    sync.Mutex
+	entries map[compressCacheKey]*compressCacheEntry
+}
+
+func newCompressCache() *compressCache {
+	return &compressCache{entries: make(map[compressCacheKey]*compressCacheEntry)}
+}
+
+func (c *compressCache) get(key compressCacheKey) *compressCacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+func (c *compressCache) put(key compressCacheKey, e *compressCacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[key] = e
+}
+
+// compressWholeFileCached is compressWholeFile for a small file with ZipArgs.CompressCache.
+// If a file with the same contents has already been compressed at the same level, its CRC32
+// and compressed contents are reused, otherwise they are computed and cached.  It returns
+// false without reading r if the file can't be cached.
+func (z *ZipWriter) compressWholeFileCached(ze *zipEntry, r io.Reader, deadline time.Time, compressChan chan *zipEntry) bool {
+	if z.compressCache == nil || ze.fh.Method != zip.Deflate || z.sharedDict != nil || z.adaptiveLevel ||
+		ze.fh.UncompressedSize64 > compressCacheMaxSize {
+		return false
+	}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		z.fail(err)
+		return true
+	}
+	key := compressCacheKey{ze.level, string(contents)}
+
+	cached := z.compressCache.get(key)
+	if cached != nil {
+		// The CRC32 is known, but the entry still needs the checks of checksum.
+		var sum hash.Hash
+		if ze.wantSHA256 != nil || z.commentHash {
+			sum = sha256.New()
+			sum.Write(contents)
+		}
+		if err := z.checkSums(ze, cached.crc, sum); err != nil {
+			z.fail(err)
+			return true
+		}
+	} else {
+		if err := z.checksum(bytes.NewReader(contents), ze); err != nil {
+			z.fail(err)
+			return true
+		}
+		cached = &compressCacheEntry{crc: ze.fh.CRC32, reason: "deflate not smaller"}
+		compressed, err := z.compressRetrying(bytes.NewReader(contents), nil, ze.level, true, deadline)
+		if err == nil && uint64(compressed.Len()) < ze.fh.UncompressedSize64 {
+			cached.compressed = compressed.Bytes()
+			cached.reason = "deflated"
+		}
+		if err == nil {
+			z.compressCache.put(key, cached)
+		} else if _, ok := err.(compressFailedError); ok {
+			// Stored without caching, like compressWholeFile does.
+			if err := z.warn(fmt.Errorf("storing %q: %s", ze.fh.Name, err)); err != nil {
+				z.fail(err)
+				return true
+			}
+			cached.reason = "compression failed"
+		} else if err == errCompressDeadline {
+			cached.reason = "compress deadline exceeded"
+		} else {
+			z.fail(err)
+			return true
+		}
+	}
+
+	ze.futureReaders = make(chan chan io.Reader, 1)
+	futureReader := make(chan io.Reader, 1)
+	ze.futureReaders <- futureReader
+	close(ze.futureReaders)
+
+	ze.methodReason = cached.reason
+	if cached.compressed != nil {
+		if ze.deflateStat != nil {
+			ze.deflateStat.level = ze.level
+		}
+		futureReader <- bytes.NewReader(cached.compressed)
+	} else {
+		ze.fh.Method = zip.Store
+		futureReader <- bytes.NewReader(contents)
+	}
+
+	z.cpuRateLimiter.Finish()
+
+	close(futureReader)
+
+	compressChan <- ze
+	close(compressChan)
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
+// compressRetries is the number of times compressing a block is tried again with
+// ZipArgs.CompressFallbackStore before the block is stored.
+const compressRetries = 2
+
+// compressBlockFunc compresses a block, replaced in tests to inject compression failures.
+var compressBlockFunc = (*ZipWriter).compressBlock
+
+// sourceError is an error reading the source of a block, which compressing it again won't
+// fix.
+type sourceError struct {
+	err error
+}
+
+func (e sourceError) Error() string {
+	return e.err.Error()
+}
+
+// sourceErrorReader returns the errors of reading r as sourceErrors.
+type sourceErrorReader struct {
+	r io.Reader
+}
+
+func (s sourceErrorReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
+
+// compressFailedError is returned by compressRetrying when every attempt to compress a block
+// failed and it should be stored instead.
+type compressFailedError struct {
+	err      error
+	attempts int
+}
+
+func (e compressFailedError) Error() string {
+	if e.attempts == 1 {
+		return fmt.Sprintf("compression failed: %s", e.err)
+	}
+	return fmt.Sprintf("compression failed %d times: %s", e.attempts, e.err)
+}
+
+// flateWriterError is an error creating a flate writer.  Levels are checked before zipping,
+// so it is unexpected and creating one again won't fix it.
+type flateWriterError struct {
+	err error
+}
+
+func (e flateWriterError) Error() string {
+	return e.err.Error()
+}
+
+// compressRetrying deflates the block r, which starts at offset 0.  Without
+// ZipArgs.CompressFallbackStore it is compressBlock.  With it, failures other than reading r
+// and the compression deadline are retried up to compressRetries times, and if the last attempt
+// still fails it returns a compressFailedError for the caller to store the block instead.
+// Failing to create the flate writer is never retried, and always returns a
+// compressFailedError, since it fails before r is read.
+func (z *ZipWriter) compressRetrying(r io.ReadSeeker, dict []byte, level int, last bool, deadline time.Time) (*bytes.Buffer, error) {
+	if !z.compressFallback {
+		buf, err := compressBlockFunc(z, r, dict, level, last, deadline)
+		if werr, ok := err.(flateWriterError); ok {
+			return nil, compressFailedError{werr.err, 1}
+		}
+		return buf, err
+	}
+
+	var err error
+	for attempt := 0; attempt <= compressRetries; attempt++ {
+		if attempt > 0 {
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+
+		var buf *bytes.Buffer
+		buf, err = compressBlockFunc(z, sourceErrorReader{r}, dict, level, last, deadline)
+		if err == nil {
+			return buf, nil
+		}
+		if serr, ok := err.(sourceError); ok {
+			return nil, serr.err
+		} else if werr, ok := err.(flateWriterError); ok {
+			return nil, compressFailedError{werr.err, 1}
+		} else if err == errCompressDeadline {
+			return nil, err
+		}
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return nil, compressFailedError{err, compressRetries + 1}
+}
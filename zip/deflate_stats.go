@@ -0,0 +1,70 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// Dictionaries recorded in the ZipArgs.DeflateStatsFilePath line of an entry.
+const (
+	noDictionary        = "none"
+	precedingDictionary = "preceding"
+	sharedDictionary    = "shared"
+)
+
+// deflateStat is the record of a deflated entry for ZipArgs.DeflateStatsFilePath.  It is
+// created by writeFileContents, which fills in the blocks of an entry compressed in parallel,
+// compressWholeFile fills in the level of any other entry, compressPartialFile counts the
+// stored blocks and the write loop fills in the sizes once the entry has been written.
+type deflateStat struct {
+	name  string
+	level int
+
+	blocks       int
+	storedBlocks int32
+	dict         string
+
+	size, compressedSize uint64
+}
+
+// storedBlock counts a block of an entry compressed in parallel that was stored.  It is called
+// by the compression goroutines of the blocks.
+func (s *deflateStat) storedBlock() {
+	if s != nil {
+		atomic.AddInt32(&s.storedBlocks, 1)
+	}
+}
+
+// writeDeflateStats writes one tab separated line per deflated entry to file with the name,
+// the compression level, the number of blocks it was compressed in, the number of them that
+// were stored inside the deflate stream, the dictionary the blocks were compressed with, the
+// uncompressed and compressed sizes and the ratio of the compressed size to the uncompressed
+// size.
+func writeDeflateStats(file string, stats []*deflateStat) error {
+	buf := &bytes.Buffer{}
+	for _, s := range stats {
+		ratio := 0.0
+		if s.size > 0 {
+			ratio = float64(s.compressedSize) / float64(s.size)
+		}
+		fmt.Fprintf(buf, "%s\t%d\t%d\t%d\t%s\t%d\t%d\t%.3f\n", s.name, s.level, s.blocks,
+			atomic.LoadInt32(&s.storedBlocks), s.dict, s.size, s.compressedSize, ratio)
+	}
+	return ioutil.WriteFile(file, buf.Bytes(), 0666)
+}
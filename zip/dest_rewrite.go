@@ -0,0 +1,96 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DestRewrite is a regular expression substitution applied to the paths in the zip of the
+// files from FileArgs, see ParseDestRewrite.
+type DestRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	// Global replaces every match instead of only the first one.
+	Global bool
+}
+
+// ParseDestRewrite parses a substitution like sed's, s/pattern/replacement/ or
+// s/pattern/replacement/g to replace every match.  Any character after the s can be the
+// delimiter instead of /, and a delimiter in the pattern or replacement is escaped with a
+// backslash.  The pattern is a Go regular expression (RE2 syntax) matched against the whole
+// path in the zip, and the replacement refers to its groups with $1 or ${name}, see
+// regexp.Regexp.Expand.
+func ParseDestRewrite(s string) (*DestRewrite, error) {
+	if len(s) < 2 || s[0] != 's' {
+		return nil, fmt.Errorf("substitution %q must be of the form s/pattern/replacement/", s)
+	}
+	delim := s[1:2]
+
+	var parts []string
+	var part strings.Builder
+	for i := 2; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1:i+2] == delim:
+			part.WriteString(delim)
+			i++
+		case s[i:i+1] == delim:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(s[i])
+		}
+	}
+	if len(parts) != 2 || (part.Len() > 0 && part.String() != "g") {
+		return nil, fmt.Errorf("substitution %q must be of the form s/pattern/replacement/ or s/pattern/replacement/g", s)
+	}
+
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("substitution %q: %s", s, err)
+	}
+	return &DestRewrite{Pattern: re, Replacement: parts[1], Global: part.String() == "g"}, nil
+}
+
+// apply returns dest with the substitution made, or unchanged if the pattern doesn't match.
+func (r *DestRewrite) apply(dest string) string {
+	if r.Global {
+		return r.Pattern.ReplaceAllString(dest, r.Replacement)
+	}
+	loc := r.Pattern.FindStringSubmatchIndex(dest)
+	if loc == nil {
+		return dest
+	}
+	replaced := r.Pattern.ExpandString(nil, r.Replacement, dest, loc)
+	return dest[:loc[0]] + string(replaced) + dest[loc[1]:]
+}
+
+// rewriteDest applies rewrites to dest in order.
+func rewriteDest(dest string, rewrites []*DestRewrite) (string, error) {
+	if len(rewrites) == 0 {
+		return dest, nil
+	}
+	orig := dest
+	for _, r := range rewrites {
+		dest = r.apply(dest)
+	}
+	dest = zipPath(dest)
+	if dest == "." || dest == ".." || strings.HasPrefix(dest, "../") || strings.HasPrefix(dest, "/") {
+		return "", fmt.Errorf("destination %q is rewritten to %q, which is outside the zip", orig, dest)
+	}
+	return dest, nil
+}
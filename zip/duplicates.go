@@ -0,0 +1,112 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// DuplicateDestination is a destination in the zip that more than one file would be written
+// to, or that would be both a file and a directory.
+type DuplicateDestination struct {
+	Dest string
+
+	// Files are the sources of the files at Dest, in the order they would be added.
+	Files []string
+
+	// Directory is the first source that makes Dest a directory, either a source directory
+	// or a file below Dest, or "" if Dest is only the destination of files.
+	Directory string
+}
+
+func (d DuplicateDestination) String() string {
+	files := make([]string, len(d.Files))
+	for i, f := range d.Files {
+		files[i] = fmt.Sprintf("%q", f)
+	}
+	if d.Directory != "" {
+		return fmt.Sprintf("%q is both a directory %q and files %s", d.Dest, d.Directory,
+			strings.Join(files, ", "))
+	}
+	return fmt.Sprintf("%q has files %s", d.Dest, strings.Join(files, ", "))
+}
+
+// DuplicateDestinationsError is returned when ZipArgs.ReportAllDuplicates finds destinations
+// that more than one source would be written to.
+type DuplicateDestinationsError struct {
+	Duplicates []DuplicateDestination
+}
+
+func (x DuplicateDestinationsError) Error() string {
+	msgs := make([]string, len(x.Duplicates))
+	for i, d := range x.Duplicates {
+		msgs[i] = d.String()
+	}
+	return fmt.Sprintf("%d duplicate destinations:\n  %s", len(x.Duplicates), strings.Join(msgs, "\n  "))
+}
+
+// findDuplicates returns the destinations of pathMappings that are an error to add to the zip
+// because they have more than one file, or are both a file and a directory, in the order of
+// their first file.  Sources that can't be stat'ed are skipped, their errors are reported when
+// they are added to the zip.
+func (z *ZipWriter) findDuplicates(pathMappings []pathMapping) []DuplicateDestination {
+	files := make(map[string][]string)
+	var order []string
+	dirs := make(map[string]string)
+
+	addParents := func(dest, src string) {
+		for dir := path.Dir(dest); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if _, exists := dirs[dir]; exists {
+				break
+			}
+			dirs[dir] = src
+		}
+	}
+
+	for _, ele := range pathMappings {
+		isDir := ele.appended != nil && ele.appended.isDir()
+		if ele.contents == nil && ele.appended == nil && ele.src != "" {
+			s, err := z.stat(ele.src)
+			if err != nil {
+				continue
+			}
+			isDir = s.IsDir()
+		}
+		if isDir {
+			// The same directory can be added any number of times.
+			if _, exists := dirs[ele.dest]; !exists && ele.dest != "." {
+				dirs[ele.dest] = ele.src
+			}
+			addParents(ele.dest, ele.src)
+			continue
+		}
+		if _, exists := files[ele.dest]; !exists {
+			order = append(order, ele.dest)
+		}
+		files[ele.dest] = append(files[ele.dest], ele.src)
+		addParents(ele.dest, ele.src)
+	}
+
+	var duplicates []DuplicateDestination
+	for _, dest := range order {
+		dir := dirs[dest]
+		if len(files[dest]) > 1 || dir != "" {
+			duplicates = append(duplicates, DuplicateDestination{Dest: dest, Files: files[dest], Directory: dir})
+		}
+	}
+	return duplicates
+}
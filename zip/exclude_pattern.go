@@ -0,0 +1,98 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// checkExcludePatterns returns an error for the first of ZipArgs.ExcludePatterns that isn't a
+// valid pattern, so that it fails before zipping instead of never excluding anything.
+func checkExcludePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := pathtools.Match(p, p); err != nil {
+			return fmt.Errorf("exclude pattern %q: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// isExcludedByPattern returns whether the source src, or one of the directories it is in,
+// matches one of ZipArgs.ExcludePatterns.
+func (z *ZipWriter) isExcludedByPattern(src string) bool {
+	if len(z.excludePatterns) == 0 {
+		return false
+	}
+	for p := zipPath(filepath.Clean(src)); p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range z.excludePatterns {
+			if match, _ := pathtools.Match(pattern, p); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterExcludePatterns returns the sources that aren't excluded by ZipArgs.ExcludePatterns,
+// or all the sources if there are no patterns.  The directories that only had excluded sources
+// in them are dropped too, so that excluded files don't leave their directories behind in the
+// zip, while directories that were empty to begin with are kept.
+func (z *ZipWriter) filterExcludePatterns(srcs []string) []string {
+	if len(z.excludePatterns) == 0 {
+		return srcs
+	}
+
+	var kept []string
+	parents := make(map[string]bool)
+	excludedParents := make(map[string]bool)
+	addParents := func(parents map[string]bool, src string) {
+		for dir := filepath.Dir(src); dir != "." && dir != "/" && !parents[dir]; dir = filepath.Dir(dir) {
+			parents[dir] = true
+		}
+	}
+	for _, src := range srcs {
+		addParents(parents, filepath.Clean(src))
+		if z.isExcludedByPattern(src) {
+			z.exclude(src, "excluded pattern")
+			addParents(excludedParents, filepath.Clean(src))
+		} else {
+			kept = append(kept, src)
+		}
+	}
+	if len(excludedParents) == 0 {
+		return kept
+	}
+
+	// A directory is kept if a file or empty directory below it is kept.
+	keptParents := make(map[string]bool)
+	for _, src := range kept {
+		if !parents[filepath.Clean(src)] {
+			addParents(keptParents, filepath.Clean(src))
+		}
+	}
+	filtered := kept[:0]
+	for _, src := range kept {
+		if dir := filepath.Clean(src); excludedParents[dir] && !keptParents[dir] {
+			z.exclude(src, "excluded pattern")
+			continue
+		}
+		filtered = append(filtered, src)
+	}
+	return filtered
+}
@@ -0,0 +1,65 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+
+	"android/soong/third_party/zip"
+)
+
+// addExtra adds the extra field records in field to fh.  Every extra field soong_zip writes
+// goes through addExtra, which keeps the records sorted by header ID, and records with the same
+// ID in the order they were added, so that the serialization of the extra fields of an entry
+// only depends on which features are enabled and not on the order they add their records in.
+// The zip64 record is added by the zip writer after these.  A new slice is always returned, so
+// fh.Extra may be shared between headers.
+func addExtra(fh *zip.FileHeader, field []byte) {
+	records := splitExtra(fh.Extra)
+	for _, r := range splitExtra(field) {
+		i := len(records)
+		for i > 0 && headerID(records[i-1]) > headerID(r) {
+			i--
+		}
+		records = append(records, nil)
+		copy(records[i+1:], records[i:])
+		records[i] = r
+	}
+
+	extra := make([]byte, 0, len(fh.Extra)+len(field))
+	for _, r := range records {
+		extra = append(extra, r...)
+	}
+	fh.Extra = extra
+}
+
+// splitExtra returns the records of the extra field extra.  Trailing bytes too short to be a
+// record are dropped.
+func splitExtra(extra []byte) [][]byte {
+	var records [][]byte
+	for len(extra) >= 4 {
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra) {
+			break
+		}
+		records = append(records, extra[:size])
+		extra = extra[size:]
+	}
+	return records
+}
+
+func headerID(record []byte) uint16 {
+	return binary.LittleEndian.Uint16(record)
+}
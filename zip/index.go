@@ -0,0 +1,265 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"android/soong/third_party/zip"
+)
+
+// Zip files written with ZipArgs.EmitIndex end with a stored entry IndexName, immediately
+// before the central directory, that lists every other entry sorted by name.  All integers
+// are little-endian.  Each record of the index is:
+//
+//	uint16  length of the name
+//	        name
+//	uint64  offset of the local file header in the zip file
+//	uint64  compressed size
+//	uint64  uncompressed size
+//	uint32  CRC32
+//
+// The records are followed by a trailer of a uint64 with the size of the records, a uint32
+// with their count and the 8 bytes of IndexMagic.  Since soong_zip never writes a zip file
+// comment, a reader finds the central directory from the end of central directory record at
+// the end of the file, and the trailer right before it, without reading the central
+// directory.  Use NewIndexedReader to read it.
+const (
+	IndexName  = ".soong_zip_index"
+	IndexMagic = "SZINDEX1"
+)
+
+const indexTrailerLen = 8 + 4 + len(IndexMagic)
+
+var errNoIndex = errors.New("zip file has no index written by soong_zip")
+
+// IndexEntry is a record of the index.
+type IndexEntry struct {
+	Name             string
+	Offset           int64
+	CompressedSize   uint64
+	UncompressedSize uint64
+	CRC32            uint32
+}
+
+// indexEntry returns the record of an entry whose local header is at offset, once its
+// writer has been closed and its header has the final sizes.
+func indexEntry(fh *zip.FileHeader, offset int64) IndexEntry {
+	return IndexEntry{
+		Name:             fh.Name,
+		Offset:           offset,
+		CompressedSize:   fh.CompressedSize64,
+		UncompressedSize: fh.UncompressedSize64,
+		CRC32:            fh.CRC32,
+	}
+}
+
+// indexContents returns the contents of IndexName for entries.
+func indexContents(entries []IndexEntry) []byte {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	buf := &bytes.Buffer{}
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, uint16(len(e.Name)))
+		buf.WriteString(e.Name)
+		binary.Write(buf, binary.LittleEndian, uint64(e.Offset))
+		binary.Write(buf, binary.LittleEndian, e.CompressedSize)
+		binary.Write(buf, binary.LittleEndian, e.UncompressedSize)
+		binary.Write(buf, binary.LittleEndian, e.CRC32)
+	}
+	size := buf.Len()
+	binary.Write(buf, binary.LittleEndian, uint64(size))
+	binary.Write(buf, binary.LittleEndian, uint32(len(entries)))
+	buf.WriteString(IndexMagic)
+	return buf.Bytes()
+}
+
+// writeIndex writes the index of entries as the last entry of zipw.
+func (z *ZipWriter) writeIndex(zipw *zip.Writer, entries []IndexEntry) error {
+	contents := indexContents(entries)
+	fh := &zip.FileHeader{
+		Name:               IndexName,
+		Method:             zip.Store,
+		UncompressedSize64: uint64(len(contents)),
+		CompressedSize64:   uint64(len(contents)),
+		CRC32:              crc32.ChecksumIEEE(contents),
+	}
+	z.setModTime(fh, z.time)
+
+	var w io.WriteCloser
+	var err error
+	if z.storedDescriptors {
+		w, err = zipw.CreateHeaderWithDataDescriptor(fh)
+	} else {
+		var zw io.Writer
+		zw, err = zipw.CreateHeaderAndroid(fh)
+		w = nopCloser{zw}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(contents); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return z.finishEntry(fh)
+}
+
+// IndexedReader looks up and reads the entries of a zip file written with ZipArgs.EmitIndex
+// using its index instead of its central directory.
+type IndexedReader struct {
+	r       io.ReaderAt
+	entries []IndexEntry
+}
+
+// NewIndexedReader reads the index of the zip file r of size bytes.
+func NewIndexedReader(r io.ReaderAt, size int64) (*IndexedReader, error) {
+	tailLen := int64(directoryEndLen + directory64LocLen + directory64EndLen)
+	if tailLen > size {
+		tailLen = size
+	}
+	tail := make([]byte, tailLen)
+	if _, err := r.ReadAt(tail, size-tailLen); err != nil {
+		return nil, err
+	}
+	cdOffset, err := centralDirectoryOffset(tail)
+	if err != nil {
+		return nil, errNoIndex
+	}
+
+	if cdOffset < int64(indexTrailerLen) {
+		return nil, errNoIndex
+	}
+	trailer := make([]byte, indexTrailerLen)
+	if _, err := r.ReadAt(trailer, cdOffset-int64(indexTrailerLen)); err != nil {
+		return nil, err
+	}
+	if string(trailer[12:]) != IndexMagic {
+		return nil, errNoIndex
+	}
+	recordsLen := int64(binary.LittleEndian.Uint64(trailer))
+	count := int(binary.LittleEndian.Uint32(trailer[8:]))
+	start := cdOffset - int64(indexTrailerLen) - recordsLen
+	if recordsLen < 0 || start < 0 {
+		return nil, errNoIndex
+	}
+
+	records := make([]byte, recordsLen)
+	if _, err := r.ReadAt(records, start); err != nil {
+		return nil, err
+	}
+
+	entries := make([]IndexEntry, 0, count)
+	for len(records) > 0 {
+		if len(records) < 2 {
+			return nil, errors.New("truncated index")
+		}
+		n := int(binary.LittleEndian.Uint16(records))
+		if len(records) < 2+n+28 {
+			return nil, errors.New("truncated index")
+		}
+		rec := records[2+n:]
+		entries = append(entries, IndexEntry{
+			Name:             string(records[2 : 2+n]),
+			Offset:           int64(binary.LittleEndian.Uint64(rec)),
+			CompressedSize:   binary.LittleEndian.Uint64(rec[8:]),
+			UncompressedSize: binary.LittleEndian.Uint64(rec[16:]),
+			CRC32:            binary.LittleEndian.Uint32(rec[24:]),
+		})
+		records = rec[28:]
+	}
+	if len(entries) != count {
+		return nil, fmt.Errorf("index has %d entries, its trailer has %d", len(entries), count)
+	}
+
+	return &IndexedReader{r: r, entries: entries}, nil
+}
+
+// Entries returns the records of the index, sorted by name.
+func (r *IndexedReader) Entries() []IndexEntry {
+	return r.entries
+}
+
+// Lookup returns the record of the entry name with a binary search of the index.
+func (r *IndexedReader) Lookup(name string) (IndexEntry, bool) {
+	i := sort.Search(len(r.entries), func(i int) bool { return r.entries[i].Name >= name })
+	if i < len(r.entries) && r.entries[i].Name == name {
+		return r.entries[i], true
+	}
+	return IndexEntry{}, false
+}
+
+// Open returns a reader for the uncompressed contents of the entry name, which fails with
+// zip.ErrChecksum at the end if they don't match the CRC32 in the index.
+func (r *IndexedReader) Open(name string) (io.ReadCloser, error) {
+	e, ok := r.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%q is not in the index", name)
+	}
+
+	var local [30]byte
+	if _, err := r.r.ReadAt(local[:], e.Offset); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(local[:]) != 0x04034b50 {
+		return nil, fmt.Errorf("%q: no local file header at offset %d", name, e.Offset)
+	}
+	method := binary.LittleEndian.Uint16(local[8:])
+	dataOffset := e.Offset + 30 + int64(binary.LittleEndian.Uint16(local[26:])) +
+		int64(binary.LittleEndian.Uint16(local[28:]))
+
+	data := io.NewSectionReader(r.r, dataOffset, int64(e.CompressedSize))
+	var rc io.ReadCloser
+	switch method {
+	case zip.Store:
+		rc = ioutil.NopCloser(data)
+	case zip.Deflate:
+		rc = flate.NewReader(data)
+	default:
+		return nil, zip.ErrAlgorithm
+	}
+	return &indexedFileReader{rc: rc, crc: crc32.NewIEEE(), want: e.CRC32}, nil
+}
+
+// indexedFileReader checks the CRC32 of an entry opened by IndexedReader.Open.
+type indexedFileReader struct {
+	rc   io.ReadCloser
+	crc  hash.Hash32
+	want uint32
+}
+
+func (r *indexedFileReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && r.crc.Sum32() != r.want {
+		err = zip.ErrChecksum
+	}
+	return n, err
+}
+
+func (r *indexedFileReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"compress/flate"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// LevelPattern is the compression level of the entries whose paths in the zip match Pattern,
+// which may use ** like pathtools.Match, see ZipArgs.LevelPatterns.
+type LevelPattern struct {
+	Pattern string
+	Level   int
+}
+
+// ParseLevelPattern parses a LevelPattern of the form pattern=level.
+func ParseLevelPattern(s string) (LevelPattern, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return LevelPattern{}, fmt.Errorf("level pattern %q must be of the form pattern=level", s)
+	}
+	level, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return LevelPattern{}, fmt.Errorf("level pattern %q has invalid level %q", s, s[i+1:])
+	}
+	return LevelPattern{Pattern: s[:i], Level: level}, nil
+}
+
+// checkLevelPatterns returns an error for the first of ZipArgs.LevelPatterns that isn't a valid
+// pattern or has a level out of range, so that it fails before zipping instead of never
+// matching.
+func checkLevelPatterns(patterns []LevelPattern) error {
+	for _, p := range patterns {
+		if _, err := pathtools.Match(p.Pattern, p.Pattern); err != nil {
+			return fmt.Errorf("level pattern %q: %s", p.Pattern, err)
+		}
+		if p.Level < flate.NoCompression || p.Level > flate.BestCompression {
+			return fmt.Errorf("level pattern %q has level %d, it must be from %d to %d",
+				p.Pattern, p.Level, flate.NoCompression, flate.BestCompression)
+		}
+	}
+	return nil
+}
+
+// levelFor returns the compression level of the entry name: the level of the first of
+// ZipArgs.LevelPatterns that matches it, or ZipArgs.CompressionLevel if none does.
+func (z *ZipWriter) levelFor(name string) int {
+	for _, p := range z.levelPatterns {
+		if match, _ := pathtools.Match(p.Pattern, name); match {
+			return p.Level
+		}
+	}
+	return z.compLevel
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// checkEntriesPerDir reports the directories that would have more than max direct entries,
+// for ZipArgs.MaxEntriesPerDir.  The entries of a directory are the files and directories
+// whose parent it is, including the parents of deeper entries that only exist implicitly.
+// The root of the zip is reported as ".".
+func (z *ZipWriter) checkEntriesPerDir(pathMappings []pathMapping, max int, fail bool) error {
+	children := make(map[string]map[string]bool)
+	for _, ele := range pathMappings {
+		for p := path.Clean(ele.dest); p != "." && p != "/"; p = path.Dir(p) {
+			dir := path.Dir(p)
+			if children[dir] == nil {
+				children[dir] = make(map[string]bool)
+			}
+			if children[dir][p] {
+				// The parents of p have already been counted.
+				break
+			}
+			children[dir][p] = true
+		}
+	}
+
+	var dirs []string
+	for dir, c := range children {
+		if len(c) > max {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		err := fmt.Errorf("directory %q has %d entries, more than the maximum of %d",
+			dir, len(children[dir]), max)
+		if fail {
+			return err
+		}
+		if err := z.warn(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
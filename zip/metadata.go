@@ -0,0 +1,138 @@
+// Copyright 2018 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"android/soong/third_party/zip"
+)
+
+// Metadata describes the entries of a zip file written with ZipArgs.MetadataFilePath set.  It
+// is serialized as JSON:
+//
+//	{
+//	  "entries": [
+//	    {
+//	      "name": "a/",                 // name of the entry in the zip file
+//	      "type": "dir",                // "file", "dir" or "symlink"
+//	      "method": "store",            // "store" or "deflate", the method actually used
+//	      "size": 0,                    // uncompressed size in bytes
+//	      "compressed_size": 0,         // size of the entry data in the zip file
+//	      "ratio": 0,                   // size / compressed_size, omitted if either is 0
+//	      "crc32": 0,                   // CRC32 of the uncompressed data, omitted if it is 0
+//	      "explicit": true,             // dirs only: listed as a source rather than implied
+//	                                    // by the files inside it
+//	      "empty": true                 // dirs only: no other entries are inside it
+//	    }
+//	  ]
+//	}
+//
+// Entries are listed in the order they appear in the zip file.
+type Metadata struct {
+	Entries []EntryMetadata `json:"entries"`
+}
+
+type EntryMetadata struct {
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	Method         string  `json:"method"`
+	Size           uint64  `json:"size"`
+	CompressedSize uint64  `json:"compressed_size"`
+	Ratio          float64 `json:"ratio,omitempty"`
+	CRC32          uint32  `json:"crc32,omitempty"`
+	Explicit       bool    `json:"explicit,omitempty"`
+	Empty          bool    `json:"empty,omitempty"`
+}
+
+func methodName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "store"
+	case zip.Deflate:
+		return "deflate"
+	default:
+		return "unknown"
+	}
+}
+
+// add records an entry after it has been written, once its compressed size is known.
+func (m *Metadata) add(fh *zip.FileHeader) {
+	entry := EntryMetadata{
+		Name:           fh.Name,
+		Type:           "file",
+		Method:         methodName(fh.Method),
+		Size:           fh.UncompressedSize64,
+		CompressedSize: fh.CompressedSize64,
+		CRC32:          fh.CRC32,
+	}
+
+	if mode := fh.Mode(); mode&os.ModeDir != 0 || strings.HasSuffix(fh.Name, "/") {
+		entry.Type = "dir"
+	} else if mode&os.ModeSymlink != 0 {
+		entry.Type = "symlink"
+	}
+
+	if entry.Size > 0 && entry.CompressedSize > 0 {
+		entry.Ratio = float64(entry.Size) / float64(entry.CompressedSize)
+	}
+
+	m.Entries = append(m.Entries, entry)
+}
+
+// markDirs fills in the explicit and empty flags of directory entries once all entries have
+// been written.  explicitDirs contains the cleaned names of directories that were sources.
+func (m *Metadata) markDirs(explicitDirs map[string]bool) {
+	hasChildren := make(map[string]bool)
+	for _, e := range m.Entries {
+		parent := path.Dir(strings.TrimSuffix(e.Name, "/"))
+		hasChildren[parent] = true
+	}
+
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if e.Type == "dir" {
+			name := strings.TrimSuffix(e.Name, "/")
+			e.Explicit = explicitDirs[name]
+			e.Empty = !hasChildren[name]
+		}
+	}
+}
+
+// ReadMetadata reads a file written for ZipArgs.MetadataFilePath.
+func ReadMetadata(file string) (*Metadata, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	m := &Metadata{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return m, nil
+}
+
+func (m *Metadata) writeFile(file string) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(buf, '\n'), 0666)
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ReadModeMap reads the modes of paths in the zip for ZipArgs.ModeMap, one path and an octal
+// mode separated by whitespace per line, like "system/bin 0755".  A leading slash of the path
+// is ignored, and "/" is the prefix of every path.  The mode may include the setuid (04000),
+// setgid (02000) and sticky (01000) bits.  Blank lines and lines starting with # are ignored.
+func ReadModeMap(r io.Reader) (map[string]os.FileMode, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	modes := make(map[string]os.FileMode)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a path and a mode, got %q", i+1, line)
+		}
+		v, err := strconv.ParseUint(fields[1], 8, 32)
+		if err != nil || v > 07777 {
+			return nil, fmt.Errorf("line %d: mode %q must be octal from 0 to 07777", i+1, fields[1])
+		}
+
+		prefix := modeMapPath(fields[0])
+		if _, exists := modes[prefix]; exists {
+			return nil, fmt.Errorf("line %d: %s is listed more than once", i+1, fields[0])
+		}
+
+		mode := os.FileMode(v & 0777)
+		if v&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if v&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if v&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+		modes[prefix] = mode
+	}
+	return modes, nil
+}
+
+// modeMapPath returns the key of ZipArgs.ModeMap for the path p, which is "" for the root.
+func modeMapPath(p string) string {
+	return strings.TrimLeft(path.Clean("/"+p), "/")
+}
+
+// mappedMode returns the mode of the longest prefix of the entry name in ZipArgs.ModeMap.
+// Prefixes match whole path elements, so system/bin is a prefix of system/bin/sh but not of
+// system/binfmt.
+func (z *ZipWriter) mappedMode(name string) (os.FileMode, bool) {
+	if len(z.modeMap) == 0 {
+		return 0, false
+	}
+	for p := modeMapPath(name); ; p = path.Dir(p) {
+		if p == "." {
+			p = ""
+		}
+		if mode, ok := z.modeMap[p]; ok {
+			return mode, true
+		}
+		if p == "" {
+			return 0, false
+		}
+	}
+}
+
+// fileMode returns the mode to set on the entry of a file at dest, or 0 to leave it unset.
+func (z *ZipWriter) fileMode(dest string, executable bool) os.FileMode {
+	if mode, ok := z.mappedMode(dest); ok {
+		return mode
+	}
+	if executable {
+		return 0700
+	}
+	return 0
+}
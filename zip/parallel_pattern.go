@@ -0,0 +1,54 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// checkParallelPatterns returns an error for the first of ZipArgs.ParallelPatterns that isn't
+// a valid pattern, so that it fails before zipping instead of never matching.
+func checkParallelPatterns(patterns []string) error {
+	for _, p := range patterns {
+		// Matching a pattern against itself reaches every element of it, so a syntax error
+		// anywhere is found.
+		if _, err := pathtools.Match(p, p); err != nil {
+			return fmt.Errorf("parallel pattern %q: %s", p, err)
+		}
+	}
+	return nil
+}
+
+// compressInParallel returns whether the file dest of size bytes to be deflated is split into
+// blocks compressed in parallel, instead of being compressed as a whole by one goroutine.
+// Without ZipArgs.ParallelPatterns that is decided by the size of the file, otherwise by
+// whether a pattern matches dest.  A file of a single block is always compressed as a whole,
+// since splitting it gains nothing.
+func (z *ZipWriter) compressInParallel(dest string, size int64) bool {
+	if z.parallelPatterns == nil {
+		return size >= minParallelFileSize && !z.wholeLargeFiles
+	}
+	if size <= parallelBlockSize {
+		return false
+	}
+	for _, p := range z.parallelPatterns {
+		if match, _ := pathtools.Match(p, dest); match {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// addPipe adds the source of a PipeArg with a Path at dest.  A regular file is added like any
+// other source, while anything else, like a named pipe or a character device, is read until
+// it is closed into memory and compressed from there, since it can't be read again.  The
+// entry then counts the buffered contents against the memory limit like a file of that size
+// until it has been written.
+func (z *ZipWriter) addPipe(dest, src string, method uint16) error {
+	s, err := z.fs.Stat(src)
+	if err != nil {
+		return err
+	} else if s.Mode().IsRegular() {
+		return z.addFile(dest, src, method, z.emulateJar)
+	} else if s.IsDir() {
+		return notAFileError(src)
+	}
+
+	contents, err := drainPipe(src, z.drainTimeout)
+	if err != nil {
+		return err
+	}
+	return z.addContents(dest, src, contents, method, s.Mode()&z.executableBits != 0, z.emulateJar)
+}
+
+// drainPipe reads the named pipe at name until its writer closes it.  If timeout is set and the
+// pipe hasn't been opened by a writer and closed again by then, it returns an error.
+func drainPipe(name string, timeout time.Duration) ([]byte, error) {
+	timedOut := func() error {
+		return fmt.Errorf("timed out after %s waiting for named pipe %q to be closed", timeout, name)
+	}
+
+	type result struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		// Opening a named pipe for reading blocks until it has a writer.
+		f, err := os.Open(name)
+		opened <- result{f, err}
+	}()
+
+	var deadline time.Time
+	var timer <-chan time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	var f *os.File
+	select {
+	case r := <-opened:
+		if r.err != nil {
+			return nil, r.err
+		}
+		f = r.f
+	case <-timer:
+		// Open the pipe for writing to unblock the open for reading, so that it doesn't
+		// stay blocked after returning.
+		if w, err := os.OpenFile(name, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+			w.Close()
+			if r := <-opened; r.f != nil {
+				r.f.Close()
+			}
+		}
+		return nil, timedOut()
+	}
+	defer f.Close()
+
+	if !deadline.IsZero() {
+		if err := f.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	buf, err := ioutil.ReadAll(f)
+	if os.IsTimeout(err) {
+		return nil, timedOut()
+	}
+	return buf, err
+}
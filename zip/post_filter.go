@@ -0,0 +1,48 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// zipThroughFilter writes the zip file to the standard input of the shell command
+// args.PostFilter, and its standard output to w.
+func (z *ZipWriter) zipThroughFilter(args ZipArgs, pathMappings []pathMapping, w io.Writer) error {
+	filter := args.PostFilter
+	cmd := exec.Command("/bin/sh", "-c", filter)
+	cmd.Stdout = w
+	cmd.Stderr = z.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("post filter %q: %s", filter, err)
+	}
+
+	args.PostFilter = ""
+	zipErr := z.zipTo(args, pathMappings, stdin)
+	stdin.Close()
+
+	// A filter that fails without reading all of its input also fails the write of the zip,
+	// report the filter.
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("post filter %q: %s", filter, err)
+	}
+	return zipErr
+}
@@ -46,7 +46,8 @@ func NewRateLimit(capacity int64) *RateLimit {
 	return ret
 }
 
-// RequestExecution blocks until another execution of size <size> can be allowed to run.
+// RequestExecution blocks until another execution of size <size> can be allowed to run, or
+// the RateLimit is stopped.
 func (r *RateLimit) Request(size int64) {
 	request := request{
 		size:     size,
@@ -54,18 +55,28 @@ func (r *RateLimit) Request(size int64) {
 	}
 
 	// wait for the request to be received
-	r.requests <- request
+	select {
+	case r.requests <- request:
+	case <-r.stop:
+		return
+	}
 
 	// wait for the request to be accepted
-	<-request.serviced
+	select {
+	case <-request.serviced:
+	case <-r.stop:
+	}
 }
 
 // Finish declares the completion of an execution of size <size>
 func (r *RateLimit) Finish(size int64) {
-	r.completions <- size
+	select {
+	case r.completions <- size:
+	case <-r.stop:
+	}
 }
 
-// Stop the background goroutine
+// Stop the background goroutine, and release any callers blocked in Request or Finish
 func (r *RateLimit) Stop() {
 	close(r.stop)
 }
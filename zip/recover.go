@@ -0,0 +1,268 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"android/soong/third_party/zip"
+)
+
+const (
+	localHeaderSignature   = 0x04034b50
+	dataDescriptorSig      = 0x08074b50
+	localHeaderLen         = 30
+	zip64ExtraTag          = 0x0001
+	recoveredFileMode      = 0700
+	recoveredDirectoryMode = 0700 | os.ModeDir
+)
+
+// countingByteReader counts the bytes read through it, so that the end of a deflate stream can
+// be found by inflating it.  It implements io.ByteReader so that flate doesn't read ahead.
+type countingByteReader struct {
+	r     *bufio.Reader
+	count int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.count++
+	}
+	return b, err
+}
+
+// recoveredEntry is an entry found by Recover, with its data still compressed.
+type recoveredEntry struct {
+	fh   *zip.FileHeader
+	data *io.SectionReader
+}
+
+// Recover salvages the complete entries of the zip file r of size bytes, whose central
+// directory may be missing because writing it was cut short, for example by a crash of a zip
+// written with ZipArgs.Checkpoint.  It reads the local file headers from the start of r, and
+// stops at the first entry that is truncated, corrupt or doesn't match its CRC32, or at the
+// central directory.  The salvaged entries are copied without being recompressed into a new
+// zip file written to w, and their number is returned.
+//
+// The modes of the entries are only in the central directory, so the salvaged files and
+// directories get soong_zip's default mode of 0700.
+func Recover(r io.ReaderAt, size int64, w io.Writer) (int, error) {
+	zipw := zip.NewWriter(w)
+	n := 0
+	for offset := int64(0); ; {
+		e, next, ok, err := recoverEntry(r, size, offset)
+		if err != nil {
+			return n, err
+		} else if !ok {
+			break
+		}
+		if err := writeRecoveredEntry(zipw, e); err != nil {
+			return n, err
+		}
+		n++
+		offset = next
+	}
+	return n, zipw.Close()
+}
+
+// RecoverFile salvages the complete entries of the zip file src into the new zip file dest with
+// Recover.
+func RecoverFile(src, dest string) (int, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	s, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, err
+	}
+	n, err := Recover(in, s.Size(), out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return n, err
+}
+
+// recoverEntry reads the entry whose local file header is at offset, and returns it with the
+// offset of the next local file header if it is complete and its contents match its CRC32.  It
+// returns an error if the data descriptor of the entry can't be read.
+func recoverEntry(r io.ReaderAt, size, offset int64) (*recoveredEntry, int64, bool, error) {
+	var local [localHeaderLen]byte
+	if offset+localHeaderLen > size {
+		return nil, 0, false, nil
+	}
+	if _, err := r.ReadAt(local[:], offset); err != nil {
+		return nil, 0, false, nil
+	}
+	le := binary.LittleEndian
+	if le.Uint32(local[:]) != localHeaderSignature {
+		return nil, 0, false, nil
+	}
+
+	fh := &zip.FileHeader{
+		ReaderVersion: le.Uint16(local[4:]),
+		Flags:         le.Uint16(local[6:]),
+		Method:        le.Uint16(local[8:]),
+		ModifiedTime:  le.Uint16(local[10:]),
+		ModifiedDate:  le.Uint16(local[12:]),
+		CRC32:         le.Uint32(local[14:]),
+	}
+	csize := int64(le.Uint32(local[18:]))
+	usize := int64(le.Uint32(local[22:]))
+	nameLen := int64(le.Uint16(local[26:]))
+	extraLen := int64(le.Uint16(local[28:]))
+
+	dataOffset := offset + localHeaderLen + nameLen + extraLen
+	if dataOffset > size {
+		return nil, 0, false, nil
+	}
+	nameExtra := make([]byte, nameLen+extraLen)
+	if _, err := r.ReadAt(nameExtra, offset+localHeaderLen); err != nil {
+		return nil, 0, false, nil
+	}
+	fh.Name = string(nameExtra[:nameLen])
+	extra := nameExtra[nameLen:]
+
+	// The zip64 extra is recreated by the writer when it is needed, read its sizes and drop it.
+	for len(extra) >= 4 {
+		tag, n := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		if 4+n > len(extra) {
+			break
+		}
+		if tag == zip64ExtraTag {
+			field := extra[4 : 4+n]
+			if usize == 0xffffffff && len(field) >= 8 {
+				usize, field = int64(le.Uint64(field)), field[8:]
+			}
+			if csize == 0xffffffff && len(field) >= 8 {
+				csize = int64(le.Uint64(field))
+			}
+		} else {
+			fh.Extra = append(fh.Extra, extra[:4+n]...)
+		}
+		extra = extra[4+n:]
+	}
+
+	if fh.Method != zip.Store && fh.Method != zip.Deflate {
+		return nil, 0, false, nil
+	}
+
+	var contents io.Reader
+	crc := crc32.NewIEEE()
+	next := dataOffset + csize
+	if fh.Flags&zip.DataDescriptorFlag == 0 {
+		if next > size {
+			return nil, 0, false, nil
+		}
+		contents = io.NewSectionReader(r, dataOffset, csize)
+		if fh.Method == zip.Deflate {
+			contents = flate.NewReader(contents)
+		}
+		n, err := io.Copy(crc, contents)
+		if err != nil || n != usize || crc.Sum32() != fh.CRC32 {
+			return nil, 0, false, nil
+		}
+	} else {
+		// The sizes and CRC32 follow the data, which must be deflated to find where it ends.
+		if fh.Method != zip.Deflate {
+			return nil, 0, false, nil
+		}
+		cr := &countingByteReader{r: bufio.NewReader(io.NewSectionReader(r, dataOffset, size-dataOffset))}
+		n, err := io.Copy(crc, flate.NewReader(cr))
+		if err != nil {
+			return nil, 0, false, nil
+		}
+		csize, usize = cr.count, n
+
+		descriptorLen := int64(12)
+		if csize >= 0xffffffff || usize >= 0xffffffff {
+			descriptorLen = 20
+		}
+		var descriptor [24]byte
+		descriptorOffset := dataOffset + csize
+		if descriptorOffset+4 > size {
+			return nil, 0, false, nil
+		}
+		if _, err := r.ReadAt(descriptor[:4], descriptorOffset); err != nil && err != io.EOF {
+			return nil, 0, false, err
+		}
+		if le.Uint32(descriptor[:]) == dataDescriptorSig {
+			descriptorOffset += 4
+		}
+		if descriptorOffset+descriptorLen > size {
+			return nil, 0, false, nil
+		}
+		if _, err := r.ReadAt(descriptor[:descriptorLen], descriptorOffset); err != nil {
+			return nil, 0, false, nil
+		}
+		fh.CRC32 = le.Uint32(descriptor[:])
+		if crc.Sum32() != fh.CRC32 {
+			return nil, 0, false, nil
+		}
+		next = descriptorOffset + descriptorLen
+	}
+
+	fh.CompressedSize64 = uint64(csize)
+	fh.UncompressedSize64 = uint64(usize)
+	fh.Flags &^= zip.DataDescriptorFlag
+	if fh.FileInfo().IsDir() {
+		fh.SetMode(recoveredDirectoryMode)
+	} else {
+		fh.SetMode(recoveredFileMode)
+	}
+	return &recoveredEntry{fh: fh, data: io.NewSectionReader(r, dataOffset, csize)}, next, true, nil
+}
+
+// writeRecoveredEntry copies the still compressed data of e into zipw.
+func writeRecoveredEntry(zipw *zip.Writer, e *recoveredEntry) error {
+	if e.fh.Method != zip.Deflate {
+		w, err := zipw.CreateHeaderAndroid(e.fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, e.data)
+		return err
+	}
+
+	w, err := zipw.CreateCompressedHeader(e.fh)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, e.data); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"android/soong/third_party/zip"
+)
+
+// entryChecker recomputes the sizes and CRC32 of an entry from the data the write loop writes
+// for it, for ZipArgs.SelfCheck.  Deflated data is inflated in a separate goroutine as it is
+// written, and compared block by block with the CRC32s recorded by the goroutines that
+// compressed each block of the file.
+type entryChecker struct {
+	fh        *zip.FileHeader
+	blockCRCs []uint32
+
+	// blockOffsets are the offsets in the compressed data of the start of each block.
+	blockOffsets []int64
+	compressed   int64
+
+	pw     *io.PipeWriter
+	result chan error
+}
+
+func newEntryChecker(ze *zipEntry) *entryChecker {
+	pr, pw := io.Pipe()
+	c := &entryChecker{
+		fh:        ze.fh,
+		blockCRCs: ze.blockCRCs,
+		pw:        pw,
+		result:    make(chan error, 1),
+	}
+
+	var r io.Reader = pr
+	if ze.fh.Method == zip.Deflate {
+		r = flate.NewReaderDict(pr, ze.dict)
+	}
+	go func() {
+		err := c.check(r)
+		// Unblock the write loop if the data stopped making sense before it was all written.
+		pr.CloseWithError(err)
+		c.result <- err
+	}()
+
+	return c
+}
+
+// startBlock marks the start of the next block of the compressed data.
+func (c *entryChecker) startBlock() {
+	c.blockOffsets = append(c.blockOffsets, c.compressed)
+}
+
+func (c *entryChecker) Write(p []byte) (int, error) {
+	c.compressed += int64(len(p))
+	// An error means the checker has already failed, which is reported by finish.
+	c.pw.Write(p)
+	return len(p), nil
+}
+
+// check reads the uncompressed data of the entry from r and compares it with the header.
+func (c *entryChecker) check(r io.Reader) error {
+	crc := crc32.NewIEEE()
+	size := int64(0)
+	for i := range c.blockCRCs {
+		blockSize := int64(parallelBlockSize)
+		if i == len(c.blockCRCs)-1 {
+			blockSize = int64(c.fh.UncompressedSize64) - size
+		}
+		blockCRC := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(crc, blockCRC), io.LimitReader(r, blockSize))
+		size += n
+		if err != nil {
+			return c.blockError(i, err)
+		}
+		if n != blockSize {
+			return c.blockError(i, fmt.Errorf("got %d uncompressed bytes, want %d", n, blockSize))
+		}
+		if got := blockCRC.Sum32(); got != c.blockCRCs[i] {
+			return c.blockError(i, fmt.Errorf("got CRC32 %08x, want %08x", got, c.blockCRCs[i]))
+		}
+	}
+
+	// The rest of the data after the blocks, or all of it for entries that weren't compressed
+	// in parallel blocks.
+	n, err := io.Copy(crc, r)
+	size += n
+	if err != nil {
+		return err
+	}
+	if uint64(size) != c.fh.UncompressedSize64 {
+		return fmt.Errorf("got %d uncompressed bytes, header has %d", size, c.fh.UncompressedSize64)
+	}
+	if got := crc.Sum32(); got != c.fh.CRC32 {
+		return fmt.Errorf("got CRC32 %08x, header has %08x", got, c.fh.CRC32)
+	}
+	return nil
+}
+
+func (c *entryChecker) blockError(i int, err error) error {
+	offset := "unknown"
+	if i < len(c.blockOffsets) {
+		offset = fmt.Sprint(c.blockOffsets[i])
+	}
+	return fmt.Errorf("block %d of %d at uncompressed offset %d, compressed offset %s: %s",
+		i+1, len(c.blockCRCs), int64(i)*parallelBlockSize, offset, err)
+}
+
+// finish waits for the check of the entry to complete, and compares the compressed size
+// written with the header, which must have been updated by closing the entry's writer.
+func (c *entryChecker) finish() error {
+	c.pw.Close()
+	err := <-c.result
+	if err == nil && uint64(c.compressed) != c.fh.CompressedSize64 {
+		err = fmt.Errorf("wrote %d compressed bytes, header has %d", c.compressed, c.fh.CompressedSize64)
+	}
+	if err != nil {
+		return fmt.Errorf("self-check of %q failed: %s", c.fh.Name, err)
+	}
+	return nil
+}
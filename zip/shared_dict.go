@@ -0,0 +1,205 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+// Zip files written with ZipArgs.SharedDictionaryAuto are not readable by standard zip readers.
+// The dictionary is stored uncompressed in the first entry, SharedDictionaryName, and every entry
+// compressed with it has a SharedDictionaryTag extra field holding the CRC32 of the dictionary.
+// To read such an entry, a reader must inflate its raw deflate data with the dictionary as the
+// preset dictionary, for example with flate.NewReaderDict.  A standard reader will fail with a
+// decompression or CRC32 error, or may silently produce corrupt contents.  Entries without the
+// extra field are ordinary deflated or stored entries.
+const (
+	SharedDictionaryName = ".soong_zip_shared_dictionary"
+	SharedDictionaryTag  = 0x4453
+)
+
+const (
+	// sharedDictSamples is the maximum number of files read to train the shared dictionary,
+	// and sharedDictSampleSize is the maximum number of bytes read from each.
+	sharedDictSamples    = 128
+	sharedDictSampleSize = 16 * 1024
+
+	// The dictionary is built from segments of the samples, scored by how many other samples
+	// contain the grams of each segment.
+	sharedDictSegmentSize = 64
+	sharedDictGramSize    = 8
+)
+
+// sampleSharedDictionary reads the beginning of up to sharedDictSamples of the files in
+// pathMappings that would be compressed with a shared dictionary, spread evenly through them.
+func (z *ZipWriter) sampleSharedDictionary(pathMappings []pathMapping) ([][]byte, error) {
+	var candidates []pathMapping
+	for _, ele := range pathMappings {
+		if ele.zipMethod != zip.Deflate || ele.contents != nil {
+			continue
+		}
+		// Errors are reported when the file is added to the zip.
+		s, err := z.stat(ele.src)
+		if err == nil && s.Mode().IsRegular() && s.Size() > sharedDictGramSize && s.Size() < minParallelFileSize {
+			candidates = append(candidates, ele)
+		}
+	}
+
+	step := 1
+	if len(candidates) > sharedDictSamples {
+		step = len(candidates) / sharedDictSamples
+	}
+
+	var samples [][]byte
+	for i := 0; i < len(candidates) && len(samples) < sharedDictSamples; i += step {
+		f, err := z.fs.Open(candidates[i].src)
+		if err != nil {
+			continue
+		}
+		sample := make([]byte, sharedDictSampleSize)
+		n, err := io.ReadFull(f, sample)
+		f.Close()
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		samples = append(samples, sample[:n])
+	}
+
+	return samples, nil
+}
+
+// trainSharedDictionary returns a preset dictionary of at most size bytes made of the segments
+// of samples whose contents are most common across the samples, or nil if the samples have
+// nothing in common.  The best segments are at the end of the dictionary, where they are cheapest
+// to refer to.
+func trainSharedDictionary(samples [][]byte, size int) []byte {
+	gram := func(b []byte) uint64 { return binary.LittleEndian.Uint64(b) }
+
+	// Count the number of samples that contain each gram.
+	frequency := make(map[uint64]int)
+	for _, sample := range samples {
+		seen := make(map[uint64]bool)
+		for i := 0; i+sharedDictGramSize <= len(sample); i++ {
+			g := gram(sample[i:])
+			if !seen[g] {
+				seen[g] = true
+				frequency[g]++
+			}
+		}
+	}
+
+	type segment struct {
+		data  []byte
+		score int
+	}
+
+	score := func(data []byte) int {
+		total := 0
+		seen := make(map[uint64]bool)
+		for i := 0; i+sharedDictGramSize <= len(data); i++ {
+			g := gram(data[i:])
+			// Grams that only appear in one sample don't help the others.
+			if f := frequency[g]; f > 1 && !seen[g] {
+				seen[g] = true
+				total += f - 1
+			}
+		}
+		return total
+	}
+
+	var segments []segment
+	for _, sample := range samples {
+		for start := 0; start+sharedDictGramSize <= len(sample); start += sharedDictSegmentSize {
+			end := start + sharedDictSegmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			if s := score(sample[start:end]); s > 0 {
+				segments = append(segments, segment{sample[start:end], s})
+			}
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score > segments[j].score })
+
+	// Take the best segments, rescoring each without the grams of the segments already taken
+	// so that repeated contents aren't added to the dictionary more than once.
+	var chosen [][]byte
+	total := 0
+	for _, s := range segments {
+		if total >= size {
+			break
+		}
+		if score(s.data) == 0 {
+			continue
+		}
+		for i := 0; i+sharedDictGramSize <= len(s.data); i++ {
+			frequency[gram(s.data[i:])] = 0
+		}
+		chosen = append(chosen, s.data)
+		total += len(s.data)
+	}
+
+	if len(chosen) == 0 {
+		return nil
+	}
+
+	dict := make([]byte, 0, total)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		dict = append(dict, chosen[i]...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
+
+// sharedDictionaryExtra returns the extra field that marks an entry compressed with dict.
+func sharedDictionaryExtra(dict []byte) []byte {
+	extra := make([]byte, 8)
+	binary.LittleEndian.PutUint16(extra[0:], SharedDictionaryTag)
+	binary.LittleEndian.PutUint16(extra[2:], 4)
+	binary.LittleEndian.PutUint32(extra[4:], crc32.ChecksumIEEE(dict))
+	return extra
+}
+
+// compressSharedDictionary deflates a whole file with the shared dictionary.  Resetting a
+// writer keeps the dictionary it was created with, so the writers are pooled separately from
+// the writers without a dictionary.
+func (z *ZipWriter) compressSharedDictionary(r io.Reader, deadline time.Time) (*bytes.Buffer, error) {
+	buf := new(bytes.Buffer)
+	fw, ok := z.sharedDictPool.Get().(flateWriter)
+	if ok {
+		fw.Reset(buf)
+	} else {
+		var err error
+		fw, err = z.newFlateWriter(buf, z.compLevel, z.sharedDict)
+		if err != nil {
+			return nil, compressFailedError{err, 1}
+		}
+	}
+	defer z.sharedDictPool.Put(fw)
+
+	if err := deflateBlock(fw, r, true, deadline); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
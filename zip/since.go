@@ -0,0 +1,107 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+
+	"android/soong/jar"
+)
+
+// removeUnchanged returns the mappings whose entries would differ from the entries recorded
+// in since, for ZipArgs.SinceMetadataFilePath.  Files and symlinks are compared by size and
+// CRC32, which means reading every file whose size hasn't changed, and directories are
+// unchanged if since has a directory with the same name.  Mappings without an entry in since,
+// and sources that can't be read, are always kept, errors are reported when they are added.
+func (z *ZipWriter) removeUnchanged(pathMappings []pathMapping, since *Metadata) []pathMapping {
+	previous := make(map[string]EntryMetadata, len(since.Entries))
+	for _, e := range since.Entries {
+		previous[e.Name] = e
+	}
+
+	var changed []pathMapping
+	for _, ele := range pathMappings {
+		if z.unchanged(ele, previous) {
+			z.exclude(ele.src, "unchanged")
+		} else {
+			changed = append(changed, ele)
+		}
+	}
+	return changed
+}
+
+func (z *ZipWriter) unchanged(ele pathMapping, previous map[string]EntryMetadata) bool {
+	if ele.contents != nil {
+		e, ok := previous[ele.dest]
+		return ok && e.Type == "file" && e.Size == uint64(len(ele.contents)) &&
+			e.CRC32 == crc32.ChecksumIEEE(ele.contents)
+	}
+	if ele.appended != nil {
+		if ele.appended.isDir() {
+			e, ok := previous[ele.dest+"/"]
+			return ok && e.Type == "dir"
+		}
+		e, ok := previous[ele.dest]
+		return ok && e.Type == "file" && e.Size == ele.appended.f.UncompressedSize64 &&
+			e.CRC32 == ele.appended.f.CRC32
+	}
+
+	// The manifest of a jar is generated from its source.
+	if z.emulateJar && ele.dest == jar.ManifestFile {
+		return false
+	}
+
+	s, err := z.stat(ele.src)
+	if err != nil {
+		return false
+	}
+	if s.IsDir() {
+		e, ok := previous[ele.dest+"/"]
+		return ok && e.Type == "dir"
+	}
+
+	e, ok := previous[ele.dest]
+	if !ok {
+		return false
+	}
+
+	if s.Mode()&os.ModeSymlink != 0 {
+		if target, inline := z.inlineSymlinkTarget(ele.src); inline {
+			s = target
+		} else {
+			link, err := z.fs.Readlink(ele.src)
+			link = toSlash(link)
+			return err == nil && e.Type == "symlink" && e.Size == uint64(len(link)) &&
+				e.CRC32 == crc32.ChecksumIEEE([]byte(link))
+		}
+	}
+
+	if e.Type != "file" || !s.Mode().IsRegular() || e.Size != uint64(s.Size()) {
+		return false
+	}
+
+	f, err := z.fs.Open(ele.src)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, f); err != nil {
+		return false
+	}
+	return e.CRC32 == crc.Sum32()
+}
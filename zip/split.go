@@ -0,0 +1,186 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"android/soong/third_party/zip"
+)
+
+// A file split with ZipArgs.SplitEntriesOver is stored as the ordinary entries name.part0,
+// name.part1, ..., whose contents concatenated in order are the contents of the file, followed
+// by a stored entry name.parts holding a SplitManifest in JSON.  Use ReassembleSplitEntry to
+// read it back.
+const (
+	SplitPartSuffix     = ".part"
+	SplitManifestSuffix = ".parts"
+)
+
+// SplitManifest describes how to reassemble a split file.
+type SplitManifest struct {
+	Name  string      `json:"name"`
+	Size  int64       `json:"size"`
+	Parts []SplitPart `json:"parts"`
+}
+
+// SplitPart is one of the entries of a split file.
+type SplitPart struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// sectionReaderCloser reads a section of a file, and closes the file when it is closed.
+type sectionReaderCloser struct {
+	*io.SectionReader
+	io.Closer
+}
+
+// addSplitFile adds the regular file src of fileSize bytes as parts of at most
+// z.splitEntriesOver bytes, each with the extra field extra and stamped with modTime, and the
+// manifest describing them.  The destinations have been checked and the parent directories
+// written by addFile.
+func (z *ZipWriter) addSplitFile(dest, src string, method uint16, fileSize int64, mode os.FileMode, extra []byte, modTime time.Time) error {
+	// The SHA-256 of each part can't be compared with the one of the whole file, so it is
+	// checked with an extra read before anything is queued.
+	if want, err := z.expectedSHA256(src); err != nil {
+		return err
+	} else if want != nil {
+		f, err := z.openLimited(src)
+		if err != nil {
+			return err
+		}
+		sum := sha256.New()
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if err := checkSHA256(&zipEntry{src: src, wantSHA256: want}, sum); err != nil {
+			return err
+		}
+	}
+
+	manifest := SplitManifest{Name: dest, Size: fileSize}
+	for i, start := 0, int64(0); start < fileSize; i, start = i+1, start+z.splitEntriesOver {
+		name := fmt.Sprintf("%s%s%d", dest, SplitPartSuffix, i)
+		if prev, exists := z.createdFiles[name]; exists {
+			return fmt.Errorf("destination %q of part %d of %q is also the file %q", name, i, src, prev)
+		}
+		z.createdFiles[name] = src
+
+		size := fileSize - start
+		if size > z.splitEntriesOver {
+			size = z.splitEntriesOver
+		}
+		manifest.Parts = append(manifest.Parts, SplitPart{Name: name, Size: size})
+	}
+
+	start := int64(0)
+	for _, part := range manifest.Parts {
+		f, err := z.openLimited(src)
+		if err != nil {
+			return err
+		}
+		r := &sectionReaderCloser{io.NewSectionReader(f, start, part.Size), f}
+		start += part.Size
+
+		partMethod := method
+		if partMethod == zip.Deflate && part.Size < z.deflateMinSize {
+			partMethod = zip.Store
+		}
+		header := &zip.FileHeader{
+			Name:               part.Name,
+			Method:             partMethod,
+			UncompressedSize64: uint64(part.Size),
+		}
+		addExtra(header, extra)
+		if mode != 0 {
+			header.SetMode(mode)
+		}
+		if err := z.writeFileContents(header, r, "", modTime); err != nil {
+			return err
+		}
+	}
+
+	name := dest + SplitManifestSuffix
+	if prev, exists := z.createdFiles[name]; exists {
+		return fmt.Errorf("destination %q of the manifest of %q is also the file %q", name, src, prev)
+	}
+	z.createdFiles[name] = src
+
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return z.writeContents(name, append(contents, '\n'), zip.Store, false)
+}
+
+// ReassembleSplitEntry writes the contents of the file name split with
+// ZipArgs.SplitEntriesOver to w.
+func ReassembleSplitEntry(r *zip.Reader, name string, w io.Writer) error {
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+
+	readEntry := func(f *zip.File, w io.Writer) (int64, error) {
+		rc, err := f.Open()
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.Copy(w, rc)
+	}
+
+	f := files[name+SplitManifestSuffix]
+	if f == nil {
+		return fmt.Errorf("%q has no split manifest %q", name, name+SplitManifestSuffix)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := readEntry(f, buf); err != nil {
+		return err
+	}
+	var manifest SplitManifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		return fmt.Errorf("%s: %s", f.Name, err)
+	}
+
+	total := int64(0)
+	for _, part := range manifest.Parts {
+		f := files[part.Name]
+		if f == nil {
+			return fmt.Errorf("part %q of %q is missing", part.Name, name)
+		}
+		n, err := readEntry(f, w)
+		if err != nil {
+			return err
+		}
+		if n != part.Size {
+			return fmt.Errorf("part %q of %q has %d bytes, the manifest has %d", part.Name, name, n, part.Size)
+		}
+		total += n
+	}
+	if total != manifest.Size {
+		return fmt.Errorf("parts of %q have %d bytes, the manifest has %d", name, total, manifest.Size)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultMaxSymlinkDepth is the number of symlinks followed in a row if
+// ZipArgs.MaxSymlinkDepth is 0, the limit of Linux.
+const DefaultMaxSymlinkDepth = 40
+
+// danglingSymlinkError is returned for a followed source that is a symlink, or a chain of
+// symlinks, to a file that doesn't exist.  It unwraps to the error of the missing file, so
+// that it is skipped like other missing sources with ZipArgs.IgnoreMissingFiles.
+type danglingSymlinkError struct {
+	src   string
+	chain []string
+	err   error
+}
+
+func (e danglingSymlinkError) Error() string {
+	return fmt.Sprintf("%q is a dangling symlink, %s does not exist: %s",
+		e.src, e.chain[len(e.chain)-1], strings.Join(e.chain, " -> "))
+}
+
+func (e danglingSymlinkError) Unwrap() error {
+	return e.err
+}
+
+// checkSymlinkDepth returns an error listing the chain of symlinks starting at src if it is
+// longer than z.maxSymlinkDepth.  Symlinks in the directories of the chain are resolved by the
+// filesystem as usual.  A chain that ends at a missing file is a danglingSymlinkError.
+func (z *ZipWriter) checkSymlinkDepth(src string) error {
+	chain := []string{src}
+	for p := src; ; {
+		s, err := z.fs.Lstat(p)
+		if os.IsNotExist(err) && len(chain) > 1 {
+			return danglingSymlinkError{src: src, chain: chain, err: err}
+		} else if err != nil || s.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		if len(chain) > z.maxSymlinkDepth {
+			return fmt.Errorf("%q is a chain of more than %d symlinks: %s",
+				src, z.maxSymlinkDepth, strings.Join(chain, " -> "))
+		}
+		target, err := z.fs.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		chain = append(chain, target)
+		p = target
+	}
+}
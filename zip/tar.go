@@ -0,0 +1,132 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"android/soong/third_party/zip"
+)
+
+// Format is the container format of the archive for ZipArgs.Format.
+type Format int
+
+const (
+	ZipFormat Format = iota
+	TarFormat
+	TarGzFormat
+)
+
+// tarWriter writes the entries of the write loop to a tar archive instead of a zip file.  The
+// entries are always stored, the whole archive is compressed with gzip for TarGzFormat.
+type tarWriter struct {
+	buf *bufio.Writer
+	gz  *gzip.Writer
+	tw  *tar.Writer
+}
+
+func newTarWriter(w io.Writer, format Format, level, bufSize int) (*tarWriter, error) {
+	if bufSize <= 0 {
+		bufSize = 4096
+	}
+	t := &tarWriter{buf: bufio.NewWriterSize(w, bufSize)}
+	var out io.Writer = t.buf
+	if format == TarGzFormat {
+		gz, err := gzip.NewWriterLevel(t.buf, level)
+		if err != nil {
+			return nil, err
+		}
+		t.gz = gz
+		out = gz
+	}
+	t.tw = tar.NewWriter(out)
+	return t, nil
+}
+
+// tarMode returns the permissions of the tar entry for fh.  Entries without unix permissions
+// get the usual defaults for their type.
+func tarMode(fh *zip.FileHeader) int64 {
+	mode := fh.Mode()
+	switch {
+	case fh.CreatorVersion>>8 == creatorUnix:
+		// Symlinks always have unix permissions, ZipArgs.SymlinkMode.
+		return int64(mode.Perm())
+	case mode&os.ModeSymlink != 0:
+		return 0777
+	case mode.IsDir():
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// creatorUnix is the high byte of zip.FileHeader.CreatorVersion set by SetMode.
+const creatorUnix = 3
+
+// CreateHeader writes the tar header for fh, and returns the writer for its data.  The data of
+// a symlink is its target, which is buffered and written in the header when it is closed.
+func (t *tarWriter) CreateHeader(fh *zip.FileHeader) (io.WriteCloser, error) {
+	hdr := &tar.Header{
+		Name:    fh.Name,
+		Mode:    tarMode(fh),
+		ModTime: fh.ModTime(),
+	}
+
+	mode := fh.Mode()
+	switch {
+	case mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		return &tarSymlinkWriter{t: t, hdr: hdr}, nil
+	case mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(fh.UncompressedSize64)
+	}
+
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return nopCloser{t.tw}, nil
+}
+
+type tarSymlinkWriter struct {
+	bytes.Buffer
+	t   *tarWriter
+	hdr *tar.Header
+}
+
+func (s *tarSymlinkWriter) Close() error {
+	s.hdr.Linkname = s.String()
+	return s.t.tw.WriteHeader(s.hdr)
+}
+
+// Close finishes the tar archive and any gzip stream around it.
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		if err := t.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return t.buf.Flush()
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"sync"
+	"time"
+)
+
+// budgetWindows is the number of windows the work of a zip with ZipArgs.TimeBudget is split
+// into.  The level is reconsidered at the end of each window from how fast its bytes were
+// compressed.
+const budgetWindows = 100
+
+// budgetLevels are the levels stepped down to, from the configured level, when the zip is
+// falling behind ZipArgs.TimeBudget.  Each one takes roughly half as long as the one before it.
+// Past the last one, files are stored.
+var budgetLevels = []int{6, 1}
+
+// budgetNow returns the current time, replaced in tests to simulate slow compression.
+var budgetNow = time.Now
+
+// timeBudget picks the compression level of each file so that a zip with ZipArgs.TimeBudget
+// finishes near its deadline.  It is used by the write loop, which starts compressing the
+// files one at a time, as fast as the compression goroutines take them.
+type timeBudget struct {
+	lock sync.Mutex
+
+	end   time.Time
+	total int64
+
+	started     int64
+	windowStart time.Time
+	windowBytes int64
+
+	// step is 0 for the configured level, then an index+1 into budgetLevels, and
+	// len(budgetLevels)+1 to store files.
+	step int
+}
+
+// newTimeBudget returns a timeBudget for total bytes of files to be zipped within budget.
+func newTimeBudget(budget time.Duration, total int64) *timeBudget {
+	now := budgetNow()
+	return &timeBudget{
+		end:         now.Add(budget),
+		total:       total,
+		windowStart: now,
+	}
+}
+
+// level returns the compression level for the next file of size bytes, or -1 to store it.
+// Once a window of bytes has been started, it projects how long the rest will take at the
+// rate of that window, steps down a level if that is past the deadline and steps back up if
+// it is well before it.
+func (b *timeBudget) level(configured int, size int64) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := budgetNow()
+	if b.windowBytes > 0 && b.windowBytes >= b.total/budgetWindows {
+		remaining := b.end.Sub(now)
+		elapsed := now.Sub(b.windowStart)
+		projected := time.Duration(float64(elapsed) * float64(b.total-b.started) / float64(b.windowBytes))
+		switch {
+		case remaining <= 0:
+			b.step = len(budgetLevels) + 1
+		case projected > remaining && b.step <= len(budgetLevels):
+			b.step++
+		case 2*projected < remaining && b.step > 0:
+			b.step--
+		}
+		b.windowStart, b.windowBytes = now, 0
+	}
+	b.started += size
+	b.windowBytes += size
+
+	if b.step == 0 {
+		return configured
+	} else if b.step > len(budgetLevels) {
+		return -1
+	} else if l := budgetLevels[b.step-1]; l < configured {
+		return l
+	}
+	return configured
+}
+
+// mappingsSize returns the total size of the sources of mappings, like sizeSort.
+func (z *ZipWriter) mappingsSize(mappings []pathMapping) int64 {
+	var total int64
+	for _, ele := range mappings {
+		if ele.contents != nil {
+			total += int64(len(ele.contents))
+		} else if s, err := z.stat(ele.src); err == nil && !s.IsDir() {
+			total += s.Size()
+		}
+	}
+	return total
+}
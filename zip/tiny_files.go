@@ -0,0 +1,85 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/blueprint/pathtools"
+)
+
+// tinyBatchEntries is the number of tiny files with ZipArgs.BatchTinyFiles that are compressed
+// one after the other by the same goroutine.
+const tinyBatchEntries = 128
+
+// tinyFile is a file waiting in z.tinyFiles to be compressed with the rest of its batch.  Its
+// entry has already been queued.
+type tinyFile struct {
+	ze           *zipEntry
+	r            pathtools.ReaderAtSeekerCloser
+	compressChan chan *zipEntry
+}
+
+// isTinyFile returns whether the file of fileSize bytes is compressed in a batch of tiny files
+// with ZipArgs.BatchTinyFiles.  Files compressed in parallel blocks never are.
+func (z *ZipWriter) isTinyFile(fileSize int64) bool {
+	return fileSize < z.batchTinyFiles && fileSize <= parallelBlockSize
+}
+
+// batchTinyFile adds a tiny file whose entry has been queued to the current batch, and starts
+// compressing the batch once it is full.  It must be called with mu held.
+func (z *ZipWriter) batchTinyFile(ze *zipEntry, r pathtools.ReaderAtSeekerCloser, compressChan chan *zipEntry) {
+	z.tinyFiles = append(z.tinyFiles, tinyFile{ze, r, compressChan})
+	if len(z.tinyFiles) >= tinyBatchEntries {
+		z.flushTinyFiles()
+	}
+}
+
+// flushTinyFiles starts a goroutine that compresses the tiny files of the current batch in
+// order.  The write loop may be waiting for the first of them, so it must be called with mu
+// held before anything that can block until the write loop has written an entry, and before
+// the writeOps are closed.
+func (z *ZipWriter) flushTinyFiles() {
+	if len(z.tinyFiles) == 0 {
+		return
+	}
+	batch := z.tinyFiles
+	z.tinyFiles = make([]tinyFile, 0, tinyBatchEntries)
+
+	go func() {
+		for i, f := range batch {
+			// compressWholeFile releases the CPU after each file.
+			z.cpuRateLimiter.Request()
+			var deadline time.Time
+			if z.compressDeadline > 0 {
+				deadline = time.Now().Add(z.compressDeadline)
+			}
+			// Reading the whole file once saves compressWholeFile reading it again and
+			// again, and allocating a copy buffer to checksum it.
+			contents, err := ioutil.ReadAll(f.r)
+			f.r.Close()
+			if err != nil {
+				z.fail(err)
+				for _, rest := range batch[i+1:] {
+					rest.r.Close()
+				}
+				return
+			}
+			z.compressWholeFile(f.ze, bytes.NewReader(contents), deadline, f.compressChan)
+		}
+	}()
+}
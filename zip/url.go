@@ -0,0 +1,133 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// URLArg describes an entry whose contents are downloaded from a URL.
+//
+// Downloading makes the zip depend on the network and on the server returning the same
+// contents every time, so the output is only reproducible if SHA256 is set, in which case
+// different contents fail the zip instead.
+type URLArg struct {
+	Dest string
+	URL  string
+
+	// SHA256 is the expected SHA-256 of the contents in hex, or empty to accept any contents.
+	SHA256 string
+}
+
+// DefaultURLTimeout is the time allowed for each attempt to download a URLArg if
+// ZipArgs.URLTimeout is 0.
+const DefaultURLTimeout = time.Minute
+
+// urlRetryDelay is the time to wait before the first retry of a failed download, doubled for
+// each retry after it.
+var urlRetryDelay = time.Second
+
+// fetchURL downloads the contents of u.URL, trying again up to retries times if the download
+// fails with an error that may be temporary.
+func fetchURL(client *http.Client, u URLArg, timeout time.Duration, retries int, allowInsecure bool) ([]byte, error) {
+	parsed, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url for %q: %s", u.Dest, err)
+	}
+	switch parsed.Scheme {
+	case "https":
+	case "http":
+		if !allowInsecure {
+			return nil, fmt.Errorf("url %q for %q is not https", u.URL, u.Dest)
+		}
+	default:
+		return nil, fmt.Errorf("url %q for %q must be https", u.URL, u.Dest)
+	}
+
+	var wantSum []byte
+	if u.SHA256 != "" {
+		wantSum, err = hex.DecodeString(u.SHA256)
+		if err != nil || len(wantSum) != sha256.Size {
+			return nil, fmt.Errorf("sha256 %q for %q is not 64 hex digits", u.SHA256, u.Dest)
+		}
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if timeout <= 0 {
+		timeout = DefaultURLTimeout
+	}
+
+	delay := urlRetryDelay
+	var contents []byte
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		contents, retry, err = fetchURLOnce(client, u.URL, timeout)
+		if err == nil || !retry || attempt >= retries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %q for %q: %s", u.URL, u.Dest, err)
+	}
+
+	if wantSum != nil {
+		if sum := sha256.Sum256(contents); !strings.EqualFold(hex.EncodeToString(sum[:]), u.SHA256) {
+			return nil, fmt.Errorf("contents of %q for %q have sha256 %x, want %s", u.URL, u.Dest, sum, u.SHA256)
+		}
+	}
+
+	return contents, nil
+}
+
+// fetchURLOnce makes one attempt to download rawURL, and returns whether it is worth trying
+// again if it fails.
+func fetchURLOnce(client *http.Client, rawURL string, timeout time.Duration) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// Only server errors and throttling are likely to go away.
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("%s", resp.Status)
+	}
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	return contents, false, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// NonUTF8Policy is what to do with entry names that aren't valid UTF-8 for ZipArgs.NonUTF8.
+//
+// Entries are never marked with the UTF-8 flag, so readers decode every name with their
+// default encoding, usually code page 437 or the locale's encoding.  Passing names that aren't
+// UTF-8 through keeps the bytes of the source path, which only extract to the same path with
+// a reader that uses the same encoding.
+type NonUTF8Policy int
+
+const (
+	// NonUTF8Passthrough stores the bytes of the name unchanged.
+	NonUTF8Passthrough NonUTF8Policy = iota
+
+	// NonUTF8Reject fails the zip.
+	NonUTF8Reject
+
+	// NonUTF8Transliterate replaces each invalid sequence with NonUTF8Placeholder.  Names that
+	// become the same as another entry's conflict with it like any other duplicate.
+	NonUTF8Transliterate
+)
+
+// NonUTF8Placeholder replaces the invalid sequences of names for NonUTF8Transliterate.
+const NonUTF8Placeholder = "_"
+
+// checkName applies ZipArgs.NonUTF8 to the name dest of an entry from src.
+func (z *ZipWriter) checkName(dest, src string) (string, error) {
+	if utf8.ValidString(dest) {
+		return dest, nil
+	}
+	switch z.nonUTF8 {
+	case NonUTF8Reject:
+		return "", fmt.Errorf("name %q of %q is not valid UTF-8", dest, src)
+	case NonUTF8Transliterate:
+		return strings.ToValidUTF8(dest, NonUTF8Placeholder), nil
+	default:
+		return dest, nil
+	}
+}
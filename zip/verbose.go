@@ -0,0 +1,48 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+)
+
+// verbosef prints a line of ZipArgs.Verbose output.  There is a line for every entry, so the
+// lines are buffered in z.verboseOut until flushVerbose, or until a warning is printed, and
+// written with stderrLock held so that they are never interleaved with other output.
+func (z *ZipWriter) verbosef(format string, a ...interface{}) {
+	z.stderrLock.Lock()
+	defer z.stderrLock.Unlock()
+	fmt.Fprintf(z.verboseOut, format+"\n", a...)
+}
+
+// flushVerbose writes the buffered ZipArgs.Verbose output to stderr.  It must be called with
+// stderrLock held.
+func (z *ZipWriter) flushVerbose() {
+	if z.verboseOut != nil {
+		z.verboseOut.Flush()
+	}
+}
+
+// finishVerbose flushes the ZipArgs.Verbose output once the write loop is done, after a
+// summary of the number of entries and their total sizes if the zip was written.
+func (z *ZipWriter) finishVerbose(written bool) {
+	z.stderrLock.Lock()
+	defer z.stderrLock.Unlock()
+	if written {
+		fmt.Fprintf(z.verboseOut, "%d entries, %d bytes compressed to %d bytes\n",
+			z.entries, z.inputSize, z.compressedSize)
+	}
+	z.flushVerbose()
+}
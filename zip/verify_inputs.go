@@ -0,0 +1,86 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// ReadSHA256Manifest reads the expected SHA-256s of source files for ZipArgs.InputSHA256s in
+// the format written by sha256sum: one line per file with the hash in hex, two spaces or a
+// space and a '*', and the path of the file.  Blank lines and lines starting with # are
+// ignored.
+func ReadSHA256Manifest(r io.Reader) (map[string][]byte, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string][]byte)
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) < 2*sha256.Size+2 || (line[2*sha256.Size:2*sha256.Size+2] != "  " &&
+			line[2*sha256.Size:2*sha256.Size+2] != " *") {
+			return nil, fmt.Errorf("line %d: want a sha256 and a path, got %q", i+1, line)
+		}
+		sum, err := hex.DecodeString(line[:2*sha256.Size])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid sha256 %q", i+1, line[:2*sha256.Size])
+		}
+		file := filepath.Clean(line[2*sha256.Size+2:])
+		if _, exists := sums[file]; exists {
+			return nil, fmt.Errorf("line %d: %s is listed more than once", i+1, file)
+		}
+		sums[file] = sum
+	}
+	return sums, nil
+}
+
+// expectedSHA256 returns the SHA-256 that the source file src must have, or nil if inputs
+// aren't verified.
+func (z *ZipWriter) expectedSHA256(src string) ([]byte, error) {
+	if z.inputSHA256s == nil {
+		return nil, nil
+	}
+	sum, ok := z.inputSHA256s[filepath.Clean(src)]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the input checksum manifest", src)
+	}
+	return sum, nil
+}
+
+// checkSHA256 returns an error if the contents of the entry hashed into sum don't match the
+// SHA-256 expected for its source.
+func checkSHA256(ze *zipEntry, sum hash.Hash) error {
+	if got := sum.Sum(nil); string(got) != string(ze.wantSHA256) {
+		return fmt.Errorf("%s has sha256 %x, but the input checksum manifest has %x", ze.src, got, ze.wantSHA256)
+	}
+	return nil
+}
+
+// sourceHashComment returns the comment of an entry for ZipArgs.CommentSourceHash.
+func sourceHashComment(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
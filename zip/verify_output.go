@@ -0,0 +1,86 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+
+	"android/soong/third_party/zip"
+)
+
+// verifyOutput reads the zip file in r of size bytes back for ZipArgs.VerifyOutput, and
+// inflates every entry to check it against the CRC32 and size in its header.  Up to jobs
+// entries are checked at once, or runtime.NumCPU() if jobs is <= 0.  It returns the error of
+// the first entry in the zip that fails.
+func verifyOutput(r io.ReaderAt, size int64, jobs int) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("verifying the zip: %s", err)
+	}
+
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	errs := make([]error, len(zr.File))
+	next := make(chan int)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = verifyEntry(zr.File[i])
+			}
+		}()
+	}
+	for i := range zr.File {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyEntry inflates the entry f and checks it against its header.
+func verifyEntry(f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("verifying %q: %s", f.Name, err)
+	}
+	defer r.Close()
+
+	crc := crc32.NewIEEE()
+	n, err := io.Copy(crc, r)
+	if err != nil {
+		return fmt.Errorf("verifying %q: %s", f.Name, err)
+	}
+	if sum := crc.Sum32(); sum != f.CRC32 {
+		return fmt.Errorf("verifying %q: contents have CRC32 %08x, header has %08x", f.Name, sum, f.CRC32)
+	}
+	if uint64(n) != f.UncompressedSize64 {
+		return fmt.Errorf("verifying %q: contents are %d bytes, header has %d", f.Name, n, f.UncompressedSize64)
+	}
+	return nil
+}
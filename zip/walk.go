@@ -0,0 +1,106 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// walkDir returns the paths of everything under dir, like globbing dir/**/*, sorted so that the
+// result doesn't depend on the order the directories were read in.  Up to jobs directories are
+// read at once, which hides the latency of each read on network filesystems.  Symlinks to
+// directories are only walked into if symlinks are followed.
+func (z *ZipWriter) walkDir(dir string, jobs int) ([]string, error) {
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, jobs)
+		lock sync.Mutex
+
+		paths    []string
+		firstErr error
+	)
+
+	// Missing roots and roots that aren't directories have already been reported by
+	// prepareZip, and have nothing under them.
+	if isDir, err := z.fs.IsDir(dir); err != nil || !isDir {
+		return nil, nil
+	}
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		defer wg.Done()
+
+		sem <- struct{}{}
+		names, err := z.fs.ReadDirNames(dir)
+		var subdirs []string
+		for _, name := range names {
+			if err != nil {
+				break
+			}
+			p := filepath.Join(dir, name)
+			var isDir bool
+			if z.followSymlinks {
+				isDir, err = z.fs.IsDir(p)
+				if os.IsNotExist(err) {
+					// A dangling symlink, which is reported when it is added to the zip.
+					isDir, err = false, nil
+				}
+			} else if s, lerr := z.fs.Lstat(p); lerr != nil {
+				err = lerr
+			} else {
+				isDir = s.IsDir()
+			}
+			if isDir && !z.isExcludedByPattern(p) {
+				// Excluded directories are returned to be filtered with the rest, but
+				// nothing below them is.
+				subdirs = append(subdirs, p)
+			}
+		}
+		<-sem
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+
+		// Don't start more work once something has failed.
+		if firstErr == nil {
+			wg.Add(len(subdirs))
+			for _, subdir := range subdirs {
+				go walk(subdir)
+			}
+		}
+	}
+
+	wg.Add(1)
+	go walk(dir)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
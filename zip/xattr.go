@@ -0,0 +1,138 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"android/soong/third_party/zip"
+)
+
+// Entries written with ZipArgs.StoreXattrs have an XattrTag extra field holding the extended
+// attributes of their source file, sorted by name, each as a little-endian uint16 length and
+// the bytes of the name followed by a uint16 length and the bytes of the value.  All the
+// attributes of a file must fit in the 65535 bytes of one extra field.  Use ReadXattrs to
+// decode them and RestoreXattrs to set them on an extracted file.
+const XattrTag = 0x5841
+
+// errXattrsUnsupported is returned by osReadXattrs and osWriteXattrs on platforms without
+// extended attributes.
+var errXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// readXattrs reads the extended attributes of a file, and can be replaced by tests that use a
+// mock filesystem.
+var readXattrs = osReadXattrs
+
+// xattrExtra returns the extra field holding the extended attributes of src, or nil if it
+// has none.  The attributes are always read from the operating system's filesystem.
+func (z *ZipWriter) xattrExtra(src string) ([]byte, error) {
+	attrs, err := readXattrs(src)
+	if err == errXattrsUnsupported {
+		if !z.xattrsWarned {
+			z.xattrsWarned = true
+			return nil, z.warn(err)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read extended attributes of %q: %s", src, err)
+	}
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	size := 0
+	for _, name := range names {
+		size += 2 + len(name) + 2 + len(attrs[name])
+	}
+	if size > 0xffff {
+		return nil, fmt.Errorf("extended attributes of %q don't fit in an extra field", src)
+	}
+
+	extra := make([]byte, 4, 4+size)
+	binary.LittleEndian.PutUint16(extra[0:], XattrTag)
+	binary.LittleEndian.PutUint16(extra[2:], uint16(size))
+	for _, name := range names {
+		value := attrs[name]
+		extra = append(extra, byte(len(name)), byte(len(name)>>8))
+		extra = append(extra, name...)
+		extra = append(extra, byte(len(value)), byte(len(value)>>8))
+		extra = append(extra, value...)
+	}
+	return extra, nil
+}
+
+// ReadXattrs returns the extended attributes stored in the XattrTag extra field of fh, or nil
+// if it doesn't have one.
+func ReadXattrs(fh *zip.FileHeader) (map[string][]byte, error) {
+	extra := fh.Extra
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if tag != XattrTag {
+			extra = extra[4+size:]
+			continue
+		}
+
+		attrs := make(map[string][]byte)
+		data := extra[4 : 4+size]
+		for len(data) > 0 {
+			name, rest, ok := readXattrField(data)
+			if !ok {
+				return nil, fmt.Errorf("%s: truncated extended attribute name", fh.Name)
+			}
+			value, rest, ok := readXattrField(rest)
+			if !ok {
+				return nil, fmt.Errorf("%s: truncated value of extended attribute %q", fh.Name, name)
+			}
+			attrs[string(name)] = append([]byte{}, value...)
+			data = rest
+		}
+		return attrs, nil
+	}
+	return nil, nil
+}
+
+// readXattrField splits a length-prefixed field from the start of data.
+func readXattrField(data []byte) (field, rest []byte, ok bool) {
+	if len(data) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if 2+n > len(data) {
+		return nil, nil, false
+	}
+	return data[2 : 2+n], data[2+n:], true
+}
+
+// RestoreXattrs sets the extended attributes stored in fh on the extracted file at path.
+func RestoreXattrs(fh *zip.FileHeader, path string) error {
+	attrs, err := ReadXattrs(fh)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+	return osWriteXattrs(path, attrs)
+}
@@ -0,0 +1,72 @@
+// Copyright 2024 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// osReadXattrs returns the extended attributes of the file at path.  Filesystems that don't
+// support them have none.
+func osReadXattrs(path string) (map[string][]byte, error) {
+	names, err := xattrBuffer(func(buf []byte) (int, error) { return syscall.Listxattr(path, buf) })
+	if err == syscall.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names, []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := xattrBuffer(func(buf []byte) (int, error) { return syscall.Getxattr(path, string(name), buf) })
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+// xattrBuffer calls f with a buffer large enough for its result, retrying if the result grew
+// between asking for its size and reading it.
+func xattrBuffer(f func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := f(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := f(buf)
+		if err == syscall.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+func osWriteXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if err := syscall.Setxattr(path, name, value, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -15,14 +15,36 @@
 package zip
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
+	"android/soong/jar"
+	stableflate "android/soong/third_party/flate"
 	"android/soong/third_party/zip"
 
 	"github.com/google/blueprint/pathtools"
@@ -35,8 +57,20 @@ var (
 	fileEmpty    = []byte("")
 	fileManifest = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\n\n")
 
+	fileProvenance      = []byte(`{"builder": {"id": "soong"}}`)
+	fileLicense         = []byte("Licensed under the Apache License, Version 2.0\n")
 	fileCustomManifest  = []byte("Custom manifest: true\n")
 	customManifestAfter = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nCustom manifest: true\n\n")
+
+	longManifest      = []byte("Implementation-Title: " + strings.Repeat("long ", 12) + "\n")
+	longManifestAfter = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nImplementation-Title: " +
+		strings.Repeat("long ", 10) + "\n long long \n\n")
+
+	classPath              = "lib/first-library.jar lib/second-library.jar lib/third-library.jar"
+	mainClassManifest      = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nMain-Class: com.example.Main\n\n")
+	mainClassManifestAfter = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nCustom manifest: true\nMain-Class: com.example.Main\n\n")
+	classPathManifest      = []byte("Manifest-Version: 1.0\nCreated-By: soong_zip\nMain-Class: com.example.Main\n" +
+		"Class-Path: lib/first-library.jar lib/second-library.jar lib/third-libra\n ry.jar\n\n")
 )
 
 var mockFs = pathtools.MockFs(map[string][]byte{
@@ -45,9 +79,15 @@ var mockFs = pathtools.MockFs(map[string][]byte{
 	"a/a/c -> ../../c": nil,
 	"a/a/d -> b":       nil,
 	"c":                fileC,
+	"empty":            fileEmpty,
 	"l":                []byte("a/a/a\na/a/b\nc\n"),
 	"l2":               []byte("missing\n"),
 	"manifest.txt":     fileCustomManifest,
+	"long.mf":          longManifest,
+	"mainclass.txt":    []byte("Main-Class: com.example.Other\n"),
+	"provenance.json":  fileProvenance,
+	"LICENSE":          fileLicense,
+	"bad.json":         []byte(`{"builder":`),
 })
 
 func fh(name string, contents []byte, method uint16) zip.FileHeader {
@@ -105,8 +145,19 @@ func TestZip(t *testing.T) {
 		nonDeflatedFiles   map[string]bool
 		dirEntries         bool
 		manifest           string
+		fixManifest        bool
+		mainClass          string
+		classPath          string
 		storeSymlinks      bool
 		ignoreMissingFiles bool
+		pipes              []PipeArg
+		stdin              []byte
+		provenance         string
+		provenancePath     string
+		license            string
+		licensePath        string
+		requireLicense     bool
+		deflateMinSize     int64
 
 		files []zip.FileHeader
 		err   error
@@ -298,6 +349,73 @@ func TestZip(t *testing.T) {
 				fh("a/a/b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "emulate jar with manifest to fix",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			manifest:         "long.mf",
+			fixManifest:      true,
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(longManifestAfter),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "emulate jar with main class",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			mainClass:        "com.example.Main",
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(mainClassManifest),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "emulate jar with main class and class path",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			mainClass:        "com.example.Main",
+			classPath:        classPath,
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(classPathManifest),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "emulate jar with manifest and main class",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			manifest:         "manifest.txt",
+			mainClass:        "com.example.Main",
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(mainClassManifestAfter),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
 		{
 			name: "dir entries",
 			args: fileArgsBuilder().
@@ -326,6 +444,61 @@ func TestZip(t *testing.T) {
 				fh("b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "junk levels",
+			args: fileArgsBuilder().
+				JunkLevels(1).
+				File("a/a/b").
+				File("c").
+				JunkLevels(0).
+				File("a/a/a"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a/b", fileB, zip.Deflate),
+				fh("c", fileC, zip.Deflate),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "junk levels past base name",
+			args: fileArgsBuilder().
+				JunkLevels(5).
+				File("a/a/a"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "junk levels with relative root and prefix",
+			args: fileArgsBuilder().
+				SourcePrefixToStrip("a").
+				JunkLevels(1).
+				PathPrefixInZip("foo").
+				Dir("a"),
+			compressionLevel: 9,
+
+			files: []zip.FileHeader{
+				fh("foo/a", fileA, zip.Deflate),
+				fh("foo/b", fileB, zip.Deflate),
+				fh("foo/c", fileC, zip.Deflate),
+				fh("foo/d", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "junk levels duplicate",
+			args: fileArgsBuilder().
+				JunkLevels(2).
+				File("a/a/a").
+				SourcePrefixToStrip("a").
+				JunkLevels(1).
+				File("a/a/a"),
+			compressionLevel: 9,
+
+			err: errors.New(`destination "a" has two files "a/a/a" and "a/a/a"`),
+		},
 		{
 			name: "non deflated files",
 			args: fileArgsBuilder().
@@ -339,6 +512,49 @@ func TestZip(t *testing.T) {
 				fh("a/a/b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "empty files",
+			args: fileArgsBuilder().
+				File("empty").
+				PathPrefixInZip("stored").
+				File("empty"),
+			compressionLevel: 9,
+			nonDeflatedFiles: map[string]bool{"stored/empty": true},
+			pipes: []PipeArg{
+				{Dest: "pipe/empty", Size: 0},
+			},
+
+			files: []zip.FileHeader{
+				fh("empty", fileEmpty, zip.Store),
+				fh("stored/empty", fileEmpty, zip.Store),
+				fh("pipe/empty", fileEmpty, zip.Store),
+			},
+		},
+		{
+			name: "empty files without compression",
+			args: fileArgsBuilder().
+				File("empty"),
+			compressionLevel: 0,
+
+			files: []zip.FileHeader{
+				fh("empty", fileEmpty, zip.Store),
+			},
+		},
+		{
+			name: "deflate min size",
+			args: fileArgsBuilder().
+				File("a/a/a").
+				File("a/a/b").
+				File("c"),
+			compressionLevel: 9,
+			deflateMinSize:   int64(len(fileB)),
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("a/a/b", fileB, zip.Deflate),
+				fh("c", fileC, zip.Store),
+			},
+		},
 		{
 			name: "ignore missing files",
 			args: fileArgsBuilder().
@@ -353,8 +569,126 @@ func TestZip(t *testing.T) {
 				fh("a/a/b", fileB, zip.Deflate),
 			},
 		},
+		{
+			name: "pipes",
+			args: fileArgsBuilder().
+				File("c"),
+			compressionLevel: 9,
+			pipes: []PipeArg{
+				{Dest: "pipe/a", Size: int64(len(fileA))},
+				{Dest: "pipe/empty", Size: 0},
+				{Dest: "pipe/b", Size: int64(len(fileB))},
+			},
+			stdin: append(append([]byte{}, fileA...), fileB...),
+
+			files: []zip.FileHeader{
+				fh("c", fileC, zip.Deflate),
+				fh("pipe/a", fileA, zip.Deflate),
+				fh("pipe/empty", fileEmpty, zip.Store),
+				fh("pipe/b", fileB, zip.Deflate),
+			},
+		},
+		{
+			name: "provenance",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			provenance:       "provenance.json",
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("META-INF/provenance.json", fileProvenance, zip.Store),
+			},
+		},
+		{
+			name: "provenance custom path",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			provenance:       "provenance.json",
+			provenancePath:   "attestations/build.json",
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("attestations/build.json", fileProvenance, zip.Store),
+			},
+		},
+		{
+			name: "provenance in jar",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			provenance:       "provenance.json",
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(fileManifest),
+				fh("META-INF/provenance.json", fileProvenance, zip.Store),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "license in jar",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			emulateJar:       true,
+			license:          "LICENSE",
+
+			files: []zip.FileHeader{
+				fhDir("META-INF/"),
+				fhManifest(fileManifest),
+				fh("META-INF/LICENSE", fileLicense, zip.Store),
+				fhDir("a/"),
+				fhDir("a/a/"),
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
+		{
+			name: "license custom path",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			license:          "LICENSE",
+			licensePath:      "NOTICE",
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+				fh("NOTICE", fileLicense, zip.Store),
+			},
+		},
+		{
+			name: "missing license",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			compressionLevel: 9,
+			license:          "missing",
+
+			files: []zip.FileHeader{
+				fh("a/a/a", fileA, zip.Deflate),
+			},
+		},
 
 		// errors
+		{
+			name: "error missing required license",
+			args: fileArgsBuilder().
+				File("a/a/a"),
+			license:        "missing",
+			requireLicense: true,
+			err:            errors.New(`license file "missing" does not exist`),
+		},
+		{
+			name: "error duplicate license",
+			args: fileArgsBuilder().
+				PathPrefixInZip("META-INF").
+				File("LICENSE"),
+			license: "LICENSE",
+			err:     errors.New(`destination "META-INF/LICENSE" has two files "LICENSE" and "LICENSE"`),
+		},
 		{
 			name: "error missing file",
 			args: fileArgsBuilder().
@@ -380,6 +714,72 @@ func TestZip(t *testing.T) {
 				File("a/a/a"),
 			err: IncorrectRelativeRootError{},
 		},
+		{
+			name:       "error invalid provenance",
+			args:       fileArgsBuilder(),
+			provenance: "bad.json",
+			err:        errors.New(`provenance file "bad.json" is not valid JSON`),
+		},
+		{
+			name: "error duplicate provenance",
+			args: fileArgsBuilder().
+				PathPrefixInZip("META-INF").
+				File("provenance.json"),
+			provenance: "provenance.json",
+			err:        errors.New(`destination "META-INF/provenance.json" has two files "provenance.json" and "provenance.json"`),
+		},
+		{
+			name: "error short pipe",
+			args: fileArgsBuilder(),
+			pipes: []PipeArg{
+				{Dest: "pipe/a", Size: int64(len(fileA))},
+				{Dest: "pipe/b", Size: int64(len(fileB))},
+			},
+			stdin: fileA,
+			err:   errors.New(`failed to read 62 bytes for pipe "pipe/b": EOF`),
+		},
+		{
+			name: "error pipe stream ends early",
+			args: fileArgsBuilder(),
+			pipes: []PipeArg{
+				{Dest: "pipe/a", Size: int64(len(fileA)) + 1},
+			},
+			stdin: fileA,
+			err:   errors.New(`failed to read 65 bytes for pipe "pipe/a": unexpected EOF`),
+		},
+		{
+			name: "error oversized pipe",
+			args: fileArgsBuilder(),
+			pipes: []PipeArg{
+				{Dest: "pipe/a", Size: math.MaxInt64},
+			},
+			stdin: fileA,
+			err:   fmt.Errorf(`failed to read %d bytes for pipe "pipe/a": unexpected EOF`, int64(math.MaxInt64)),
+		},
+		{
+			name:      "main class without jar",
+			args:      fileArgsBuilder().File("a/a/a"),
+			mainClass: "com.example.Main",
+
+			err: errors.New("must specify --jar when specifying a main class or class path"),
+		},
+		{
+			name:       "invalid main class",
+			args:       fileArgsBuilder().File("a/a/a"),
+			emulateJar: true,
+			mainClass:  "com/example/Main",
+
+			err: errors.New(`"com/example/Main" is not a valid class name`),
+		},
+		{
+			name:       "main class in manifest and flag",
+			args:       fileArgsBuilder().File("a/a/a"),
+			emulateJar: true,
+			manifest:   "mainclass.txt",
+			mainClass:  "com.example.Main",
+
+			err: errors.New("mainclass.txt: manifest already has a Main-Class attribute"),
+		},
 	}
 
 	for _, test := range testCases {
@@ -395,8 +795,19 @@ func TestZip(t *testing.T) {
 			args.AddDirectoryEntriesToZip = test.dirEntries
 			args.NonDeflatedFiles = test.nonDeflatedFiles
 			args.ManifestSourcePath = test.manifest
+			args.FixManifest = test.fixManifest
+			args.ManifestMainClass = test.mainClass
+			args.ManifestClassPath = test.classPath
 			args.StoreSymlinks = test.storeSymlinks
 			args.IgnoreMissingFiles = test.ignoreMissingFiles
+			args.PipeArgs = test.pipes
+			args.ProvenanceSourcePath = test.provenance
+			args.ProvenancePath = test.provenancePath
+			args.LicenseSourcePath = test.license
+			args.LicensePath = test.licensePath
+			args.RequireLicense = test.requireLicense
+			args.DeflateMinSize = test.deflateMinSize
+			args.Stdin = bytes.NewReader(test.stdin)
 			args.Filesystem = mockFs
 			args.Stderr = &bytes.Buffer{}
 
@@ -414,7 +825,7 @@ func TestZip(t *testing.T) {
 					if _, gotRelativeRootErr := err.(IncorrectRelativeRootError); !gotRelativeRootErr {
 						t.Fatalf("want error %v, got %v", test.err, err)
 					}
-				} else {
+				} else if err.Error() != test.err.Error() {
 					t.Fatalf("want error %v, got %v", test.err, err)
 				}
 				return
@@ -464,6 +875,16 @@ func TestZip(t *testing.T) {
 					continue
 				}
 
+				if want.Method != got.Method {
+					t.Errorf("incorrect file %s method want %v got %v", want.Name,
+						want.Method, got.Method)
+				}
+
+				if got.Method == zip.Store && got.CompressedSize64 != got.UncompressedSize64 {
+					t.Errorf("incorrect file %s compressed size for stored entry want %v got %v",
+						want.Name, got.UncompressedSize64, got.CompressedSize64)
+				}
+
 				if want.UncompressedSize64 != got.UncompressedSize64 {
 					t.Errorf("incorrect file %s length want %v got %v", want.Name,
 						want.UncompressedSize64, got.UncompressedSize64)
@@ -483,69 +904,6602 @@ func TestZip(t *testing.T) {
 	}
 }
 
-func TestReadRespFile(t *testing.T) {
-	testCases := []struct {
-		name, in string
-		out      []string
-	}{
-		{
-			name: "single quoting test case 1",
-			in:   `./cmd '"'-C`,
-			out:  []string{"./cmd", `"-C`},
-		},
-		{
-			name: "single quoting test case 2",
-			in:   `./cmd '-C`,
-			out:  []string{"./cmd", `-C`},
-		},
-		{
-			name: "single quoting test case 3",
-			in:   `./cmd '\"'-C`,
-			out:  []string{"./cmd", `\"-C`},
-		},
-		{
+// countingFs tracks the number of files that are open at once.
+type countingFs struct {
+	pathtools.FileSystem
+
+	lock       sync.Mutex
+	open, peak int
+}
+
+type countingReader struct {
+	pathtools.ReaderAtSeekerCloser
+	fs *countingFs
+}
+
+func (r countingReader) Close() error {
+	r.fs.lock.Lock()
+	r.fs.open--
+	r.fs.lock.Unlock()
+	return r.ReaderAtSeekerCloser.Close()
+}
+
+func (fs *countingFs) Open(name string) (pathtools.ReaderAtSeekerCloser, error) {
+	r, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	fs.open++
+	if fs.open > fs.peak {
+		fs.peak = fs.open
+	}
+	fs.lock.Unlock()
+	return countingReader{r, fs}, nil
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("src/%d", i)] = bytes.Repeat([]byte{byte(i)}, 1000)
+	}
+	fs := &countingFs{FileSystem: pathtools.MockFs(files)}
+
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().Dir("src").FileArgs(),
+		CompressionLevel: 9,
+		MaxOpenFiles:     3,
+		Filesystem:       fs,
+		Stderr:           &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 500 {
+		t.Errorf("want 500 files, got %d", len(zr.File))
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.peak > 3 {
+		t.Errorf("want at most 3 open files, got %d", fs.peak)
+	}
+}
+
+// countingWriter counts the calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestOutputBufferSize(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 500; i++ {
+		files[fmt.Sprintf("src/%d", i)] = []byte{byte(i)}
+	}
+
+	zipWithBuffer := func(size int) *countingWriter {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().Dir("src").FileArgs(),
+			CompressionLevel: 9,
+			OutputBufferSize: size,
+			Filesystem:       pathtools.MockFs(files),
+			Stderr:           &bytes.Buffer{},
+		}
+		w := &countingWriter{}
+		if err := ZipTo(args, w); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	small := zipWithBuffer(0)
+	large := zipWithBuffer(1024 * 1024)
+	if !bytes.Equal(small.Bytes(), large.Bytes()) {
+		t.Error("the buffer size changed the zip file")
+	}
+	if large.writes != 1 {
+		t.Errorf("want 1 write with a buffer larger than the zip file, got %d (%d with the default buffer)",
+			large.writes, small.writes)
+	}
+}
+
+func TestWalkDir(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"root/a/1":                 fileA,
+		"root/a/b/2":               fileB,
+		"root/a/b/c/3":             fileC,
+		"root/d/4":                 fileA,
+		"root/.hidden":             fileB,
+		"root/e":                   fileC,
+		"root/linkdir -> a/b":      nil,
+		"root/dangling -> missing": nil,
+	})
+
+	for _, follow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("follow symlinks %v", follow), func(t *testing.T) {
+			z := &ZipWriter{fs: fs, followSymlinks: pathtools.ShouldFollowSymlinks(follow)}
+			want, _, err := fs.Glob("root/**/*", nil, z.followSymlinks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(want)
+
+			got, err := z.walkDir("root", 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("want %q, got %q", want, got)
+			}
+		})
+	}
+
+	z := &ZipWriter{fs: fs}
+	if got, err := z.walkDir("missing", 3); err != nil || got != nil {
+		t.Errorf("want nothing for a missing directory, got %q, %v", got, err)
+	}
+}
+
+// slowFs adds latency to each metadata operation, like a network filesystem.
+type slowFs struct {
+	pathtools.FileSystem
+	latency time.Duration
+}
+
+func (fs slowFs) ReadDirNames(name string) ([]string, error) {
+	time.Sleep(fs.latency)
+	return fs.FileSystem.ReadDirNames(name)
+}
+
+func (fs slowFs) Lstat(name string) (os.FileInfo, error) {
+	time.Sleep(fs.latency)
+	return fs.FileSystem.Lstat(name)
+}
+
+func (fs slowFs) Stat(name string) (os.FileInfo, error) {
+	time.Sleep(fs.latency)
+	return fs.FileSystem.Stat(name)
+}
+
+func (fs slowFs) IsDir(name string) (bool, error) {
+	time.Sleep(fs.latency)
+	return fs.FileSystem.IsDir(name)
+}
+
+func (fs slowFs) IsSymlink(name string) (bool, error) {
+	time.Sleep(fs.latency)
+	return fs.FileSystem.IsSymlink(name)
+}
+
+// BenchmarkWalkDir finds the files in a deep and wide tree on a filesystem with 200us of latency
+// for each operation.
+func BenchmarkWalkDir(b *testing.B) {
+	files := make(map[string][]byte)
+	var add func(dir string, depth int)
+	add = func(dir string, depth int) {
+		for i := 0; i < 5; i++ {
+			files[fmt.Sprintf("%s/file%d", dir, i)] = fileA
+		}
+		if depth < 4 {
+			for i := 0; i < 4; i++ {
+				add(fmt.Sprintf("%s/dir%d", dir, i), depth+1)
+			}
+		}
+	}
+	add("root", 0)
+	fs := slowFs{pathtools.MockFs(files), 200 * time.Microsecond}
+
+	for _, jobs := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("jobs %d", jobs), func(b *testing.B) {
+			z := &ZipWriter{fs: fs}
+			for i := 0; i < b.N; i++ {
+				if _, err := z.walkDir("root", jobs); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestLowMemory(t *testing.T) {
+	large := make([]byte, minParallelFileSize+3*parallelBlockSize/2)
+	rand.New(rand.NewSource(1)).Read(large[:len(large)/3])
+	fs := pathtools.MockFs(map[string][]byte{
+		"large":  large,
+		"large2": large[parallelBlockSize:],
+		"small":  fileA,
+	})
+
+	zipWithLowMemory := func(lowMemory bool, jobs int) []byte {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().File("large").File("small").File("large2").FileArgs(),
+			CompressionLevel: 5,
+			NumParallelJobs:  jobs,
+			LowMemory:        lowMemory,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	want := zipWithLowMemory(false, 4)
+	for _, jobs := range []int{1, 2, 4} {
+		if got := zipWithLowMemory(true, jobs); !bytes.Equal(got, want) {
+			t.Errorf("low memory mode with %d jobs changed the zip file", jobs)
+		}
+	}
+}
+
+func TestSingleThreadLargeFiles(t *testing.T) {
+	words := []string{"alpha", "beta", "gamma", "delta"}
+	r := rand.New(rand.NewSource(1))
+	text := &bytes.Buffer{}
+	for text.Len() < minParallelFileSize+parallelBlockSize {
+		fmt.Fprintf(text, "%s %d\n", words[r.Intn(len(words))], r.Intn(1000))
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"large": text.Bytes(),
+		"small": fileA,
+	})
+
+	zipWithJobs := func(jobs int, singleThread bool) (*zip.File, []byte) {
+		args := ZipArgs{
+			FileArgs:               NewFileArgsBuilder().File("large").File("small").FileArgs(),
+			CompressionLevel:       5,
+			NumParallelJobs:        jobs,
+			SingleThreadLargeFiles: singleThread,
+			Filesystem:             fs,
+			Stderr:                 &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr.File[0], buf.Bytes()
+	}
+
+	expected := &bytes.Buffer{}
+	fw, err := flate.NewWriter(expected, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(text.Bytes())
+	fw.Close()
+
+	for _, jobs := range []int{1, 4} {
+		got, buf := zipWithJobs(jobs, true)
+		offset, err := got.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := buf[offset : offset+int64(got.CompressedSize64)]; !bytes.Equal(data, expected.Bytes()) {
+			t.Errorf("%d jobs: want the %d bytes of a single deflate stream, got %d different bytes",
+				jobs, expected.Len(), len(data))
+		}
+	}
+
+	if parallel, _ := zipWithJobs(4, false); parallel.CompressedSize64 == uint64(expected.Len()) {
+		t.Errorf("want parallel blocks to differ from a single deflate stream")
+	}
+}
+
+func TestDeflateStats(t *testing.T) {
+	large := bytes.Repeat([]byte("deflate stats "), (minParallelFileSize+parallelBlockSize/2)/14)
+	small := bytes.Repeat([]byte("small "), 1000)
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	fs := pathtools.MockFs(map[string][]byte{"large": large, "small": small, "random": random})
+
+	zipWithStats := func(deadline time.Duration) [][]string {
+		stats := filepath.Join(t.TempDir(), "stats.txt")
+		args := ZipArgs{
+			FileArgs:             NewFileArgsBuilder().File("large").File("small").File("random").FileArgs(),
+			CompressionLevel:     6,
+			NumParallelJobs:      4,
+			CompressDeadline:     deadline,
+			DeflateStatsFilePath: stats,
+			Filesystem:           fs,
+			Stderr:               &bytes.Buffer{},
+		}
+		if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadFile(stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var lines [][]string
+		for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+			lines = append(lines, strings.Split(line, "\t"))
+		}
+		return lines
+	}
+
+	// The stored random file has no line, and the ratio is compressed over uncompressed.
+	blocks := strconv.Itoa((len(large) + parallelBlockSize - 1) / parallelBlockSize)
+	lines := zipWithStats(0)
+	want := [][]string{
+		{"large", "6", blocks, "0", "preceding", strconv.Itoa(len(large))},
+		{"small", "6", "1", "0", "none", strconv.Itoa(len(small))},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("want %d lines, got %q", len(want), lines)
+	}
+	for i, line := range lines {
+		if len(line) != 8 || !reflect.DeepEqual(line[:6], want[i]) {
+			t.Errorf("want line starting with %q, got %q", want[i], line)
+			continue
+		}
+		size, _ := strconv.Atoi(line[5])
+		compressed, _ := strconv.Atoi(line[6])
+		if want := fmt.Sprintf("%.3f", float64(compressed)/float64(size)); compressed <= 0 || line[7] != want {
+			t.Errorf("%s: want ratio %s of %d compressed bytes, got %s", line[0], want, compressed, line[7])
+		}
+	}
+
+	// Past the deadline the blocks of the large file are stored within its deflate stream, and
+	// the small file is stored.
+	lines = zipWithStats(time.Nanosecond)
+	if len(lines) != 1 || lines[0][0] != "large" || lines[0][3] != blocks {
+		t.Errorf("want all %s blocks of large stored, got %q", blocks, lines)
+	}
+}
+
+func TestParallelPatterns(t *testing.T) {
+	text := func(size int) []byte {
+		return bytes.Repeat([]byte("parallel "), size/9+1)
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"out/big.img":    text(2 * parallelBlockSize),
+		"out/tiny.img":   text(parallelBlockSize / 2),
+		"out/huge.dat":   text(minParallelFileSize + parallelBlockSize),
+		"out/sub/x.img":  text(2 * parallelBlockSize),
+		"out/medium.dat": text(2 * parallelBlockSize),
+	})
+
+	zipWithPatterns := func(patterns []string, singleThread bool) (string, error) {
+		decisions := filepath.Join(t.TempDir(), "methods.txt")
+		args := ZipArgs{
+			FileArgs: NewFileArgsBuilder().
+				File("out/big.img").
+				File("out/tiny.img").
+				File("out/huge.dat").
+				File("out/sub/x.img").
+				File("out/medium.dat").
+				FileArgs(),
+			CompressionLevel:        5,
+			NumParallelJobs:         4,
+			ParallelPatterns:        patterns,
+			SingleThreadLargeFiles:  singleThread,
+			MethodDecisionsFilePath: decisions,
+			Filesystem:              fs,
+			Stderr:                  &bytes.Buffer{},
+		}
+		if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+			return "", err
+		}
+		got, err := ioutil.ReadFile(decisions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got), nil
+	}
+
+	testCases := []struct {
+		name     string
+		patterns []string
+		want     string
+	}{
+		{
+			name: "size threshold",
+			want: "out/big.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/tiny.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/huge.dat\tdeflate\tdeflate\tdeflated in parallel blocks\n" +
+				"out/sub/x.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/medium.dat\tdeflate\tdeflate\tdeflated\n",
+		},
+		{
+			name:     "patterns",
+			patterns: []string{"out/*.img"},
+			want: "out/big.img\tdeflate\tdeflate\tdeflated in parallel blocks\n" +
+				"out/tiny.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/huge.dat\tdeflate\tdeflate\tdeflated\n" +
+				"out/sub/x.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/medium.dat\tdeflate\tdeflate\tdeflated\n",
+		},
+		{
+			name:     "recursive and repeated",
+			patterns: []string{"**/*.img", "out/medium.dat"},
+			want: "out/big.img\tdeflate\tdeflate\tdeflated in parallel blocks\n" +
+				"out/tiny.img\tdeflate\tdeflate\tdeflated\n" +
+				"out/huge.dat\tdeflate\tdeflate\tdeflated\n" +
+				"out/sub/x.img\tdeflate\tdeflate\tdeflated in parallel blocks\n" +
+				"out/medium.dat\tdeflate\tdeflate\tdeflated in parallel blocks\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := zipWithPatterns(test.patterns, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("want method decisions:\n%s\ngot:\n%s", test.want, got)
+			}
+		})
+	}
+
+	if _, err := zipWithPatterns([]string{"out/*.img"}, true); err == nil {
+		t.Error("want error with single threaded large files")
+	}
+	_, err := zipWithPatterns([]string{"out/[.img"}, false)
+	if want := `parallel pattern "out/[.img": syntax error in pattern`; err == nil || err.Error() != want {
+		t.Errorf("want error %q, got %v", want, err)
+	}
+}
+
+func TestParallelBlockRatio(t *testing.T) {
+	words := []string{"alpha", "beta", "gamma", "delta"}
+	r := rand.New(rand.NewSource(1))
+	text := &bytes.Buffer{}
+	for text.Len() < minParallelFileSize+parallelBlockSize {
+		fmt.Fprintf(text, "%s %d\n", words[r.Intn(len(words))], r.Intn(1000))
+	}
+
+	compressedSize := func(singleThread bool) uint64 {
+		args := ZipArgs{
+			FileArgs:               NewFileArgsBuilder().File("large").FileArgs(),
+			CompressionLevel:       5,
+			NumParallelJobs:        4,
+			SingleThreadLargeFiles: singleThread,
+			Filesystem:             pathtools.MockFs(map[string][]byte{"large": text.Bytes()}),
+			Stderr:                 &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr.File[0].CompressedSize64
+	}
+
+	// Without the preset dictionary the blocks are about 0.2% larger.
+	single, parallel := compressedSize(true), compressedSize(false)
+	if cost := float64(parallel)/float64(single) - 1; cost > 0.0005 {
+		t.Errorf("parallel blocks are %d bytes, %.3f%% more than the %d bytes of a single stream",
+			parallel, 100*cost, single)
+	}
+}
+
+func TestZipWriterConcurrentAdd(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("src/%d", i)] = bytes.Repeat([]byte{byte(i)}, i*10)
+	}
+	fs := pathtools.MockFs(files)
+
+	buf := &bytes.Buffer{}
+	z := NewZipWriter(buf, ZipArgs{
+		CompressionLevel: 9,
+		Filesystem:       fs,
+		Stderr:           &bytes.Buffer{},
+	})
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 100)
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * 10; i < (g+1)*10; i++ {
+				var err error
+				if i%2 == 0 {
+					err = z.Add(fmt.Sprintf("files/%d", i), fmt.Sprintf("src/%d", i), zip.Deflate)
+				} else {
+					r := bytes.NewReader(files[fmt.Sprintf("src/%d", i)])
+					err = z.AddReader(fmt.Sprintf("readers/%d", i), r, EntryOptions{Method: zip.Deflate})
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+
+		i := strings.LastIndex(f.Name, "/")
+		want := files["src/"+f.Name[i+1:]]
+
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("error when opening %s: %s", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("error when reading %s: %s", f.Name, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Errorf("incorrect contents for %s", f.Name)
+		}
+	}
+
+	if len(names) != 100 {
+		t.Fatalf("want 100 files, got %d", len(names))
+	}
+
+	// Each goroutine's entries must appear in the order it added them.
+	for g := 0; g < 10; g++ {
+		last := -1
+		for idx, name := range names {
+			var i int
+			fmt.Sscanf(name[strings.LastIndex(name, "/")+1:], "%d", &i)
+			if i/10 == g {
+				if idx < last {
+					t.Errorf("entries for goroutine %d are out of order", g)
+				}
+				last = idx
+			}
+		}
+	}
+}
+
+func TestZipWriterError(t *testing.T) {
+	z := NewZipWriter(ioutil.Discard, ZipArgs{
+		CompressionLevel: 9,
+		Filesystem:       mockFs,
+		Stderr:           &bytes.Buffer{},
+	})
+
+	if err := z.Add("a", "a/a/a", zip.Deflate); err != nil {
+		t.Fatal(err)
+	}
+
+	err := z.Add("missing", "missing", zip.Deflate)
+	if !os.IsNotExist(err) {
+		t.Fatalf("want not exist error, got %v", err)
+	}
+
+	if err2 := z.Add("b", "a/a/b", zip.Deflate); err2 != err {
+		t.Errorf("want error %v after failure, got %v", err, err2)
+	}
+
+	if err2 := z.Close(); err2 != err {
+		t.Errorf("want error %v from Close, got %v", err, err2)
+	}
+}
+
+func ExampleZipWriter() {
+	buf := &bytes.Buffer{}
+	z := NewZipWriter(buf, ZipArgs{CompressionLevel: 5})
+
+	z.AddReader("hello.txt", strings.NewReader("hello world\n"), EntryOptions{Method: zip.Deflate})
+	z.AddReader("bin/tool", strings.NewReader("#!/bin/sh\n"), EntryOptions{Method: zip.Store, Executable: true})
+
+	if err := z.Close(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	zr, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	for _, f := range zr.File {
+		fmt.Println(f.Name, f.Mode())
+	}
+	// Output:
+	// hello.txt -rw-rw-rw-
+	// bin/tool -rwx------
+}
+
+func TestMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	for _, d := range []string{"a/empty", "b"} {
+		if err := os.MkdirAll(filepath.Join(src, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a/file"), fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "b/stored"), fileB, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	metadataFile := filepath.Join(dir, "metadata.json")
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			SourcePrefixToStrip(src).
+			File(filepath.Join(src, "b/stored")).
+			Dir(filepath.Join(src, "a")).
+			FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		CompressionLevel:         9,
+		NonDeflatedFiles:         map[string]bool{"b/stored": true},
+		MetadataFilePath:         metadataFile,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata Metadata
+	if err := json.Unmarshal(buf, &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ratio depends on the flate implementation, check it separately.
+	if e := metadata.Entries[4]; e.Ratio <= 1 || e.Ratio != float64(e.Size)/float64(e.CompressedSize) {
+		t.Errorf("incorrect ratio for %s: %v", e.Name, e.Ratio)
+	}
+	metadata.Entries[4].Ratio = 0
+	metadata.Entries[4].CompressedSize = 0
+
+	want := []EntryMetadata{
+		{Name: "b/", Type: "dir", Method: "store"},
+		{Name: "b/stored", Type: "file", Method: "store", Size: uint64(len(fileB)),
+			CompressedSize: uint64(len(fileB)), Ratio: 1, CRC32: crc32.ChecksumIEEE(fileB)},
+		{Name: "a/", Type: "dir", Method: "store"},
+		{Name: "a/empty/", Type: "dir", Method: "store", Explicit: true, Empty: true},
+		{Name: "a/file", Type: "file", Method: "deflate", Size: uint64(len(fileA)),
+			CRC32: crc32.ChecksumIEEE(fileA)},
+	}
+
+	if !reflect.DeepEqual(metadata.Entries, want) {
+		t.Errorf("incorrect metadata\nwant %+v\n got %+v", want, metadata.Entries)
+	}
+}
+
+func TestStableDeflate(t *testing.T) {
+	small := bytes.Repeat([]byte("stable deflate "), 1000)
+	large := make([]byte, minParallelFileSize+parallelBlockSize/2)
+	for i := range large {
+		large[i] = byte(i % 251 % 17)
+	}
+
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().File("small").File("large").FileArgs(),
+		CompressionLevel: 9,
+		NumParallelJobs:  4,
+		StableDeflate:    true,
+		Filesystem:       pathtools.MockFs(map[string][]byte{"small": small, "large": large}),
+		Stderr:           &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"small": small, "large": large}
+	for _, f := range zr.File {
+		if f.Method != zip.Deflate {
+			t.Errorf("%s: want method %d, got %d", f.Name, zip.Deflate, f.Method)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, want[f.Name]) {
+			t.Errorf("%s: contents don't match the input", f.Name)
+		}
+	}
+
+	// Whole files are compressed in a single block, so the entry must be exactly the
+	// output of the pinned encoder.
+	f := zr.File[0]
+	offset, err := f.DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &bytes.Buffer{}
+	fw, err := stableflate.NewWriter(expected, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(small)
+	fw.Close()
+	if got := buf.Bytes()[offset : offset+int64(f.CompressedSize64)]; !bytes.Equal(got, expected.Bytes()) {
+		t.Errorf("small: compressed data doesn't match the pinned encoder")
+	}
+}
+
+func TestExtendedTimestamps(t *testing.T) {
+	args := ZipArgs{
+		FileArgs:                 fileArgsBuilder().File("a/a/a").File("a/a/c").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		StoreSymlinks:            true,
+		ExtendedTimestamps:       true,
+		CompressionLevel:         9,
+		Filesystem:               mockFs,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(stamp, uint32(jar.DefaultTime.Unix()))
+	local := append([]byte{0x55, 0x54, 13, 0, 7}, bytes.Repeat(stamp, 3)...)
+	central := append([]byte{0x55, 0x54, 5, 0, 7}, stamp...)
+
+	if len(zr.File) != 4 {
+		t.Fatalf("want 4 entries, got %d", len(zr.File))
+	}
+	for _, f := range zr.File {
+		if !bytes.Equal(f.Extra, central) {
+			t.Errorf("%s: want central directory extra %v, got %v", f.Name, central, f.Extra)
+		}
+	}
+	if n := bytes.Count(buf.Bytes(), local); n != len(zr.File) {
+		t.Errorf("want %d local headers with all three times, got %d", len(zr.File), n)
+	}
+}
+
+func TestCentralDirectoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_cdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cdirFile := filepath.Join(dir, "cdir")
+	args := ZipArgs{
+		FileArgs:                 fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		CompressionLevel:         9,
+		CentralDirectoryFilePath: cdirFile,
+		Filesystem:               mockFs,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cdir, err := ioutil.ReadFile(cdirFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), cdir) {
+		t.Fatalf("central directory file is not the end of the zip file")
+	}
+
+	// Clobber the central directory in the zip file to make sure it isn't used.
+	data := append([]byte(nil), buf.Bytes()...)
+	for i := len(data) - len(cdir); i < len(data); i++ {
+		data[i] = 0
+	}
+
+	zr, err := NewCentralDirectoryReader(cdir, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{"a/a/a": fileA, "a/a/b": fileB, "c": fileC}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+		if !bytes.Equal(contents, want[f.Name]) {
+			t.Errorf("%s: want %q, got %q", f.Name, want[f.Name], contents)
+		}
+	}
+
+	wantNames := []string{"a/", "a/a/", "a/a/a", "a/a/b", "c"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("want entries %q, got %q", wantNames, names)
+	}
+
+	if _, err := NewCentralDirectoryReader(cdir[:len(cdir)-1], bytes.NewReader(data)); err == nil {
+		t.Errorf("want error for a truncated central directory")
+	}
+}
+
+func TestCentralDirectoryFileZip64(t *testing.T) {
+	// More than 65535 entries need the zip64 end of central directory record.
+	buf := &bytes.Buffer{}
+	cdir := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	zw.SetCentralDirectoryWriter(cdir)
+	for i := 0; i < 1<<16; i++ {
+		if _, err := zw.CreateHeaderAndroid(&zip.FileHeader{Name: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := NewCentralDirectoryReader(cdir.Bytes(), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 1<<16 {
+		t.Errorf("want %d entries, got %d", 1<<16, len(zr.File))
+	}
+}
+
+func TestPrevalidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_prevalidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	fifo := filepath.Join(dir, "fifo")
+	missing := filepath.Join(dir, "missing")
+	if err := ioutil.WriteFile(file, fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out.zip")
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().SourcePrefixToStrip(dir).
+			File(file).File(fifo).File(missing).Dir(missing + "dir").FileArgs(),
+		OutputFilePath: out,
+		Prevalidate:    true,
+		Stderr:         &bytes.Buffer{},
+	}
+
+	err = Zip(args)
+	invalid, ok := err.(InvalidSourcesError)
+	if !ok {
+		t.Fatalf("want InvalidSourcesError, got %v", err)
+	}
+	if len(invalid.Errors) != 3 {
+		t.Errorf("want 3 invalid sources, got %q", invalid.Errors)
+	}
+	for _, want := range []string{fifo + " is not a file", missing + ":", missing + "dir:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("want error containing %q, got %q", want, err)
+		}
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("want no output file, got %v", err)
+	}
+
+	args.IgnoreMissingFiles = true
+	args.FileArgs = NewFileArgsBuilder().SourcePrefixToStrip(dir).File(file).File(missing).FileArgs()
+	if err := Zip(args); err != nil {
+		t.Errorf("want missing files to be ignored, got %s", err)
+	}
+}
+
+func TestMultiReleaseJar(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"classes/META-INF/versions/11/a/A.class": fileA,
+		"classes/META-INF/versions/9/a/A.class":  fileA,
+		"classes/META-INF/versions/9/b/B.class":  fileB,
+		"classes/a/A.class":                      fileA,
+		"classes/c/C.class":                      fileC,
+	})
+
+	zipMultiReleaseArgs := func(fileArgs []FileArg) (*zip.Reader, string, error) {
+		stderr := &bytes.Buffer{}
+		args := ZipArgs{
+			FileArgs:     fileArgs,
+			EmulateJar:   true,
+			MultiRelease: true,
+			Filesystem:   fs,
+			Stderr:       stderr,
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, "", err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		return zr, stderr.String(), err
+	}
+
+	zipMultiRelease := func(files ...string) (*zip.Reader, string, error) {
+		builder := NewFileArgsBuilder().SourcePrefixToStrip("classes")
+		for _, f := range files {
+			builder.File(f)
+		}
+		return zipMultiReleaseArgs(builder.FileArgs())
+	}
+
+	zr, stderr, err := zipMultiRelease(
+		"classes/META-INF/versions/11/a/A.class",
+		"classes/META-INF/versions/9/a/A.class",
+		"classes/a/A.class",
+		"classes/c/C.class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stderr != "" {
+		t.Errorf("unexpected warnings %q", stderr)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{
+		"META-INF/",
+		"META-INF/MANIFEST.MF",
+		"a/",
+		"a/A.class",
+		"c/",
+		"c/C.class",
+		"META-INF/versions/",
+		"META-INF/versions/9/",
+		"META-INF/versions/9/a/",
+		"META-INF/versions/9/a/A.class",
+		"META-INF/versions/11/",
+		"META-INF/versions/11/a/",
+		"META-INF/versions/11/a/A.class",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	rc, err := zr.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(manifest, []byte("\nMulti-Release: true\n")) {
+		t.Errorf("want Multi-Release attribute in manifest %q", manifest)
+	}
+
+	_, stderr, err = zipMultiRelease("classes/META-INF/versions/9/b/B.class", "classes/a/A.class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, `"META-INF/versions/9/b/B.class" has no base class "b/B.class"`) {
+		t.Errorf("want warning about missing base class, got %q", stderr)
+	}
+
+	// The directory mappings of -D, including the version directories, aren't versioned entries.
+	zr, _, err = zipMultiReleaseArgs(NewFileArgsBuilder().SourcePrefixToStrip("classes").Dir("classes").FileArgs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want = []string{
+		"META-INF/",
+		"META-INF/MANIFEST.MF",
+		"META-INF/versions/",
+		"META-INF/versions/11/",
+		"META-INF/versions/9/",
+		"a/",
+		"a/A.class",
+		"c/",
+		"c/C.class",
+		"META-INF/versions/9/a/",
+		"META-INF/versions/9/a/A.class",
+		"META-INF/versions/9/b/",
+		"META-INF/versions/9/b/B.class",
+		"META-INF/versions/11/a/",
+		"META-INF/versions/11/a/A.class",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("with -D want entries %q, got %q", want, names)
+	}
+
+	// Nor is a version directory passed with -f.
+	if _, _, err := zipMultiRelease("classes/META-INF/versions/9", "classes/a/A.class"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelativeRootErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_relative_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, fileA, 0666); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	b := NewFileArgsBuilder().
+		SourcePrefixToStrip(dir).File(file).
+		SourcePrefixToStrip(missing).File(filepath.Join(missing, "a")).
+		SourcePrefixToStrip(file).File(file).
+		SourcePrefixToStrip(missing).File(filepath.Join(missing, "b")).
+		SourcePrefixToStrip("")
+
+	if b.Error() != nil {
+		t.Fatal(b.Error())
+	}
+
+	var got []string
+	for _, err := range b.RelativeRootErrors() {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		fmt.Sprintf("relative root %q does not exist", missing),
+		fmt.Sprintf("relative root %q is not a directory", file),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want errors %q, got %q", want, got)
+	}
+}
+
+func TestInlineSymlinks(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/small":                     fileA,
+		"a/large":                     bytes.Repeat(fileB, 10),
+		"a/dir/file":                  fileC,
+		"links/small -> ../a/small":   nil,
+		"links/large -> ../a/large":   nil,
+		"links/dir -> ../a/dir":       nil,
+		"links/link -> small":         nil,
+		"links/dangling -> ../a/none": nil,
+	})
+
+	args := ZipArgs{
+		FileArgs:            NewFileArgsBuilder().Dir("links").FileArgs(),
+		CompressionLevel:    0,
+		StoreSymlinks:       true,
+		InlineSymlinksUnder: int64(len(fileA) + 1),
+		Filesystem:          fs,
+		Stderr:              &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]zip.FileHeader{
+		"links/dangling": fhLink("links/dangling", "../a/none"),
+		"links/dir":      fhLink("links/dir", "../a/dir"),
+		"links/large":    fhLink("links/large", "../a/large"),
+		"links/link":     fh("links/link", fileA, zip.Store),
+		"links/small":    fh("links/small", fileA, zip.Store),
+	}
+	isSymlink := func(fh zip.FileHeader) bool {
+		return fh.ExternalAttrs>>16&syscall.S_IFMT == syscall.S_IFLNK
+	}
+	if len(zr.File) != len(want) {
+		t.Errorf("want %d entries, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		w, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry %q", f.Name)
+			continue
+		}
+		if f.CRC32 != w.CRC32 || f.UncompressedSize64 != w.UncompressedSize64 || isSymlink(f.FileHeader) != isSymlink(w) {
+			t.Errorf("%q: want symlink %v with %d bytes, got symlink %v with %d bytes",
+				f.Name, isSymlink(w), w.UncompressedSize64, isSymlink(f.FileHeader), f.UncompressedSize64)
+		}
+	}
+}
+
+func TestExecutableBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modes := []os.FileMode{0644, 0744, 0654, 0645, 0755, 0711, 0600}
+	builder := NewFileArgsBuilder().SourcePrefixToStrip(dir)
+	for _, mode := range modes {
+		file := filepath.Join(dir, fmt.Sprintf("%04o", mode))
+		if err := ioutil.WriteFile(file, fileA, 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Chmod separately, WriteFile is subject to the umask.
+		if err := os.Chmod(file, mode); err != nil {
+			t.Fatal(err)
+		}
+		builder.File(file)
+	}
+	fileArgs := builder.FileArgs()
+
+	testCases := []struct {
+		name string
+		bits os.FileMode
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"0744", "0755", "0711"},
+		},
+		{
+			name: "owner",
+			bits: 0100,
+			want: []string{"0744", "0755", "0711"},
+		},
+		{
+			name: "group",
+			bits: 0010,
+			want: []string{"0654", "0755", "0711"},
+		},
+		{
+			name: "any",
+			bits: 0111,
+			want: []string{"0744", "0654", "0645", "0755", "0711"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:         fileArgs,
+				CompressionLevel: 9,
+				ExecutableBits:   test.bits,
+				Stderr:           &bytes.Buffer{},
+			}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, f := range zr.File {
+				if f.Mode()&0100 != 0 {
+					got = append(got, f.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want executables %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDirectoryModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_dir_mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a/b is passed as a source, a is only its parent, and c is the parent of a file.
+	for _, d := range []string{"a/b", "c"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "c/f"), fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for d, mode := range map[string]os.FileMode{"a": 0751, "a/b": 0715, "c": 0705} {
+		if err := os.Chmod(filepath.Join(dir, d), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fileArgs := NewFileArgsBuilder().SourcePrefixToStrip(dir).
+		File(filepath.Join(dir, "a/b")).
+		File(filepath.Join(dir, "c/f")).
+		FileArgs()
+
+	testCases := []struct {
+		name     string
+		mode     os.FileMode
+		preserve bool
+		want     map[string]os.FileMode
+	}{
+		{
+			name: "default",
+			want: map[string]os.FileMode{"a/": 0700, "a/b/": 0700, "c/": 0700},
+		},
+		{
+			name: "dir mode",
+			mode: 0755,
+			want: map[string]os.FileMode{"a/": 0755, "a/b/": 0755, "c/": 0755},
+		},
+		{
+			name:     "preserve",
+			preserve: true,
+			want:     map[string]os.FileMode{"a/": 0700, "a/b/": 0715, "c/": 0700},
+		},
+		{
+			name:     "preserve with dir mode",
+			mode:     0750,
+			preserve: true,
+			want:     map[string]os.FileMode{"a/": 0750, "a/b/": 0715, "c/": 0750},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:                 fileArgs,
+				AddDirectoryEntriesToZip: true,
+				DirectoryMode:            test.mode,
+				PreserveDirectoryModes:   test.preserve,
+				Stderr:                   &bytes.Buffer{},
+			}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]os.FileMode{}
+			for _, f := range zr.File {
+				if f.Mode().IsDir() {
+					got[f.Name] = f.Mode().Perm()
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("want directory modes %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+// TestStoredLocalHeaders checks that the local headers of a store-only zip file have the sizes
+// and crcs of their entries, so that the zip file can be read without the central directory.
+func TestStoredLocalHeaders(t *testing.T) {
+	large := bytes.Repeat([]byte("stored "), minParallelFileSize/7+1)
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/empty": nil,
+		"a/small": fileA,
+		"b/large": large,
+	})
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			File("a/empty").
+			File("a/small").
+			File("b/large").
+			FileArgs(),
+		CompressionLevel:         0,
+		AddDirectoryEntriesToZip: true,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the local headers the way a streaming reader would.
+	data := buf.Bytes()
+	for i, f := range zr.File {
+		if len(data) < 30 || binary.LittleEndian.Uint32(data) != 0x04034b50 {
+			t.Fatalf("missing local header for %q", f.Name)
+		}
+		flags := binary.LittleEndian.Uint16(data[6:])
+		method := binary.LittleEndian.Uint16(data[8:])
+		crc := binary.LittleEndian.Uint32(data[14:])
+		compressedSize := binary.LittleEndian.Uint32(data[18:])
+		uncompressedSize := binary.LittleEndian.Uint32(data[22:])
+		nameLen := int(binary.LittleEndian.Uint16(data[26:]))
+		extraLen := int(binary.LittleEndian.Uint16(data[28:]))
+		name := string(data[30 : 30+nameLen])
+		data = data[30+nameLen+extraLen:]
+
+		if name != f.Name {
+			t.Fatalf("local header %d: want name %q, got %q", i, f.Name, name)
+		}
+		if flags&zip.DataDescriptorFlag != 0 {
+			t.Errorf("%q: unexpected data descriptor", name)
+		}
+		if method != zip.Store {
+			t.Errorf("%q: want method %d, got %d", name, zip.Store, method)
+		}
+		if crc != f.CRC32 {
+			t.Errorf("%q: local crc32 %08x doesn't match central directory %08x", name, crc, f.CRC32)
+		}
+		if uint64(compressedSize) != f.CompressedSize64 || uint64(uncompressedSize) != f.UncompressedSize64 {
+			t.Errorf("%q: local sizes %d/%d don't match central directory %d/%d", name,
+				compressedSize, uncompressedSize, f.CompressedSize64, f.UncompressedSize64)
+		}
+		if compressedSize != uncompressedSize {
+			t.Errorf("%q: stored entry has compressed size %d and uncompressed size %d", name,
+				compressedSize, uncompressedSize)
+		}
+		if int(compressedSize) > len(data) {
+			t.Fatalf("%q: size %d runs past the end of the zip file", name, compressedSize)
+		}
+		if got := crc32.ChecksumIEEE(data[:compressedSize]); got != crc {
+			t.Errorf("%q: contents have crc32 %08x, local header has %08x", name, got, crc)
+		}
+		data = data[compressedSize:]
+	}
+
+	if len(data) < 4 || binary.LittleEndian.Uint32(data) != 0x02014b50 {
+		t.Errorf("expected the central directory after the last entry")
+	}
+}
+
+func TestSharedDictionaryAuto(t *testing.T) {
+	files := make(map[string][]byte)
+	builder := NewFileArgsBuilder()
+	for _, locale := range []string{"de", "en", "es", "fr", "it", "ja", "ko", "pt", "ru", "zh"} {
+		for i := 0; i < 10; i++ {
+			name := fmt.Sprintf("res/values-%s/strings%d.xml", locale, i)
+			files[name] = []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<resources xmlns:android="http://schemas.android.com/apk/res/android">
+    <string name="app_name_%d">%s %d</string>
+    <string name="settings_title_%d" translatable="true">%s settings</string>
+</resources>
+`, i, locale, i, i, locale))
+			builder.File(name)
+		}
+	}
+
+	zipWith := func(sharedDict bool) (*zip.Reader, []byte) {
+		t.Helper()
+		args := ZipArgs{
+			FileArgs:             builder.FileArgs(),
+			CompressionLevel:     9,
+			SharedDictionaryAuto: sharedDict,
+			Filesystem:           pathtools.MockFs(files),
+			Stderr:               &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr, buf.Bytes()
+	}
+
+	// compressedSize doesn't count the dictionary, which is only worth its size for a larger
+	// number of files.
+	compressedSize := func(zr *zip.Reader) uint64 {
+		size := uint64(0)
+		for _, f := range zr.File {
+			if f.Name != SharedDictionaryName {
+				size += f.CompressedSize64
+			}
+		}
+		return size
+	}
+
+	plain, _ := zipWith(false)
+	shared, data := zipWith(true)
+
+	if got := shared.File[0].Name; got != SharedDictionaryName {
+		t.Fatalf("want first entry %q, got %q", SharedDictionaryName, got)
+	}
+	rc, err := shared.File[0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dict) == 0 || len(dict) > windowSize {
+		t.Fatalf("want a dictionary of 1 to %d bytes, got %d", windowSize, len(dict))
+	}
+	extra := sharedDictionaryExtra(dict)
+
+	if got, want := len(shared.File), len(files)+1; got != want {
+		t.Fatalf("want %d entries, got %d", want, got)
+	}
+	for _, f := range shared.File[1:] {
+		if !bytes.Equal(f.Extra, extra) {
+			t.Errorf("%q: want extra %v, got %v", f.Name, extra, f.Extra)
+			continue
+		}
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := bytes.NewReader(data[offset : offset+int64(f.CompressedSize64)])
+		got, err := ioutil.ReadAll(flate.NewReaderDict(raw, dict))
+		if err != nil {
+			t.Errorf("%q: %v", f.Name, err)
+			continue
+		}
+		if !bytes.Equal(got, files[f.Name]) {
+			t.Errorf("%q: want contents %q, got %q", f.Name, files[f.Name], got)
+		}
+		if crc := crc32.ChecksumIEEE(got); crc != f.CRC32 {
+			t.Errorf("%q: want crc32 %08x, got %08x", f.Name, f.CRC32, crc)
+		}
+	}
+
+	if plainSize, sharedSize := compressedSize(plain), compressedSize(shared); sharedSize >= plainSize {
+		t.Errorf("want shared dictionary zip smaller than %d bytes, got %d", plainSize, sharedSize)
+	}
+}
+
+func TestTrainSharedDictionary(t *testing.T) {
+	common := []byte("<string name=\"common\">shared between all of the samples</string>")
+
+	if dict := trainSharedDictionary([][]byte{[]byte("abcdefghijklmnop"), []byte("qrstuvwxyz012345")}, windowSize); dict != nil {
+		t.Errorf("want no dictionary for samples with nothing in common, got %q", dict)
+	}
+
+	var samples [][]byte
+	for i := 0; i < 4; i++ {
+		samples = append(samples, append([]byte(fmt.Sprintf("unique prefix %d ", i)), common...))
+	}
+	dict := trainSharedDictionary(samples, windowSize)
+	deflatedSize := func(dict []byte) int {
+		buf := &bytes.Buffer{}
+		fw, err := flate.NewWriterDict(buf, 9, dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(append([]byte("another sample "), common...))
+		fw.Close()
+		return buf.Len()
+	}
+	if with, without := deflatedSize(dict), deflatedSize(nil); with >= without {
+		t.Errorf("want dictionary %q to compress the common contents, got %d bytes with it and %d without", dict, with, without)
+	}
+	if len(dict) > len(common)+sharedDictSegmentSize {
+		t.Errorf("want the common contents in the dictionary once, got %q", dict)
+	}
+
+	if dict := trainSharedDictionary(samples, 16); len(dict) != 16 {
+		t.Errorf("want a 16 byte dictionary, got %q", dict)
+	}
+}
+
+func TestMethodDecisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_methods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"compressible": bytes.Repeat([]byte("compressible "), 100),
+		"tiny":         []byte("x"),
+		"stored":       bytes.Repeat([]byte("stored "), 100),
+		"large":        bytes.Repeat([]byte("large "), minParallelFileSize/6+1),
+	})
+	decisions := filepath.Join(dir, "methods.txt")
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			File("compressible").
+			File("tiny").
+			File("stored").
+			File("large").
+			FileArgs(),
+		CompressionLevel:         9,
+		NonDeflatedFiles:         map[string]bool{"stored": true},
+		AddDirectoryEntriesToZip: true,
+		MethodDecisionsFilePath:  decisions,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+	if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(decisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "compressible\tdeflate\tdeflate\tdeflated\n" +
+		"tiny\tdeflate\tstore\tdeflate not smaller\n" +
+		"stored\tstore\tstore\tstore requested\n" +
+		"large\tdeflate\tdeflate\tdeflated in parallel blocks\n"
+	if string(got) != want {
+		t.Errorf("want method decisions:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestMaxCompressionRatio(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"zeros": make([]byte, 1<<20),
+		"text":  []byte("ordinary text that only compresses a little"),
+	})
+	fileArgs := NewFileArgsBuilder().File("text").File("zeros").FileArgs()
+
+	testCases := []struct {
+		name     string
+		maxRatio float64
+		fail     bool
+		warning  bool
+		err      bool
+	}{
+		{name: "unchecked"},
+		{name: "under", maxRatio: 2000},
+		{name: "warn", maxRatio: 200, warning: true},
+		{name: "fail", maxRatio: 200, fail: true, err: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			args := ZipArgs{
+				FileArgs:            fileArgs,
+				CompressionLevel:    9,
+				MaxCompressionRatio: test.maxRatio,
+				FailOnMaxRatio:      test.fail,
+				Filesystem:          fs,
+				Stderr:              stderr,
+			}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err {
+				if err == nil || !strings.Contains(err.Error(), `"zeros" has compression ratio`) {
+					t.Errorf("want compression ratio error for zeros, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			warned := strings.Contains(stderr.String(), `warning: "zeros" has compression ratio`)
+			if warned != test.warning {
+				t.Errorf("want warning %v, got stderr %q", test.warning, stderr.String())
+			}
+			if strings.Contains(stderr.String(), `"text"`) {
+				t.Errorf("unexpected warning for text: %q", stderr.String())
+			}
+		})
+	}
+}
+
+func TestRequiredSavings(t *testing.T) {
+	random := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(random)
+	fs := pathtools.MockFs(map[string][]byte{
+		"text":   bytes.Repeat([]byte("compressible text "), 1000),
+		"random": random,
+	})
+
+	testCases := []struct {
+		name     string
+		files    []string
+		stored   bool
+		required float64
+		err      string
+	}{
+		{name: "compressible", files: []string{"text"}, required: 90},
+		{name: "no requirement", files: []string{"random"}},
+		{name: "incompressible", files: []string{"random"}, required: 10, err: "less than the required 10%"},
+		{name: "stored", files: []string{"text"}, stored: true, required: 1, err: "less than the required 1%"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewFileArgsBuilder()
+			for _, f := range test.files {
+				b.File(f)
+			}
+			args := ZipArgs{
+				FileArgs:         b.FileArgs(),
+				CompressionLevel: 9,
+				RequiredSavings:  test.required,
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			}
+			if test.stored {
+				args.CompressionLevel = 0
+			}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err == "" && err != nil {
+				t.Errorf("want no error, got %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("want error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestDrainPipes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := bytes.Repeat([]byte("drained "), 10000)
+
+	testCases := []struct {
+		name string
+		// writer writes to the pipe, or is nil to never open it.
+		writer func(w *os.File)
+		err    bool
+	}{
+		{
+			name:   "drained",
+			writer: func(w *os.File) { w.Write(contents) },
+		},
+		{
+			name: "never opened",
+			err:  true,
+		},
+		{
+			name: "never closed",
+			writer: func(w *os.File) {
+				w.Write(contents[:100])
+				time.Sleep(time.Second)
+			},
+			err: true,
+		},
+	}
+
+	for i, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			fifo := filepath.Join(dir, fmt.Sprintf("fifo%d", i))
+			if err := syscall.Mkfifo(fifo, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.writer != nil {
+				go func() {
+					w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+					if err != nil {
+						return
+					}
+					defer w.Close()
+					test.writer(w)
+				}()
+			}
+
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().SourcePrefixToStrip(dir).File(fifo).FileArgs(),
+				CompressionLevel: 9,
+				DrainPipes:       true,
+				DrainTimeout:     200 * time.Millisecond,
+				Stderr:           &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err {
+				if err == nil || !strings.Contains(err.Error(), "timed out") {
+					t.Errorf("want timeout error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zr.File) != 1 || zr.File[0].Name != filepath.Base(fifo) {
+				t.Fatalf("want one entry %q, got %v", filepath.Base(fifo), zr.File)
+			}
+			rc, err := zr.File[0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, contents) {
+				t.Errorf("want %d bytes of drained contents, got %d", len(contents), len(got))
+			}
+		})
+	}
+}
+
+// TestWindowsPaths simulates a Windows host, whose paths use backslashes, and checks that they
+// don't leak into the entry names, extra fields or synthesized files.
+func TestWindowsPaths(t *testing.T) {
+	defer func(sep rune) { hostSeparator = sep }(hostSeparator)
+	hostSeparator = '\\'
+
+	dir, err := ioutil.TempDir("", "soong_zip_windows")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := pathtools.MockFs(map[string][]byte{
+		`src\a\file`:              fileA,
+		`src\a\link -> ..\b\file`: nil,
+		`provenance.json`:         fileProvenance,
+	})
+
+	metadata := filepath.Join(dir, "metadata.json")
+	methods := filepath.Join(dir, "methods.txt")
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			PathPrefixInZip(`out\dir`).
+			File(`src\a\file`).
+			File(`src\a\link`).
+			FileArgs(),
+		CompressionLevel:         9,
+		AddDirectoryEntriesToZip: true,
+		StoreSymlinks:            true,
+		ExtendedTimestamps:       true,
+		PipeArgs:                 []PipeArg{{Dest: `pipe\f`, Size: int64(len(fileB))}},
+		Stdin:                    bytes.NewReader(fileB),
+		ProvenanceSourcePath:     "provenance.json",
+		ProvenancePath:           `META-INF\provenance.json`,
+		MetadataFilePath:         metadata,
+		MethodDecisionsFilePath:  methods,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if bytes.Contains(f.Extra, []byte(`\`)) {
+			t.Errorf("%q: extra field %q contains a backslash", f.Name, f.Extra)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			target, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(target) != "../b/file" {
+				t.Errorf("%q: want symlink target %q, got %q", f.Name, "../b/file", target)
+			}
+		}
+	}
+	want := []string{
+		"out/", "out/dir/", "out/dir/src/", "out/dir/src/a/", "out/dir/src/a/file", "out/dir/src/a/link",
+		"pipe/", "pipe/f",
+		"META-INF/", "META-INF/provenance.json",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	for _, file := range []string{metadata, methods} {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(contents, []byte(`\`)) {
+			t.Errorf("%s contains a backslash:\n%s", filepath.Base(file), contents)
+		}
+	}
+}
+
+func TestAdaptiveLevel(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 4*adaptiveSampleSize)
+	r.Read(random)
+
+	words := []string{"alpha", "beta", "gamma", "delta", "settings", "network", "account", "the", "of", "and"}
+	text := &bytes.Buffer{}
+	for text.Len() < 4*adaptiveSampleSize {
+		fmt.Fprintf(text, "%s %d ", words[r.Intn(len(words))], r.Intn(100))
+	}
+
+	testCases := []struct {
+		name     string
+		contents []byte
+		level    int
+	}{
+		{name: "small", contents: fileA, level: 5},
+		{name: "random", contents: random, level: 1},
+		{name: "zeros", contents: make([]byte, 4*adaptiveSampleSize), level: 1},
+		{name: "text", contents: text.Bytes(), level: 6},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			z := &ZipWriter{compLevel: 5}
+			r := bytes.NewReader(test.contents)
+			level, err := z.sampleLevel(r, int64(len(test.contents)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if level != test.level {
+				t.Errorf("want level %d, got %d", test.level, level)
+			}
+			if pos, _ := r.Seek(0, io.SeekCurrent); pos != 0 {
+				t.Errorf("want reader at the start of the file, got %d", pos)
+			}
+		})
+	}
+
+	// The text is compressed whole at the sampled level.
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().File("text").FileArgs(),
+		CompressionLevel: 5,
+		AdaptiveLevel:    true,
+		Filesystem:       pathtools.MockFs(map[string][]byte{"text": text.Bytes()}),
+		Stderr:           &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &bytes.Buffer{}
+	fw, err := flate.NewWriter(expected, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(text.Bytes())
+	fw.Close()
+	if got := zr.File[0].CompressedSize64; got != uint64(expected.Len()) {
+		t.Errorf("want compressed size %d from level 6, got %d", expected.Len(), got)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	large := make([]byte, minParallelFileSize+parallelBlockSize/2)
+	rand.New(rand.NewSource(1)).Read(large[:len(large)/2])
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"dir/a":            fileA,
+		"dir/empty":        fileEmpty,
+		"dir/link -> a":    nil,
+		"dir/stored":       fileB,
+		"dir/large":        large,
+		"dir/sharedA.txt":  bytes.Repeat([]byte("shared dictionary contents "), 10),
+		"dir2/sharedB.txt": bytes.Repeat([]byte("shared dictionary contents "), 20),
+	})
+
+	for _, sharedDict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("shared dictionary %v", sharedDict), func(t *testing.T) {
+			zipWithSelfCheck := func(selfCheck bool) []byte {
+				args := ZipArgs{
+					FileArgs:                 NewFileArgsBuilder().Dir("dir").Dir("dir2").FileArgs(),
+					CompressionLevel:         5,
+					NonDeflatedFiles:         map[string]bool{"dir/stored": true},
+					AddDirectoryEntriesToZip: true,
+					StoreSymlinks:            true,
+					SharedDictionaryAuto:     sharedDict,
+					SelfCheck:                selfCheck,
+					Filesystem:               fs,
+					Stderr:                   &bytes.Buffer{},
+				}
+				buf := &bytes.Buffer{}
+				if err := ZipTo(args, buf); err != nil {
+					t.Fatal(err)
+				}
+				return buf.Bytes()
+			}
+
+			if !bytes.Equal(zipWithSelfCheck(true), zipWithSelfCheck(false)) {
+				t.Error("the self-check changed the zip file")
+			}
+		})
+	}
+
+	// Check the checker against data that doesn't match the header or the blocks.
+	data := make([]byte, 2*parallelBlockSize+100)
+	rand.New(rand.NewSource(2)).Read(data)
+	compressed := &bytes.Buffer{}
+	fw, _ := flate.NewWriter(compressed, 1)
+	fw.Write(data)
+	fw.Close()
+
+	var blockCRCs []uint32
+	for start := 0; start < len(data); start += parallelBlockSize {
+		end := start + parallelBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		blockCRCs = append(blockCRCs, crc32.ChecksumIEEE(data[start:end]))
+	}
+
+	check := func(fh zip.FileHeader, blockCRCs []uint32) error {
+		fh.CompressedSize64 = uint64(compressed.Len())
+		c := newEntryChecker(&zipEntry{fh: &fh, blockCRCs: blockCRCs})
+		third := compressed.Len() / 3
+		for i := 0; i < 3; i++ {
+			c.startBlock()
+			end := (i + 1) * third
+			if i == 2 {
+				end = compressed.Len()
+			}
+			c.Write(compressed.Bytes()[i*third : end])
+		}
+		return c.finish()
+	}
+
+	good := fh("data", data, zip.Deflate)
+	if err := check(good, blockCRCs); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+
+	badCRC := good
+	badCRC.CRC32++
+	if err := check(badCRC, nil); err == nil || !strings.Contains(err.Error(), "header has") {
+		t.Errorf("want a CRC32 error, got %v", err)
+	}
+
+	badBlock := append([]uint32(nil), blockCRCs...)
+	badBlock[1]++
+	if err := check(good, badBlock); err == nil || !strings.Contains(err.Error(), "block 2 of 3") {
+		t.Errorf("want an error in block 2, got %v", err)
+	}
+
+	bigger := good
+	bigger.UncompressedSize64++
+	if err := check(bigger, nil); err == nil || !strings.Contains(err.Error(), "uncompressed bytes") {
+		t.Errorf("want a size error, got %v", err)
+	}
+}
+
+func TestCompressDeadline(t *testing.T) {
+	small := bytes.Repeat([]byte("deadline "), 1000)
+	large := bytes.Repeat([]byte("deadline "), (minParallelFileSize+parallelBlockSize/2)/9)
+	fs := pathtools.MockFs(map[string][]byte{"small": small, "large": large})
+
+	testCases := []struct {
+		name     string
+		deadline time.Duration
+		deflated bool
+	}{
+		{
+			name:     "none",
+			deflated: true,
+		},
+		{
+			name:     "long",
+			deadline: time.Hour,
+			deflated: true,
+		},
+		{
+			name:     "expired",
+			deadline: time.Nanosecond,
+			deflated: false,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().File("small").File("large").FileArgs(),
+				CompressionLevel: 9,
+				NumParallelJobs:  4,
+				CompressDeadline: test.deadline,
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			}
+
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string][]byte{"small": small, "large": large}
+			for _, f := range zr.File {
+				deflated := f.CompressedSize64 < f.UncompressedSize64
+				if deflated != test.deflated {
+					t.Errorf("%s: want deflated %v, got method %d with size %d of %d",
+						f.Name, test.deflated, f.Method, f.CompressedSize64, f.UncompressedSize64)
+				}
+
+				// The header of a large file is written before its blocks are
+				// compressed, so it stays deflated with stored blocks.
+				wantMethod := zip.Deflate
+				if f.Name == "small" && !test.deflated {
+					wantMethod = zip.Store
+				}
+				if f.Method != wantMethod {
+					t.Errorf("%s: want method %d, got %d", f.Name, wantMethod, f.Method)
+				}
+
+				r, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				contents, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil {
+					t.Fatalf("%s: %s", f.Name, err)
+				}
+				if !bytes.Equal(contents, want[f.Name]) {
+					t.Errorf("%s: contents don't match the input", f.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestSynthesizedEntriesStored(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"META-INF/MANIFEST.MF": []byte(strings.Repeat("X-Padding: compressible\n", 20)),
+		"d/e/f":                bytes.Repeat([]byte("compressible "), 100),
+	})
+
+	for _, emulateJar := range []bool{false, true} {
+		t.Run(fmt.Sprintf("jar=%v", emulateJar), func(t *testing.T) {
+			args := ZipArgs{
+				// The manifest is requested deflated like every other file.
+				FileArgs:                 NewFileArgsBuilder().Dir(".").FileArgs(),
+				EmulateJar:               emulateJar,
+				AddDirectoryEntriesToZip: true,
+				CompressionLevel:         9,
+				Filesystem:               fs,
+				Stderr:                   &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dirs := 0
+			for _, f := range zr.File {
+				switch {
+				case strings.HasSuffix(f.Name, "/"):
+					dirs++
+					if f.Method != zip.Store || f.CompressedSize64 != 0 || f.UncompressedSize64 != 0 || f.CRC32 != 0 {
+						t.Errorf("want directory %q stored with no contents, got method %d, sizes %d/%d, CRC32 %08x",
+							f.Name, f.Method, f.CompressedSize64, f.UncompressedSize64, f.CRC32)
+					}
+				case f.Name == jar.ManifestFile && emulateJar:
+					if f.Method != zip.Store {
+						t.Errorf("want manifest stored, got method %d", f.Method)
+					}
+				default:
+					if f.Method != zip.Deflate {
+						t.Errorf("want %q deflated, got method %d", f.Name, f.Method)
+					}
+				}
+			}
+			if dirs != 3 {
+				t.Errorf("want 3 directories, got %d", dirs)
+			}
+		})
+	}
+}
+
+func TestTarFormat(t *testing.T) {
+	type tarEntry struct {
+		name     string
+		typeflag byte
+		mode     int64
+		linkname string
+		contents []byte
+	}
+
+	testCases := []struct {
+		name   string
+		format Format
+		args   *FileArgsBuilder
+		jar    bool
+
+		symlinkMode os.FileMode
+
+		out []tarEntry
+		err string
+	}{
+		{
+			name:   "tar",
+			format: TarFormat,
+			args:   NewFileArgsBuilder().SourcePrefixToStrip("a").Dir("a").SourcePrefixToStrip("").File("c"),
+			out: []tarEntry{
+				{"a/", tar.TypeDir, 0700, "", nil},
+				{"a/a", tar.TypeReg, 0644, "", fileA},
+				{"a/b", tar.TypeReg, 0644, "", fileB},
+				{"a/c", tar.TypeSymlink, 0777, "../../c", nil},
+				{"a/d", tar.TypeSymlink, 0777, "b", nil},
+				{"c", tar.TypeReg, 0644, "", fileC},
+			},
+		},
+		{
+			name:        "symlink mode",
+			format:      TarFormat,
+			args:        NewFileArgsBuilder().SourcePrefixToStrip("a").File("a/a/c").File("a/a/d"),
+			symlinkMode: 0755,
+			out: []tarEntry{
+				{"a/", tar.TypeDir, 0700, "", nil},
+				{"a/c", tar.TypeSymlink, 0755, "../../c", nil},
+				{"a/d", tar.TypeSymlink, 0755, "b", nil},
+			},
+		},
+		{
+			name:   "tar.gz",
+			format: TarGzFormat,
+			args:   NewFileArgsBuilder().File("a/a/a").File("empty"),
+			out: []tarEntry{
+				{"a/", tar.TypeDir, 0700, "", nil},
+				{"a/a/", tar.TypeDir, 0700, "", nil},
+				{"a/a/a", tar.TypeReg, 0644, "", fileA},
+				{"empty", tar.TypeReg, 0644, "", fileEmpty},
+			},
+		},
+		{
+			name:   "jar",
+			format: TarFormat,
+			args:   NewFileArgsBuilder().File("c"),
+			jar:    true,
+			err:    "can't write a tar archive with --jar",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:                 test.args.FileArgs(),
+				Format:                   test.format,
+				EmulateJar:               test.jar,
+				SymlinkMode:              test.symlinkMode,
+				AddDirectoryEntriesToZip: true,
+				StoreSymlinks:            true,
+				CompressionLevel:         9,
+				Filesystem:               mockFs,
+				Stderr:                   &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error containing %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			again := &bytes.Buffer{}
+			if err := ZipTo(args, again); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+				t.Error("archive is not reproducible")
+			}
+
+			var r io.Reader = buf
+			if test.format == TarGzFormat {
+				gz, err := gzip.NewReader(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = gz
+			}
+			tr := tar.NewReader(r)
+			var got []tarEntry
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				contents, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(contents) == 0 {
+					contents = nil
+				}
+				if !hdr.ModTime.Equal(jar.DefaultTime) {
+					t.Errorf("%s: want modification time %v, got %v", hdr.Name, jar.DefaultTime, hdr.ModTime)
+				}
+				got = append(got, tarEntry{hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Linkname, contents})
+			}
+
+			for i := range test.out {
+				if len(test.out[i].contents) == 0 {
+					test.out[i].contents = nil
+				}
+			}
+			if !reflect.DeepEqual(got, test.out) {
+				t.Errorf("want entries:\n%v\ngot:\n%v", test.out, got)
+			}
+		})
+	}
+}
+
+func TestZipWriterTarOptions(t *testing.T) {
+	testCases := []struct {
+		name string
+		args ZipArgs
+		err  string
+	}{
+		{
+			name: "central directory",
+			args: ZipArgs{CentralDirectoryFilePath: "cd"},
+			err:  "a tar archive has no central directory",
+		},
+		{
+			name: "index",
+			args: ZipArgs{EmitIndex: true},
+			err:  "can't write an index of a tar archive",
+		},
+		{
+			name: "zip64",
+			args: ZipArgs{ForceZip64: true},
+			err:  "a tar archive has no zip64 records",
+		},
+		{
+			name: "checkpoint",
+			args: ZipArgs{Checkpoint: 1},
+			err:  "can't checkpoint a tar archive",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := test.args
+			args.Format = TarFormat
+			args.Filesystem = mockFs
+			args.Stderr = &bytes.Buffer{}
+			buf := &bytes.Buffer{}
+			z := NewZipWriter(buf, args)
+
+			err := z.Add("a", "a/a/a", zip.Store)
+			if err == nil || err.Error() != test.err {
+				t.Errorf("want error %q from Add, got %v", test.err, err)
+			}
+			if err2 := z.Close(); err2 != err {
+				t.Errorf("want error %v from Close, got %v", err, err2)
+			}
+			if buf.Len() > 0 {
+				t.Errorf("want nothing written, got %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestBuildID(t *testing.T) {
+	testCases := []struct {
+		name    string
+		buildID string
+		jar     bool
+
+		want []byte
+		err  string
+	}{
+		{
+			name:    "sha1",
+			buildID: "0123456789abcdef0123456789ABCDEF01234567",
+			want:    []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67},
+		},
+		{
+			name:    "jar",
+			buildID: "beef",
+			jar:     true,
+			want:    []byte{0xbe, 0xef},
+		},
+		{
+			name:    "odd length",
+			buildID: "abc",
+			err:     "not an even number of hex digits",
+		},
+		{
+			name:    "not hex",
+			buildID: "build-42",
+			err:     "not an even number of hex digits",
+		},
+		{
+			name:    "too long",
+			buildID: strings.Repeat("00", 65),
+			err:     "longer than 64 bytes",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().File("a/a/a").FileArgs(),
+				BuildID:          test.buildID,
+				EmulateJar:       test.jar,
+				CompressionLevel: 9,
+				Filesystem:       mockFs,
+				Stderr:           &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("want error containing %q, got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadBuildID(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("want build ID %x, got %x", test.want, got)
+			}
+
+			// The contents are a fallback for readers that lost the extra field.
+			for _, f := range zr.File {
+				if f.Name == BuildIDName {
+					f.Extra = nil
+				}
+			}
+			got, err = ReadBuildID(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("want build ID %x from contents, got %x", test.want, got)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().File("a/a/a").FileArgs(),
+			CompressionLevel: 9,
+			Filesystem:       mockFs,
+			Stderr:           &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ReadBuildID(zr); err != nil || got != nil {
+			t.Errorf("want no build ID, got %x, %v", got, err)
+		}
+	})
+}
+
+func TestURLArgs(t *testing.T) {
+	defer func(d time.Duration) { urlRetryDelay = d }(urlRetryDelay)
+	urlRetryDelay = time.Millisecond
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/a":
+			w.Write(fileA)
+		case "/flaky":
+			if n < 3 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(fileB)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	insecureServer := httptest.NewServer(handler)
+	defer insecureServer.Close()
+
+	sumA := sha256.Sum256(fileA)
+
+	testCases := []struct {
+		name     string
+		urls     []URLArg
+		insecure bool
+
+		files    map[string][]byte
+		err      string
+		requests map[string]int
+	}{
+		{
+			name: "download",
+			urls: []URLArg{
+				{Dest: "prebuilts/a", URL: server.URL + "/a", SHA256: hex.EncodeToString(sumA[:])},
+			},
+			files: map[string][]byte{"prebuilts/a": fileA},
+		},
+		{
+			name:     "retry",
+			urls:     []URLArg{{Dest: "b", URL: server.URL + "/flaky"}},
+			files:    map[string][]byte{"b": fileB},
+			requests: map[string]int{"/flaky": 3},
+		},
+		{
+			name:     "not found",
+			urls:     []URLArg{{Dest: "missing", URL: server.URL + "/missing"}},
+			err:      "404 Not Found",
+			requests: map[string]int{"/missing": 1},
+		},
+		{
+			name: "wrong sha256",
+			urls: []URLArg{{Dest: "a", URL: server.URL + "/a", SHA256: strings.Repeat("0", 64)}},
+			err:  "have sha256 " + hex.EncodeToString(sumA[:]),
+		},
+		{
+			name: "http",
+			urls: []URLArg{{Dest: "a", URL: insecureServer.URL + "/a"}},
+			err:  "is not https",
+		},
+		{
+			name:     "allowed http",
+			urls:     []URLArg{{Dest: "a", URL: insecureServer.URL + "/a"}},
+			insecure: true,
+			files:    map[string][]byte{"a": fileA},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			lock.Lock()
+			requests = make(map[string]int)
+			lock.Unlock()
+
+			args := ZipArgs{
+				URLArgs:           test.urls,
+				URLRetries:        3,
+				AllowInsecureURLs: test.insecure,
+				HTTPClient:        server.Client(),
+				CompressionLevel:  9,
+				Filesystem:        mockFs,
+				Stderr:            &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("want error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make(map[string][]byte)
+				for _, f := range zr.File {
+					r, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					got[f.Name], _ = ioutil.ReadAll(r)
+					r.Close()
+				}
+				if !reflect.DeepEqual(got, test.files) {
+					t.Errorf("want files %q, got %q", test.files, got)
+				}
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			for path, want := range test.requests {
+				if requests[path] != want {
+					t.Errorf("want %d requests for %s, got %d", want, path, requests[path])
+				}
+			}
+		})
+	}
+}
+
+func TestExcludedCRCs(t *testing.T) {
+	large := bytes.Repeat([]byte("excluded "), (minParallelFileSize+parallelBlockSize/2)/9)
+	fs := pathtools.MockFs(map[string][]byte{"a": fileA, "b": fileB, "large": large})
+
+	testCases := []struct {
+		name     string
+		excluded []byte
+		stored   bool
+	}{
+		{name: "deflated", excluded: fileB},
+		{name: "stored", excluded: fileB, stored: true},
+		{name: "parallel", excluded: large},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			compressionLevel := 9
+			if test.stored {
+				compressionLevel = 0
+			}
+
+			crc := crc32.ChecksumIEEE(test.excluded)
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().File("a").File("b").File("large").FileArgs(),
+				CompressionLevel: compressionLevel,
+				NumParallelJobs:  4,
+				ExcludedCRCs:     map[uint32]bool{0x12345678: true, crc: true},
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			}
+
+			err := ZipTo(args, &bytes.Buffer{})
+			if err == nil {
+				t.Fatal("want error for excluded CRC")
+			}
+			if want := fmt.Sprintf("has excluded CRC32 %08x", crc); !strings.Contains(err.Error(), want) {
+				t.Errorf("want error containing %q, got %q", want, err)
+			}
+
+			// Compression of other files may still be finishing in the background, so
+			// don't modify the map it reads.
+			args.ExcludedCRCs = map[uint32]bool{0x12345678: true}
+			if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+				t.Errorf("want no error without the excluded CRC, got %s", err)
+			}
+		})
+	}
+}
+
+func TestReadCRCList(t *testing.T) {
+	crcs, err := ReadCRCList(strings.NewReader("# known bad files\n1234abcd\n\n  0xDEADBEEF  \n0X1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32]bool{0x1234abcd: true, 0xdeadbeef: true, 1: true}
+	if !reflect.DeepEqual(crcs, want) {
+		t.Errorf("want %v, got %v", want, crcs)
+	}
+
+	for _, bad := range []string{"xyz\n", "123456789\n", "0x\n"} {
+		if _, err := ReadCRCList(strings.NewReader(bad)); err == nil {
+			t.Errorf("want error for %q", bad)
+		}
+	}
+}
+
+func TestLowercaseNames(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"Res/Values/Strings.XML": fileA,
+		"Res/Icon.PNG":           fileB,
+		"other/icon.png":         fileC,
+	})
+
+	zipLowercase := func(b *FileArgsBuilder) ([]string, error) {
+		args := ZipArgs{
+			FileArgs:                 b.FileArgs(),
+			CompressionLevel:         9,
+			NonDeflatedFiles:         map[string]bool{"res/icon.png": true},
+			LowercaseNames:           true,
+			AddDirectoryEntriesToZip: true,
+			Filesystem:               fs,
+			Stderr:                   &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, fmt.Sprintf("%s %d", f.Name, f.Method))
+		}
+		return names, nil
+	}
+
+	names, err := zipLowercase(NewFileArgsBuilder().Dir("Res"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"res/ 0", "res/icon.png 0", "res/values/ 0", "res/values/strings.xml 8"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	// Files that only differ by case collide.
+	_, err = zipLowercase(NewFileArgsBuilder().
+		File("Res/Icon.PNG").
+		SourcePrefixToStrip("other").
+		PathPrefixInZip("res").
+		File("other/icon.png"))
+	want2 := `destination "res/icon.png" has two files "Res/Icon.PNG" and "other/icon.png"`
+	if err == nil || err.Error() != want2 {
+		t.Errorf("want error %q, got %v", want2, err)
+	}
+}
+
+func TestCanonicalizeCase(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"Res/Icon.PNG":   fileA,
+		"res/icon.png":   fileB,
+		"RES/ICON.png":   fileC,
+		"res/icon~2.png": fileA,
+		"res/.Config":    fileB,
+		"res/.config":    fileC,
+		"res/layout.xml": fileA,
+	})
+
+	dir := t.TempDir()
+	renames := filepath.Join(dir, "renames.txt")
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			File("Res/Icon.PNG").
+			File("res/icon.png").
+			File("RES/ICON.png").
+			File("res/icon~2.png").
+			File("res/.Config").
+			File("res/.config").
+			File("res/layout.xml").
+			FileArgs(),
+		CompressionLevel:    9,
+		NonDeflatedFiles:    map[string]bool{"res/icon.png": true},
+		CanonicalizeCase:    true,
+		CaseRenamesFilePath: renames,
+		Filesystem:          fs,
+		Stderr:              &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	contents := make(map[string][]byte)
+	for _, f := range zr.File {
+		names = append(names, fmt.Sprintf("%s %d", f.Name, f.Method))
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every file survives, and the suffixed copies of res/icon.png are still stored.
+	want := []string{
+		"res/icon.png 0",
+		"res/icon~2.png 0",
+		"res/icon~3.png 0",
+		"res/icon~2~2.png 8",
+		"res/.config 8",
+		"res/.config~2 8",
+		"res/layout.xml 8",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+	if !bytes.Equal(contents["res/icon~2.png"], fileB) || !bytes.Equal(contents["res/icon~3.png"], fileC) {
+		t.Errorf("renamed entries have the wrong contents")
+	}
+
+	got, err := ioutil.ReadFile(renames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRenames := "res/icon.png\tres/icon.png\tres/icon~2.png\n" +
+		"RES/ICON.png\tRES/ICON.png\tres/icon~3.png\n" +
+		"res/icon~2.png\tres/icon~2.png\tres/icon~2~2.png\n" +
+		"res/.config\tres/.config\tres/.config~2\n"
+	if string(got) != wantRenames {
+		t.Errorf("want renames:\n%s\ngot:\n%s", wantRenames, got)
+	}
+
+	// The same file listed twice is still a duplicate.
+	args.FileArgs = NewFileArgsBuilder().File("res/layout.xml").File("res/layout.xml").FileArgs()
+	err = ZipTo(args, &bytes.Buffer{})
+	wantErr := `destination "res/layout.xml" has two files "res/layout.xml" and "res/layout.xml"`
+	if err == nil || err.Error() != wantErr {
+		t.Errorf("want error %q, got %v", wantErr, err)
+	}
+}
+
+func TestDestRewrite(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"out/target/product/generic/system/lib/libfoo.so": fileA,
+		"out/target/product/generic/system/bin/foo":       fileB,
+		"out/target/product/generic/data/a_b_c":           fileC,
+		"out/host/bin/bar":                                fileA,
+	})
+
+	zipRewrite := func(b *FileArgsBuilder, subs ...string) ([]string, error) {
+		var rewrites []*DestRewrite
+		for _, s := range subs {
+			r, err := ParseDestRewrite(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewrites = append(rewrites, r)
+		}
+		args := ZipArgs{
+			FileArgs:         b.FileArgs(),
+			CompressionLevel: 9,
+			DestRewrites:     rewrites,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		return names, nil
+	}
+
+	testCases := []struct {
+		name string
+		subs []string
+		want []string
+	}{
+		{
+			name: "capture groups",
+			subs: []string{`s|^out/target/product/([^/]+)/system/(.*)$|$1/${2}|`},
+			want: []string{
+				"out/host/bin/bar",
+				"out/target/product/generic/data/a_b_c",
+				"generic/bin/foo",
+				"generic/lib/libfoo.so",
+			},
+		},
+		{
+			name: "escaped delimiter",
+			subs: []string{`s/^out\/target\/product\/generic\///`},
+			want: []string{
+				"out/host/bin/bar",
+				"data/a_b_c",
+				"system/bin/foo",
+				"system/lib/libfoo.so",
+			},
+		},
+		{
+			name: "first match",
+			subs: []string{`s/_/-/`},
+			want: []string{
+				"out/host/bin/bar",
+				"out/target/product/generic/data/a-b_c",
+				"out/target/product/generic/system/bin/foo",
+				"out/target/product/generic/system/lib/libfoo.so",
+			},
+		},
+		{
+			name: "global",
+			subs: []string{`s/_/-/g`},
+			want: []string{
+				"out/host/bin/bar",
+				"out/target/product/generic/data/a-b-c",
+				"out/target/product/generic/system/bin/foo",
+				"out/target/product/generic/system/lib/libfoo.so",
+			},
+		},
+		{
+			name: "in order",
+			subs: []string{`s,^out/target/product/generic/,,`, `s,^system/,,`},
+			want: []string{
+				"out/host/bin/bar",
+				"data/a_b_c",
+				"bin/foo",
+				"lib/libfoo.so",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			names, err := zipRewrite(NewFileArgsBuilder().
+				File("out/host/bin/bar").
+				File("out/target/product/generic/data/a_b_c").
+				File("out/target/product/generic/system/bin/foo").
+				File("out/target/product/generic/system/lib/libfoo.so"), test.subs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("want entries %q, got %q", test.want, names)
+			}
+		})
+	}
+
+	t.Run("collision", func(t *testing.T) {
+		_, err := zipRewrite(NewFileArgsBuilder().
+			File("out/host/bin/bar").
+			File("out/target/product/generic/system/bin/foo"),
+			`s|^.*/bin/.*$|bin/tool|`)
+		want := `destination "bin/tool" has two files "out/host/bin/bar" and "out/target/product/generic/system/bin/foo"`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("outside the zip", func(t *testing.T) {
+		_, err := zipRewrite(NewFileArgsBuilder().File("out/host/bin/bar"), `s|^out/host/|../|`)
+		want := `destination "out/host/bin/bar" is rewritten to "../bin/bar", which is outside the zip`
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestParseDestRewrite(t *testing.T) {
+	testCases := []struct {
+		sub     string
+		wantErr string
+	}{
+		{sub: `s/a/b/`},
+		{sub: `s/a/b/g`},
+		{sub: `s#a/(b)#$1#`},
+		{sub: `a/b/`, wantErr: `substitution "a/b/" must be of the form s/pattern/replacement/`},
+		{sub: `s/a/b`, wantErr: `substitution "s/a/b" must be of the form s/pattern/replacement/ or s/pattern/replacement/g`},
+		{sub: `s/a/b/x`, wantErr: `substitution "s/a/b/x" must be of the form s/pattern/replacement/ or s/pattern/replacement/g`},
+		{sub: `s/a/b/c/`, wantErr: `substitution "s/a/b/c/" must be of the form s/pattern/replacement/ or s/pattern/replacement/g`},
+		{sub: `s/a(/b/`, wantErr: "substitution \"s/a(/b/\": error parsing regexp: missing closing ): `a(`"},
+	}
+
+	for _, test := range testCases {
+		_, err := ParseDestRewrite(test.sub)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%q: unexpected error %v", test.sub, err)
+		} else if test.wantErr != "" && (err == nil || err.Error() != test.wantErr) {
+			t.Errorf("%q: want error %q, got %v", test.sub, test.wantErr, err)
+		}
+	}
+}
+
+func TestOnlyExtensions(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"out/lib/libfoo.so":     fileA,
+		"out/lib/libfoo.so.toc": fileB,
+		"out/lib/README":        fileB,
+		"out/dex/classes.dex":   fileC,
+		"out/dex/classes.jar":   fileC,
+		"out/res/icon.png":      fileA,
+		"extra/notes.txt":       fileB,
+	})
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			SourcePrefixToStrip("out").
+			Dir("out").
+			SourcePrefixToStrip("").
+			File("extra").
+			File("extra/notes.txt").
+			FileArgs(),
+		OnlyExtensions:           []string{".so", "dex"},
+		AddDirectoryEntriesToZip: true,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	// The directories of the kept files are added as their parents, and the directory passed
+	// with File is kept, but res/ is not added.
+	want := []string{"dex/", "dex/classes.dex", "lib/", "lib/libfoo.so", "extra/"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+}
+
+func TestExcludedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_excluded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"out/lib/libfoo.so": fileA,
+		"out/lib/README":    fileB,
+		"out/res/icon.png":  fileA,
+		"c":                 fileC,
+	})
+	excluded := filepath.Join(dir, "excluded.txt")
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			Dir("out").
+			Dir("missing_dir").
+			Dir("c").
+			File("missing_file").
+			FileArgs(),
+		OnlyExtensions:     []string{".so"},
+		IgnoreMissingFiles: true,
+		ExcludedFilePath:   excluded,
+		Filesystem:         fs,
+		Stderr:             &bytes.Buffer{},
+	}
+	if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(excluded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "out/lib/README\twrong extension\n" +
+		"out/res/icon.png\twrong extension\n" +
+		"missing_dir\tmissing\n" +
+		"c\tnot a directory\n" +
+		"missing_file\tmissing\n"
+	if string(got) != want {
+		t.Errorf("want excluded sources:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestClusterByExtension(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"res/b/icon.png":    fileA,
+		"res/b/layout.xml":  fileB,
+		"res/a/strings.xml": fileC,
+		"res/a/icon.png":    fileA,
+		"res/README":        fileB,
+	})
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			File("res/b/icon.png").
+			File("res/b/layout.xml").
+			File("res/a/strings.xml").
+			File("res/a/icon.png").
+			File("res/README").
+			FileArgs(),
+		CompressionLevel:   9,
+		ClusterByExtension: true,
+		Filesystem:         fs,
+		Stderr:             &bytes.Buffer{},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"res/README", "res/a/icon.png", "res/b/icon.png", "res/a/strings.xml", "res/b/layout.xml"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want order %q, got %q", want, names)
+	}
+}
+
+func TestOrderBySize(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"medium":  bytes.Repeat([]byte("m"), 20),
+		"large":   bytes.Repeat([]byte("l"), 30),
+		"small":   bytes.Repeat([]byte("s"), 10),
+		"medium2": bytes.Repeat([]byte("n"), 20),
+	})
+
+	testCases := []struct {
+		order SizeOrder
+		want  []string
+	}{
+		{NoSizeOrder, []string{"medium", "large", "small", "medium2"}},
+		{SmallestFirst, []string{"small", "medium", "medium2", "large"}},
+		{LargestFirst, []string{"large", "medium", "medium2", "small"}},
+	}
+
+	for _, test := range testCases {
+		args := ZipArgs{
+			FileArgs: NewFileArgsBuilder().
+				File("medium").
+				File("large").
+				File("small").
+				File("medium2").
+				FileArgs(),
+			CompressionLevel: 9,
+			OrderBySize:      test.order,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("order %d: want order %q, got %q", test.order, test.want, names)
+		}
+	}
+
+	args := ZipArgs{
+		FileArgs:    NewFileArgsBuilder().File("small").FileArgs(),
+		EmulateJar:  true,
+		OrderBySize: SmallestFirst,
+		Filesystem:  fs,
+		Stderr:      &bytes.Buffer{},
+	}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil {
+		t.Error("want an error ordering a jar by size")
+	}
+}
+
+// BenchmarkReadOneExtension reads all the files with one extension from a zip file of mixed
+// resources, with and without -cluster-by-ext.
+func BenchmarkReadOneExtension(b *testing.B) {
+	dir, err := ioutil.TempDir("", "soong_zip_cluster")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := make(map[string][]byte)
+	seed := uint32(1)
+	for i := 0; i < 300; i++ {
+		png := make([]byte, 16*1024)
+		for j := range png {
+			seed = seed*1103515245 + 12345
+			png[j] = byte(seed >> 16)
+		}
+		files[fmt.Sprintf("res/%03d/icon.png", i)] = png
+		files[fmt.Sprintf("res/%03d/layout.xml", i)] = bytes.Repeat([]byte(fmt.Sprintf("<view id=\"%d\"/>\n", i)), 200)
+		files[fmt.Sprintf("res/%03d/strings.txt", i)] = bytes.Repeat([]byte(fmt.Sprintf("string %d\n", i)), 200)
+	}
+	fs := pathtools.MockFs(files)
+
+	for _, cluster := range []bool{false, true} {
+		out := filepath.Join(dir, fmt.Sprintf("cluster_%v.zip", cluster))
+		f, err := os.Create(out)
+		if err != nil {
+			b.Fatal(err)
+		}
+		args := ZipArgs{
+			FileArgs:           NewFileArgsBuilder().Dir("res").FileArgs(),
+			CompressionLevel:   5,
+			ClusterByExtension: cluster,
+			Filesystem:         fs,
+			Stderr:             ioutil.Discard,
+		}
+		if err := ZipTo(args, f); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+
+		b.Run(fmt.Sprintf("cluster %v", cluster), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				zr, err := zip.OpenReader(out)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, f := range zr.File {
+					if filepath.Ext(f.Name) != ".xml" {
+						continue
+					}
+					r, err := f.Open()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := io.Copy(ioutil.Discard, r); err != nil {
+						b.Fatal(err)
+					}
+					r.Close()
+				}
+				zr.Close()
+			}
+		})
+	}
+}
+
+func TestReadRespFile(t *testing.T) {
+	testCases := []struct {
+		name, in string
+		out      []string
+	}{
+		{
+			name: "single quoting test case 1",
+			in:   `./cmd '"'-C`,
+			out:  []string{"./cmd", `"-C`},
+		},
+		{
+			name: "single quoting test case 2",
+			in:   `./cmd '-C`,
+			out:  []string{"./cmd", `-C`},
+		},
+		{
+			name: "single quoting test case 3",
+			in:   `./cmd '\"'-C`,
+			out:  []string{"./cmd", `\"-C`},
+		},
+		{
 			name: "single quoting test case 4",
 			in:   `./cmd '\\'-C`,
 			out:  []string{"./cmd", `\\-C`},
 		},
 		{
-			name: "none quoting test case 1",
-			in:   `./cmd \'-C`,
-			out:  []string{"./cmd", `'-C`},
+			name: "none quoting test case 1",
+			in:   `./cmd \'-C`,
+			out:  []string{"./cmd", `'-C`},
+		},
+		{
+			name: "none quoting test case 2",
+			in:   `./cmd \\-C`,
+			out:  []string{"./cmd", `\-C`},
+		},
+		{
+			name: "none quoting test case 3",
+			in:   `./cmd \"-C`,
+			out:  []string{"./cmd", `"-C`},
+		},
+		{
+			name: "double quoting test case 1",
+			in:   `./cmd "'"-C`,
+			out:  []string{"./cmd", `'-C`},
+		},
+		{
+			name: "double quoting test case 2",
+			in:   `./cmd "\\"-C`,
+			out:  []string{"./cmd", `\-C`},
+		},
+		{
+			name: "double quoting test case 3",
+			in:   `./cmd "\""-C`,
+			out:  []string{"./cmd", `"-C`},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			got := ReadRespFile([]byte(testCase.in))
+			if !reflect.DeepEqual(got, testCase.out) {
+				t.Errorf("expected %q got %q", testCase.out, got)
+			}
+		})
+	}
+}
+
+func BenchmarkZipTinyFiles(b *testing.B) {
+	files := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("tiny/%03d/%d", i/100, i)] = []byte(fmt.Sprintf("tiny file %d\n", i))
+	}
+	fs := pathtools.MockFs(files)
+
+	for _, minSize := range []int64{0, 64} {
+		b.Run(fmt.Sprintf("deflate min size %d", minSize), func(b *testing.B) {
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().Dir("tiny").FileArgs(),
+				CompressionLevel: 9,
+				DeflateMinSize:   minSize,
+				Filesystem:       fs,
+				Stderr:           ioutil.Discard,
+			}
+			for i := 0; i < b.N; i++ {
+				if err := ZipTo(args, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	var want []byte
+	for _, depth := range []int{1, 2, 0} {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs(),
+			QueueDepth:       depth,
+			CompressionLevel: 9,
+			Filesystem:       mockFs,
+			Stderr:           &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatalf("queue depth %d: %s", depth, err)
+		}
+		if want == nil {
+			want = buf.Bytes()
+		} else if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("queue depth %d changed the zip file", depth)
+		}
+	}
+}
+
+func BenchmarkQueueDepth(b *testing.B) {
+	// Mostly small files, with a large file that is compressed in parallel blocks every so
+	// often, which the writer is stuck on while the small files behind it queue up.
+	files := make(map[string][]byte)
+	r := rand.New(rand.NewSource(1))
+	large := make([]byte, 2*minParallelFileSize)
+	for i := range large {
+		large[i] = byte('a' + r.Intn(4))
+	}
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("mixed/%04d", i)
+		if i%500 == 0 {
+			files[name] = large
+		} else {
+			files[name] = []byte(fmt.Sprintf("small file %d\n", i))
+		}
+	}
+	fs := pathtools.MockFs(files)
+
+	for _, depth := range []int{1, 10, 100, DefaultQueueDepth} {
+		b.Run(fmt.Sprintf("depth %d", depth), func(b *testing.B) {
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().Dir("mixed").FileArgs(),
+				QueueDepth:       depth,
+				CompressionLevel: 5,
+				Filesystem:       fs,
+				Stderr:           ioutil.Discard,
+			}
+			for i := 0; i < b.N; i++ {
+				if err := ZipTo(args, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSymlinksReproducible(t *testing.T) {
+	files := map[string][]byte{
+		"tree/b.txt":           []byte("b"),
+		"tree/d/e.txt":         []byte("e"),
+		"tree/a.link -> b.txt": nil,
+		"tree/d/f -> ../b.txt": nil,
+		"tree/dirlink -> d":    nil,
+	}
+
+	testCases := []struct {
+		name    string
+		jar     bool
+		cluster bool
+
+		names []string
+	}{
+		{
+			name:  "arguments",
+			names: []string{"a.link", "b.txt", "d/", "d/e.txt", "d/f", "dirlink"},
+		},
+		{
+			name:  "jar",
+			jar:   true,
+			names: []string{"META-INF/", "META-INF/MANIFEST.MF", "a.link", "b.txt", "d/", "d/e.txt", "d/f", "dirlink"},
+		},
+		{
+			name:    "cluster by extension",
+			cluster: true,
+			names:   []string{"d/", "d/f", "dirlink", "a.link", "b.txt", "d/e.txt"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var first []byte
+			for i := 0; i < 3; i++ {
+				// A new filesystem each time, since the files are added to it in map order.
+				args := ZipArgs{
+					FileArgs:                 NewFileArgsBuilder().SourcePrefixToStrip("tree").Dir("tree").FileArgs(),
+					EmulateJar:               test.jar,
+					ClusterByExtension:       test.cluster,
+					AddDirectoryEntriesToZip: true,
+					StoreSymlinks:            true,
+					CompressionLevel:         9,
+					Filesystem:               pathtools.MockFs(files),
+					Stderr:                   &bytes.Buffer{},
+				}
+				buf := &bytes.Buffer{}
+				if err := ZipTo(args, buf); err != nil {
+					t.Fatal(err)
+				}
+				if first == nil {
+					first = buf.Bytes()
+				} else if !bytes.Equal(buf.Bytes(), first) {
+					t.Fatalf("zip file changed on run %d", i+1)
+				}
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+				if f.Name == "d/f" {
+					r, err := f.Open()
+					if err != nil {
+						t.Fatal(err)
+					}
+					target, _ := ioutil.ReadAll(r)
+					r.Close()
+					if string(target) != "../b.txt" {
+						t.Errorf("want d/f to link to %q, got %q", "../b.txt", target)
+					}
+				}
+			}
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("want entries %q, got %q", test.names, names)
+			}
+		})
+	}
+}
+
+func TestSinceMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soong_zip_since")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		"src/a/same":         []byte("same"),
+		"src/a/resized":      []byte("short"),
+		"src/a/modified":     []byte("before"),
+		"src/b/empty":        nil,
+		"src/link -> a/same": nil,
+	}
+	zipFiles := func(files map[string][]byte, since string) []string {
+		metadata := filepath.Join(dir, "metadata.json")
+		args := ZipArgs{
+			FileArgs:                 NewFileArgsBuilder().SourcePrefixToStrip("src").Dir("src").FileArgs(),
+			AddDirectoryEntriesToZip: true,
+			StoreSymlinks:            true,
+			CompressionLevel:         9,
+			MetadataFilePath:         metadata,
+			SinceMetadataFilePath:    since,
+			Filesystem:               pathtools.MockFs(files),
+			Stderr:                   &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		if since == "" {
+			if err := os.Rename(metadata, filepath.Join(dir, "since.json")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return names
+	}
+
+	all := zipFiles(files, "")
+	want := []string{"a/", "a/modified", "a/resized", "a/same", "b/", "b/empty", "link"}
+	if !reflect.DeepEqual(all, want) {
+		t.Fatalf("want entries %q, got %q", want, all)
+	}
+
+	since := filepath.Join(dir, "since.json")
+	if got := zipFiles(files, since); len(got) != 0 {
+		t.Errorf("want no entries without changes, got %q", got)
+	}
+
+	// Same size, different contents.
+	files["src/a/modified"] = []byte("after!")
+	files["src/a/resized"] = []byte("longer")
+	files["src/c/new"] = []byte("new")
+	delete(files, "src/link -> a/same")
+	files["src/link -> a/resized"] = nil
+
+	// The parent directory of a changed file is added for it even though it is unchanged.
+	want = []string{"a/", "a/modified", "a/resized", "c/", "c/new", "link"}
+	if got := zipFiles(files, since); !reflect.DeepEqual(got, want) {
+		t.Errorf("want entries %q, got %q", want, got)
+	}
+
+	if err := ioutil.WriteFile(since, []byte("not json"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	metadata := filepath.Join(dir, "metadata.json")
+	err = ZipTo(ZipArgs{
+		FileArgs:              NewFileArgsBuilder().File("c").FileArgs(),
+		MetadataFilePath:      metadata,
+		SinceMetadataFilePath: since,
+		Filesystem:            mockFs,
+		Stderr:                &bytes.Buffer{},
+	}, &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), since) {
+		t.Errorf("want error for invalid metadata file, got %v", err)
+	}
+}
+
+func TestVerifyInputs(t *testing.T) {
+	large := bytes.Repeat([]byte("large file "), minParallelFileSize/10)
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/small":      fileA,
+		"a/large":      large,
+		"manifest.txt": fileCustomManifest,
+	})
+	sum := func(b []byte) string {
+		s := sha256.Sum256(b)
+		return hex.EncodeToString(s[:])
+	}
+	wrong := strings.Repeat("0", 64)
+
+	testCases := []struct {
+		name     string
+		manifest string
+		jar      bool
+
+		err string
+	}{
+		{
+			name:     "match",
+			manifest: sum(fileA) + "  a/small\n" + sum(large) + " *./a/large\n",
+		},
+		{
+			name:     "small mismatch",
+			manifest: wrong + "  a/small\n" + sum(large) + "  a/large\n",
+			err:      "a/small has sha256 " + sum(fileA) + ", but the input checksum manifest has " + wrong,
+		},
+		{
+			name:     "large mismatch",
+			manifest: sum(fileA) + "  a/small\n" + wrong + "  a/large\n",
+			err:      "a/large has sha256 " + sum(large),
+		},
+		{
+			name:     "not listed",
+			manifest: sum(fileA) + "  a/small\n",
+			err:      "a/large is not in the input checksum manifest",
+		},
+		{
+			name:     "jar manifest",
+			manifest: sum(fileA) + "  a/small\n" + sum(large) + "  a/large\n" + wrong + "  manifest.txt\n",
+			jar:      true,
+			err:      "manifest.txt has sha256 " + sum(fileCustomManifest),
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			sums, err := ReadSHA256Manifest(strings.NewReader(test.manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().Dir("a").FileArgs(),
+				EmulateJar:       test.jar,
+				InputSHA256s:     sums,
+				CompressionLevel: 9,
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			}
+			if test.jar {
+				args.ManifestSourcePath = "manifest.txt"
+			}
+			err = ZipTo(args, &bytes.Buffer{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("want error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestReadSHA256Manifest(t *testing.T) {
+	wrong := strings.Repeat("0", 64)
+	testCases := []struct {
+		name string
+		in   string
+
+		out map[string][]byte
+		err string
+	}{
+		{
+			name: "sha256sum",
+			in:   "# comment\n\n" + wrong + "  a/b\r\n" + strings.Repeat("ab", 32) + " *c d\n",
+			out: map[string][]byte{
+				"a/b": make([]byte, 32),
+				"c d": bytes.Repeat([]byte{0xab}, 32),
+			},
+		},
+		{
+			name: "no path",
+			in:   wrong + "\n",
+			err:  "line 1: want a sha256 and a path",
+		},
+		{
+			name: "not hex",
+			in:   strings.Repeat("x", 64) + "  a\n",
+			err:  "line 1: invalid sha256",
+		},
+		{
+			name: "duplicate",
+			in:   wrong + "  a\n" + wrong + "  ./a\n",
+			err:  "line 2: a is listed more than once",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReadSHA256Manifest(strings.NewReader(test.in))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("want error containing %q, got %v", test.err, err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(got, test.out) {
+				t.Errorf("want %x, got %x", test.out, got)
+			}
+		})
+	}
+}
+
+func TestCommentSourceHash(t *testing.T) {
+	large := bytes.Repeat([]byte("large file "), minParallelFileSize/10)
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/small":         fileA,
+		"a/large":         large,
+		"a/link -> small": nil,
+	})
+
+	args := ZipArgs{
+		FileArgs:                 NewFileArgsBuilder().Dir("a").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		StoreSymlinks:            true,
+		CommentSourceHash:        true,
+		CompressionLevel:         9,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		want := ""
+		if !strings.HasSuffix(f.Name, "/") {
+			r, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, _ := ioutil.ReadAll(r)
+			r.Close()
+			sum := sha256.Sum256(contents)
+			want = "sha256:" + hex.EncodeToString(sum[:])
+		}
+		if f.Comment != want {
+			t.Errorf("%s: want comment %q, got %q", f.Name, want, f.Comment)
+		}
+	}
+	if len(zr.File) != 4 {
+		t.Errorf("want 4 entries, got %d", len(zr.File))
+	}
+}
+
+func TestSplitEntriesOver(t *testing.T) {
+	// Parts at least minParallelFileSize are compressed in parallel blocks from their section of
+	// the file.
+	large := make([]byte, 2*minParallelFileSize+100)
+	for i := range large {
+		large[i] = byte(i * 7 / 1000)
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/large": large,
+		"a/small": fileA,
+	})
+
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().File("a/large").File("a/small").FileArgs(),
+		SplitEntriesOver: minParallelFileSize + 1,
+		CompressionLevel: 9,
+		Filesystem:       fs,
+		Stderr:           &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"a/large.part0", "a/large.part1", "a/large.part2", "a/large.parts", "a/small"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+	if zr.File[0].Method != zip.Deflate || zr.File[3].Method != zip.Store {
+		t.Errorf("want deflated parts and a stored manifest, got methods %d and %d", zr.File[0].Method, zr.File[3].Method)
+	}
+
+	got := &bytes.Buffer{}
+	if err := ReassembleSplitEntry(zr, "a/large", got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), large) {
+		t.Errorf("reassembled %d bytes that differ from the %d bytes of the file", got.Len(), len(large))
+	}
+
+	if err := ReassembleSplitEntry(zr, "a/small", got); err == nil {
+		t.Error("want an error reassembling a file that wasn't split")
+	}
+}
+
+func TestNonUTF8(t *testing.T) {
+	// Latin-1 names, as written by tools that don't use UTF-8.
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/caf\xe9":     fileA,
+		"a/d\xfc\xfc/b": fileB,
+		"a/validé":      fileC,
+	})
+
+	zipNames := func(policy NonUTF8Policy) ([]string, error) {
+		args := ZipArgs{
+			FileArgs:                 NewFileArgsBuilder().Dir("a").FileArgs(),
+			AddDirectoryEntriesToZip: true,
+			NonUTF8:                  policy,
+			Filesystem:               fs,
+			Stderr:                   &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			return nil, err
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			if f.Flags&0x800 != 0 {
+				t.Errorf("%q has the UTF-8 flag", f.Name)
+			}
+		}
+		return names, nil
+	}
+
+	names, err := zipNames(NonUTF8Passthrough)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/", "a/caf\xe9", "a/d\xfc\xfc/", "a/d\xfc\xfc/b", "a/validé"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("passthrough: want entries %q, got %q", want, names)
+	}
+
+	names, err = zipNames(NonUTF8Transliterate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"a/", "a/caf_", "a/d_/", "a/d_/b", "a/validé"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("transliterate: want entries %q, got %q", want, names)
+	}
+
+	if _, err := zipNames(NonUTF8Reject); err == nil || !strings.Contains(err.Error(), "not valid UTF-8") {
+		t.Errorf("reject: want an invalid UTF-8 error, got %v", err)
+	}
+}
+
+func TestModeMap(t *testing.T) {
+	modeMap, err := ReadModeMap(strings.NewReader(`
+# comment
+/ 0640
+system/bin 0755
+system/bin/su 04750
+system/etc 0600
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"system/bin/sh":      fileA,
+		"system/bin/su":      fileB,
+		"system/binfmt/x":    fileC,
+		"system/etc/hosts":   fileA,
+		"system/etc/a/b.txt": fileB,
+	})
+
+	args := ZipArgs{
+		FileArgs:                 NewFileArgsBuilder().Dir("system").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		ModeMap:                  modeMap,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]os.FileMode)
+	for _, f := range zr.File {
+		got[f.Name] = f.Mode()
+	}
+	want := map[string]os.FileMode{
+		"system/":            os.ModeDir | 0640,
+		"system/bin/":        os.ModeDir | 0755,
+		"system/bin/sh":      0755,
+		"system/bin/su":      os.ModeSetuid | 0750,
+		"system/binfmt/":     os.ModeDir | 0640,
+		"system/binfmt/x":    0640,
+		"system/etc/":        os.ModeDir | 0600,
+		"system/etc/a/":      os.ModeDir | 0600,
+		"system/etc/a/b.txt": 0600,
+		"system/etc/hosts":   0600,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want modes %v, got %v", want, got)
+	}
+}
+
+func TestReadModeMap(t *testing.T) {
+	for _, s := range []string{"system/bin", "system/bin 0855", "system/bin 010000", "a 0644\n/a/ 0600"} {
+		if _, err := ReadModeMap(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/a":                           fileA,
+		"zeros":                         make([]byte, 1<<20),
+		"META-INF/versions/9/foo.class": fileB,
+	})
+
+	testCases := []struct {
+		name    string
+		args    ZipArgs
+		warning string
+	}{
+		{
+			name: "missing file",
+			args: ZipArgs{
+				FileArgs:           NewFileArgsBuilder().File("a/a").File("missing").FileArgs(),
+				IgnoreMissingFiles: true,
+			},
+			warning: "lstat missing: file does not exist",
+		},
+		{
+			name: "missing license",
+			args: ZipArgs{
+				FileArgs:          NewFileArgsBuilder().File("a/a").FileArgs(),
+				LicenseSourcePath: "LICENSE",
+			},
+			warning: `license file "LICENSE" does not exist`,
+		},
+		{
+			name: "versioned class",
+			args: ZipArgs{
+				FileArgs:     NewFileArgsBuilder().File("META-INF/versions/9/foo.class").FileArgs(),
+				EmulateJar:   true,
+				MultiRelease: true,
+			},
+			warning: `has no base class "foo.class"`,
+		},
+		{
+			name: "compression ratio",
+			args: ZipArgs{
+				FileArgs:            NewFileArgsBuilder().File("zeros").FileArgs(),
+				MaxCompressionRatio: 200,
+			},
+			warning: `"zeros" has compression ratio`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			for _, werror := range []bool{false, true} {
+				stderr := &bytes.Buffer{}
+				args := test.args
+				args.CompressionLevel = 9
+				args.WarningsAsErrors = werror
+				args.Filesystem = fs
+				args.Stderr = stderr
+
+				err := ZipTo(args, &bytes.Buffer{})
+				if werror {
+					if err == nil || !strings.Contains(err.Error(), test.warning) {
+						t.Errorf("want error %q, got %v", test.warning, err)
+					}
+					if stderr.Len() > 0 {
+						t.Errorf("want no warnings, got %q", stderr.String())
+					}
+				} else {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !strings.Contains(stderr.String(), "warning: ") || !strings.Contains(stderr.String(), test.warning) {
+						t.Errorf("want warning %q, got %q", test.warning, stderr.String())
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStoreXattrs(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/labeled":   fileA,
+		"a/unlabeled": fileB,
+	})
+	attrs := map[string]map[string][]byte{
+		"a/labeled": {
+			"security.selinux": []byte("u:object_r:system_file:s0\x00"),
+			"user.empty":       {},
+		},
+	}
+
+	defer func(f func(string) (map[string][]byte, error)) { readXattrs = f }(readXattrs)
+	readXattrs = func(path string) (map[string][]byte, error) { return attrs[path], nil }
+
+	args := ZipArgs{
+		FileArgs:           NewFileArgsBuilder().Dir("a").FileArgs(),
+		StoreXattrs:        true,
+		ExtendedTimestamps: true,
+		CompressionLevel:   9,
+		Filesystem:         fs,
+		Stderr:             &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		got, err := ReadXattrs(&f.FileHeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := attrs[f.Name]
+		if len(want) == 0 {
+			want = nil
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want xattrs %q, got %q", f.Name, want, got)
+		}
+	}
+
+	// The platform's own support is checked against a real file if it has any.
+	if _, err := osReadXattrs(os.Args[0]); err != nil && err != errXattrsUnsupported {
+		t.Errorf("failed to read xattrs of %s: %s", os.Args[0], err)
+	}
+}
+
+func TestExtraFieldOrder(t *testing.T) {
+	records := [][]byte{
+		zip.ExtendedTimestamp(time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0)),
+		buildIDExtra([]byte("build")),
+		sharedDictionaryExtra([]byte("dictionary")),
+		{XattrTag & 0xff, XattrTag >> 8, 2, 0, 'x', 'y'},
+	}
+	want := append(append(append(append([]byte(nil),
+		records[2]...), records[1]...), records[0]...), records[3]...)
+
+	// Every order the features could add their records in gives the same extra field.
+	var permute func(added [][]byte, rest [][]byte)
+	permute = func(added [][]byte, rest [][]byte) {
+		if len(rest) == 0 {
+			fh := &zip.FileHeader{}
+			for _, r := range added {
+				addExtra(fh, r)
+			}
+			if !bytes.Equal(fh.Extra, want) {
+				t.Errorf("adding records in order %x: want extra %x, got %x", added, want, fh.Extra)
+			}
+			return
+		}
+		for i := range rest {
+			others := append(append([][]byte(nil), rest[:i]...), rest[i+1:]...)
+			permute(append(append([][]byte(nil), added...), rest[i]), others)
+		}
+	}
+	permute(nil, records)
+
+	// Records with the same ID keep the order they were added in, and the extra field that was
+	// added to isn't modified.
+	shared := buildIDExtra([]byte("first"))
+	fh := &zip.FileHeader{Extra: shared}
+	addExtra(fh, buildIDExtra([]byte("second")))
+	if want := append(buildIDExtra([]byte("first")), buildIDExtra([]byte("second"))...); !bytes.Equal(fh.Extra, want) {
+		t.Errorf("want extra %x, got %x", want, fh.Extra)
+	}
+	if !bytes.Equal(shared, buildIDExtra([]byte("first"))) {
+		t.Errorf("shared extra modified to %x", shared)
+	}
+
+	// The entries of a zip with several features that add records have them sorted by ID.
+	fs := pathtools.MockFs(map[string][]byte{"a/labeled": fileA})
+	defer func(f func(string) (map[string][]byte, error)) { readXattrs = f }(readXattrs)
+	readXattrs = func(path string) (map[string][]byte, error) {
+		return map[string][]byte{"user.label": []byte("value")}, nil
+	}
+	args := ZipArgs{
+		FileArgs:           NewFileArgsBuilder().Dir("a").FileArgs(),
+		StoreXattrs:        true,
+		ExtendedTimestamps: true,
+		CommentSourceHash:  true,
+		CompressionLevel:   9,
+		Filesystem:         fs,
+		Stderr:             &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		var ids []uint16
+		for _, r := range splitExtra(f.Extra) {
+			ids = append(ids, headerID(r))
+		}
+		if want := []uint16{zip.ExtendedTimeStampTag, XattrTag}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("%s: want extra field IDs %#x, got %#x", f.Name, want, ids)
+		}
+	}
+}
+
+func TestSortTiebreak(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"x/d/a.txt":   fileA,
+		"x/d/b.class": fileA,
+		"y/d/c.txt":   fileA,
+		"y/e.class":   fileB,
+		"y/f.txt":     fileC,
+	})
+	type src struct{ root, file string }
+	srcs := []src{{"x", "x/d/a.txt"}, {"x", "x/d/b.class"}, {"y", "y/d/c.txt"}, {"y", "y/e.class"}, {"y", "y/f.txt"}}
+
+	testCases := []struct {
+		name string
+		args ZipArgs
+	}{
+		{"jar", ZipArgs{EmulateJar: true}},
+		{"extension", ZipArgs{ClusterByExtension: true, AddDirectoryEntriesToZip: true}},
+		{"smallest first", ZipArgs{OrderBySize: SmallestFirst}},
+		{"largest first", ZipArgs{OrderBySize: LargestFirst}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var want []byte
+			r := rand.New(rand.NewSource(1))
+			for i := 0; i < 10; i++ {
+				r.Shuffle(len(srcs), func(i, j int) { srcs[i], srcs[j] = srcs[j], srcs[i] })
+				b := NewFileArgsBuilder()
+				for _, s := range srcs {
+					b.SourcePrefixToStrip(s.root).File(s.file)
+				}
+
+				args := test.args
+				args.FileArgs = b.FileArgs()
+				args.CompressionLevel = 9
+				args.Filesystem = fs
+				args.Stderr = &bytes.Buffer{}
+				buf := &bytes.Buffer{}
+				if err := ZipTo(args, buf); err != nil {
+					t.Fatal(err)
+				}
+
+				if want == nil {
+					want = buf.Bytes()
+				} else if !bytes.Equal(buf.Bytes(), want) {
+					t.Fatalf("order %v: output differs from the first order", srcs)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxEntriesPerDir(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"flat/1":     fileA,
+		"flat/2":     fileA,
+		"flat/3":     fileA,
+		"nested/a/1": fileA,
+		"nested/b/1": fileA,
+		"nested/c":   fileA,
+	})
+
+	testCases := []struct {
+		name    string
+		dir     string
+		max     int
+		fail    bool
+		warning string
+		err     string
+	}{
+		{name: "unlimited", dir: "flat"},
+		{name: "at limit", dir: "flat", max: 3},
+		{name: "over limit", dir: "flat", max: 2, warning: `directory "flat" has 3 entries, more than the maximum of 2`},
+		{name: "fail", dir: "flat", max: 2, fail: true, err: `directory "flat" has 3 entries`},
+		// nested has the implicit directories a and b and the file c.
+		{name: "implicit dirs at limit", dir: "nested", max: 3},
+		{name: "implicit dirs", dir: "nested", max: 2, fail: true, err: `directory "nested" has 3 entries`},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			stderr := &bytes.Buffer{}
+			args := ZipArgs{
+				FileArgs:               NewFileArgsBuilder().SourcePrefixToStrip("").Dir(test.dir).FileArgs(),
+				MaxEntriesPerDir:       test.max,
+				FailOnMaxEntriesPerDir: test.fail,
+				Filesystem:             fs,
+				Stderr:                 stderr,
+			}
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.warning == "" && stderr.Len() > 0 {
+				t.Errorf("want no warnings, got %q", stderr.String())
+			} else if !strings.Contains(stderr.String(), test.warning) {
+				t.Errorf("want warning %q, got %q", test.warning, stderr.String())
+			}
+		})
+	}
+}
+
+func TestEmitIndex(t *testing.T) {
+	// Larger than minParallelFileSize, so that it is compressed in parallel blocks.
+	large := bytes.Repeat([]byte("0123456789abcdef"), minParallelFileSize/16+1)
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+		"empty": fileEmpty,
+		"large": large,
+	})
+
+	out := &bytes.Buffer{}
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().SourcePrefixToStrip("").File("a/a/a").File("a/a/b").File("c").File("empty").File("large").FileArgs(),
+		CompressionLevel: 9,
+		EmitIndex:        true,
+		Filesystem:       fs,
+		Stderr:           &bytes.Buffer{},
+	}
+	if err := ZipTo(args, out); err != nil {
+		t.Fatal(err)
+	}
+
+	data := out.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := zr.File[len(zr.File)-1]; last.Name != IndexName {
+		t.Errorf("want %q as the last entry, got %q", IndexName, last.Name)
+	}
+
+	ir, err := NewIndexedReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ir.Entries()), len(zr.File)-1; got != want {
+		t.Errorf("want %d entries in the index, got %d", want, got)
+	}
+
+	for _, f := range zr.File {
+		if f.Name == IndexName {
+			if _, ok := ir.Lookup(f.Name); ok {
+				t.Errorf("index lists itself")
+			}
+			continue
+		}
+		e, ok := ir.Lookup(f.Name)
+		if !ok {
+			t.Errorf("%q is not in the index", f.Name)
+			continue
+		}
+		if e.CRC32 != f.CRC32 || e.CompressedSize != f.CompressedSize64 || e.UncompressedSize != f.UncompressedSize64 {
+			t.Errorf("%q: index has %+v, central directory has crc %08x sizes %d %d",
+				f.Name, e, f.CRC32, f.CompressedSize64, f.UncompressedSize64)
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err = ir.Open(f.Name)
+		if err != nil {
+			t.Fatalf("%q: %s", f.Name, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%q: %s", f.Name, err)
+		} else if !bytes.Equal(got, want) {
+			t.Errorf("%q: contents read through the index don't match", f.Name)
+		}
+	}
+
+	if _, ok := ir.Lookup("missing"); ok {
+		t.Errorf("want missing to be missing from the index")
+	}
+
+	t.Run("no index", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		args.EmitIndex = false
+		if err := ZipTo(args, out); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewIndexedReader(bytes.NewReader(out.Bytes()), int64(out.Len())); err != errNoIndex {
+			t.Errorf("want %v, got %v", errNoIndex, err)
+		}
+	})
+}
+
+func TestSymlinkMode(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"dir/file":              fileA,
+		"dir/link -> file":      nil,
+		"dir/sub/up -> ../file": nil,
+	})
+
+	testCases := []struct {
+		name    string
+		mode    os.FileMode
+		modeMap map[string]os.FileMode
+		want    os.FileMode
+	}{
+		{name: "default", want: 0777},
+		{name: "custom", mode: 0755, want: 0755},
+		{name: "mode map", modeMap: map[string]os.FileMode{"dir": 0600}, want: 0777},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:       NewFileArgsBuilder().Dir("dir").FileArgs(),
+				SymlinkMode:    test.mode,
+				ModeMap:        test.modeMap,
+				ExecutableBits: 0111,
+				StoreSymlinks:  true,
+				Filesystem:     fs,
+				Stderr:         &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			links := 0
+			for _, f := range zr.File {
+				if f.Mode()&os.ModeSymlink == 0 {
+					continue
+				}
+				links++
+				if got := f.Mode(); got != test.want|os.ModeSymlink {
+					t.Errorf("%q: want mode %v, got %v", f.Name, test.want|os.ModeSymlink, got)
+				}
+			}
+			if links != 2 {
+				t.Errorf("want 2 symlinks, got %d", links)
+			}
+		})
+	}
+}
+
+func TestCompressFallbackStore(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), minParallelFileSize/16+1)
+	fs := pathtools.MockFs(map[string][]byte{
+		"a":     fileA,
+		"large": large,
+	})
+
+	defer func(f func(*ZipWriter, io.Reader, []byte, int, bool, time.Time) (*bytes.Buffer, error)) {
+		compressBlockFunc = f
+	}(compressBlockFunc)
+
+	testCases := []struct {
+		name     string
+		fallback bool
+		// failures is the number of attempts that fail, or -1 for all of them.
+		failures   int
+		wantMethod uint16
+		warning    string
+		err        string
+	}{
+		{name: "no fallback", failures: 1, err: "out of memory"},
+		{name: "retried", fallback: true, failures: 1, wantMethod: zip.Deflate},
+		{name: "stored", fallback: true, failures: -1, wantMethod: zip.Store, warning: `storing "a": compression failed 3 times: out of memory`},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			attempts := 0
+			compressBlockFunc = func(z *ZipWriter, r io.Reader, dict []byte, level int, last bool, deadline time.Time) (*bytes.Buffer, error) {
+				lock.Lock()
+				attempts++
+				fail := test.failures < 0 || attempts <= test.failures
+				lock.Unlock()
+				if fail {
+					return nil, errors.New("out of memory")
+				}
+				return z.compressBlock(r, dict, level, last, deadline)
+			}
+
+			stderr := &bytes.Buffer{}
+			args := ZipArgs{
+				FileArgs:              NewFileArgsBuilder().File("a").FileArgs(),
+				CompressionLevel:      9,
+				CompressFallbackStore: test.fallback,
+				Filesystem:            fs,
+				Stderr:                stderr,
+			}
+			buf := &bytes.Buffer{}
+			err := ZipTo(args, buf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("want error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(stderr.String(), test.warning) || (test.warning == "" && stderr.Len() > 0) {
+				t.Errorf("want warning %q, got %q", test.warning, stderr.String())
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zr.File) != 1 {
+				t.Fatalf("want 1 entry, got %d", len(zr.File))
+			}
+			if m := zr.File[0].Method; m != test.wantMethod {
+				t.Errorf("want method %d, got %d", test.wantMethod, m)
+			}
+			rc, err := zr.File[0].Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(got, fileA) {
+				t.Errorf("want contents %q, got %q", fileA, got)
+			}
+		})
+	}
+
+	t.Run("parallel blocks", func(t *testing.T) {
+		compressBlockFunc = func(z *ZipWriter, r io.Reader, dict []byte, level int, last bool, deadline time.Time) (*bytes.Buffer, error) {
+			return nil, errors.New("out of memory")
+		}
+
+		stderr := &bytes.Buffer{}
+		args := ZipArgs{
+			FileArgs:              NewFileArgsBuilder().File("large").FileArgs(),
+			CompressionLevel:      9,
+			CompressFallbackStore: true,
+			Filesystem:            fs,
+			Stderr:                stderr,
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(stderr.String(), `storing a block of "large"`) {
+			t.Errorf("want a warning about the stored blocks, got %q", stderr.String())
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rc, err := zr.File[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(got, large) {
+			t.Errorf("contents of the stored blocks don't match")
+		}
+	})
+}
+
+func TestCompressionLevelOutOfRange(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{"a": fileA})
+	for _, level := range []int{-1, 10} {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().File("a").FileArgs(),
+			CompressionLevel: level,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+		err := ZipTo(args, &bytes.Buffer{})
+		want := fmt.Sprintf("compression level %d is out of range, it must be from 0 to 9", level)
+		if err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	}
+}
+
+func TestFlateWriterFailureStores(t *testing.T) {
+	compressible := bytes.Repeat([]byte("store me "), 1000)
+	large := bytes.Repeat([]byte("0123456789abcdef"), minParallelFileSize/16+1)
+	fs := pathtools.MockFs(map[string][]byte{"small": compressible, "large": large})
+
+	// NewZipWriter doesn't check the level, so the flate writer fails to be created at runtime.
+	buf := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	z := NewZipWriter(buf, ZipArgs{
+		CompressionLevel: 42,
+		NumParallelJobs:  2,
+		Filesystem:       fs,
+		Stderr:           stderr,
+	})
+	for _, name := range []string{"small", "large"} {
+		if err := z.Add(name, name, zip.Deflate); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`storing "small": compression failed: flate: invalid compression level 42: want value in range [-2, 9]`,
+		`storing a block of "large": compression failed: flate: invalid compression level 42`,
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("want warning %q, got %q", want, stderr.String())
+		}
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"small": compressible, "large": large}
+	for _, f := range zr.File {
+		if f.CompressedSize64 < f.UncompressedSize64 {
+			t.Errorf("%s: want stored contents, got %d bytes of %d", f.Name, f.CompressedSize64, f.UncompressedSize64)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("%s: wrong contents", f.Name)
+		}
+	}
+}
+
+// syncRecorder records the length of the output at each call to Sync.
+type syncRecorder struct {
+	bytes.Buffer
+	syncs []int
+}
+
+func (s *syncRecorder) Sync() error {
+	s.syncs = append(s.syncs, s.Len())
+	return nil
+}
+
+func TestCheckpointRecover(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a/a/a": fileA,
+		"a/a/b": fileB,
+		"c":     fileC,
+		"empty": fileEmpty,
+	})
+
+	out := &syncRecorder{}
+	args := ZipArgs{
+		FileArgs:                 NewFileArgsBuilder().File("a/a/a").File("a/a/b").File("c").File("empty").FileArgs(),
+		CompressionLevel:         9,
+		AddDirectoryEntriesToZip: true,
+		NonDeflatedFiles:         map[string]bool{"a/a/b": true},
+		Checkpoint:               1,
+		Filesystem:               fs,
+		Stderr:                   &bytes.Buffer{},
+	}
+	if err := ZipTo(args, out); err != nil {
+		t.Fatal(err)
+	}
+
+	data := out.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.syncs) != len(zr.File) {
+		t.Fatalf("want %d checkpoints, one per entry, got %d", len(zr.File), len(out.syncs))
+	}
+
+	// Cut the zip at each checkpoint, and in the middle of the entry after it.
+	for i, sync := range out.syncs {
+		for _, cut := range []int{sync, sync + 10} {
+			if cut > len(data) {
+				continue
+			}
+			recovered := &bytes.Buffer{}
+			n, err := Recover(bytes.NewReader(data[:cut]), int64(cut), recovered)
+			if err != nil {
+				t.Fatalf("cut at %d: %s", cut, err)
+			}
+			if n != i+1 {
+				t.Errorf("cut at %d: want %d entries, got %d", cut, i+1, n)
+			}
+
+			rzr, err := zip.NewReader(bytes.NewReader(recovered.Bytes()), int64(recovered.Len()))
+			if err != nil {
+				t.Fatalf("cut at %d: %s", cut, err)
+			}
+			for j, f := range rzr.File {
+				orig := zr.File[j]
+				if f.Name != orig.Name || f.Method != orig.Method || f.CRC32 != orig.CRC32 ||
+					f.UncompressedSize64 != orig.UncompressedSize64 || f.FileInfo().IsDir() != orig.FileInfo().IsDir() {
+					t.Errorf("cut at %d: want entry %q method %d crc %08x, got %q method %d crc %08x",
+						cut, orig.Name, orig.Method, orig.CRC32, f.Name, f.Method, f.CRC32)
+				}
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+					t.Errorf("cut at %d: %q: %s", cut, f.Name, err)
+				}
+				rc.Close()
+			}
+		}
+	}
+
+	if args.Format = TarFormat; ZipTo(args, &bytes.Buffer{}) == nil {
+		t.Errorf("want an error checkpointing a tar archive")
+	}
+}
+
+// descriptorErrorReader fails the 4 byte reads of data descriptor signatures.
+type descriptorErrorReader struct {
+	*bytes.Reader
+}
+
+var errDescriptor = errors.New("descriptor read error")
+
+func (r descriptorErrorReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 4 {
+		return 0, errDescriptor
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestRecoverReadError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "a.txt", Method: zip.Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(fileA)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := descriptorErrorReader{bytes.NewReader(buf.Bytes())}
+	if _, err := Recover(r, int64(buf.Len()), &bytes.Buffer{}); err != errDescriptor {
+		t.Errorf("want error %v, got %v", errDescriptor, err)
+	}
+}
+
+func TestCheckpointRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestCheckpointRename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "out.zip")
+	args := ZipArgs{
+		FileArgs:       NewFileArgsBuilder().File("a").FileArgs(),
+		OutputFilePath: output,
+		Checkpoint:     1,
+		Filesystem:     pathtools.MockFs(map[string][]byte{"a": fileA}),
+		Stderr:         &bytes.Buffer{},
+	}
+	if err := Zip(args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(output + PartialSuffix); !os.IsNotExist(err) {
+		t.Errorf("want %s to be renamed, got %v", output+PartialSuffix, err)
+	}
+}
+
+func TestAtomicWrite(t *testing.T) {
+	dir := t.TempDir()
+	fs := pathtools.MockFs(map[string][]byte{"a": fileA, "b": fileB})
+
+	// Concurrent zips to distinct outputs, and to the same output, in one directory each
+	// write their own temporary file.
+	outputs := []string{"out0.zip", "out1.zip", "out2.zip", "same.zip", "same.zip", "same.zip"}
+	errs := make([]error, len(outputs))
+	wg := sync.WaitGroup{}
+	for i, output := range outputs {
+		wg.Add(1)
+		go func(i int, output string) {
+			defer wg.Done()
+			errs[i] = Zip(ZipArgs{
+				FileArgs:         NewFileArgsBuilder().File("a").File("b").FileArgs(),
+				OutputFilePath:   filepath.Join(dir, output),
+				CompressionLevel: 6,
+				NumParallelJobs:  2,
+				AtomicWrite:      true,
+				WriteIfChanged:   i%2 == 1,
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			})
+		}(i, output)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%s: %s", outputs[i], err)
+		}
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if want := []string{"out0.zip", "out1.zip", "out2.zip", "same.zip"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("want only the outputs %q, got %q", want, names)
+	}
+	for _, name := range names {
+		r, err := zip.OpenReader(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if len(r.File) != 2 {
+			t.Errorf("%s: want 2 entries, got %d", name, len(r.File))
+		}
+		r.Close()
+	}
+
+	// The temporary files of zips still being written are removed when interrupted.
+	f, path, err := createTempOutput(filepath.Join(dir, "interrupted.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	RemoveTempOutputs()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("want %s to be removed, got %v", path, err)
+	}
+
+	if ZipTo(ZipArgs{AtomicWrite: true, Checkpoint: 1, Filesystem: fs, Stderr: &bytes.Buffer{}}, &bytes.Buffer{}) == nil {
+		t.Errorf("want an error with both atomic writes and checkpoints")
+	}
+}
+
+func TestCompressCache(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("dups/%02d", i)] = bytes.Repeat([]byte(fmt.Sprintf("contents %d\n", i%3)), 100)
+	}
+	// Not smaller when deflated, so it is stored.
+	files["dups/tiny1"] = []byte("x")
+	files["dups/tiny2"] = []byte("x")
+	fs := pathtools.MockFs(files)
+
+	var want []byte
+	for _, cache := range []bool{false, true} {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().Dir("dups").FileArgs(),
+			CompressionLevel: 9,
+			CompressCache:    cache,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+		z, pathMappings, err := prepareZip(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := z.zipTo(args, pathMappings, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !cache {
+			want = buf.Bytes()
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("the cache changed the zip file")
+		}
+		if got := len(z.compressCache.entries); got != 4 {
+			t.Errorf("want 4 cached contents, got %d", got)
+		}
+	}
+}
+
+func BenchmarkCompressCache(b *testing.B) {
+	// Many copies of a few files, like the license and notice files of a large tree.
+	files := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("tree/%03d/%d", i/100, i)] = bytes.Repeat([]byte(fmt.Sprintf("notice %d, all rights reserved\n", i%10)), 200)
+	}
+	fs := pathtools.MockFs(files)
+
+	for _, cache := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cache %t", cache), func(b *testing.B) {
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().Dir("tree").FileArgs(),
+				CompressionLevel: 9,
+				CompressCache:    cache,
+				Filesystem:       fs,
+				Stderr:           ioutil.Discard,
+			}
+			for i := 0; i < b.N; i++ {
+				if err := ZipTo(args, ioutil.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxSymlinkDepth(t *testing.T) {
+	files := map[string][]byte{
+		"file":             fileA,
+		"loop/a -> b":      nil,
+		"loop/b -> a":      nil,
+		"sub/link -> ../c": nil,
+	}
+	// chain/0 -> 1 -> ... -> 5 -> ../file
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("chain/%d -> %d", i, i+1)] = nil
+	}
+	files["chain/5 -> ../file"] = nil
+	files["c -> file"] = nil
+	fs := pathtools.MockFs(files)
+
+	testCases := []struct {
+		name  string
+		src   string
+		depth int
+		err   string
+	}{
+		{name: "chain within default", src: "chain/0"},
+		{name: "chain at limit", src: "chain/0", depth: 6},
+		{name: "chain over limit", src: "chain/0", depth: 5,
+			err: `"chain/0" is a chain of more than 5 symlinks: chain/0 -> chain/1 -> chain/2 -> chain/3 -> chain/4 -> chain/5`},
+		{name: "relative", src: "sub/link", depth: 1,
+			err: `"sub/link" is a chain of more than 1 symlinks: sub/link -> c`},
+		{name: "loop", src: "loop/a",
+			err: `"loop/a" is a chain of more than 40 symlinks: loop/a -> loop/b -> loop/a`},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:        NewFileArgsBuilder().File(test.src).FileArgs(),
+				MaxSymlinkDepth: test.depth,
+				Filesystem:      fs,
+				Stderr:          &bytes.Buffer{},
+			}
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestDanglingSymlink(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"file":          fileA,
+		"dangling -> c": nil,
+		"chain -> d":    nil,
+		"d -> missing":  nil,
+	})
+
+	t.Run("followed", func(t *testing.T) {
+		for src, want := range map[string]string{
+			"dangling": `"dangling" is a dangling symlink, c does not exist: dangling -> c`,
+			"chain":    `"chain" is a dangling symlink, missing does not exist: chain -> d -> missing`,
+		} {
+			args := ZipArgs{
+				FileArgs:   NewFileArgsBuilder().File("file").File(src).FileArgs(),
+				Filesystem: fs,
+				Stderr:     &bytes.Buffer{},
+			}
+			err := ZipTo(args, &bytes.Buffer{})
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("want error %q, got %v", want, err)
+			}
+		}
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		args := ZipArgs{
+			FileArgs:           NewFileArgsBuilder().File("file").File("dangling").FileArgs(),
+			IgnoreMissingFiles: true,
+			Filesystem:         fs,
+			Stderr:             &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != 1 || zr.File[0].Name != "file" {
+			t.Errorf("want only file in the zip, got %d entries", len(zr.File))
+		}
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		args := ZipArgs{
+			FileArgs:      NewFileArgsBuilder().File("dangling").FileArgs(),
+			StoreSymlinks: true,
+			Filesystem:    fs,
+			Stderr:        &bytes.Buffer{},
+		}
+		if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPostFilter(t *testing.T) {
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().File("a/a/a").File("c").FileArgs(),
+		CompressionLevel: 9,
+		Filesystem:       mockFs,
+		Stderr:           &bytes.Buffer{},
+	}
+	want := &bytes.Buffer{}
+	if err := ZipTo(args, want); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("cat", func(t *testing.T) {
+		args := args
+		args.PostFilter = "cat"
+		got := &bytes.Buffer{}
+		if err := ZipTo(args, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("cat changed the zip file")
+		}
+	})
+
+	t.Run("transform", func(t *testing.T) {
+		args := args
+		args.PostFilter = "wc -c"
+		got := &bytes.Buffer{}
+		if err := ZipTo(args, got); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(got.String())); err != nil || n != want.Len() {
+			t.Errorf("want the filter output %d, got %q", want.Len(), got.String())
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "TestPostFilter")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		args := args
+		args.PostFilter = "cat >/dev/null; exit 3"
+		args.OutputFilePath = filepath.Join(dir, "out.zip")
+		err = Zip(args)
+		if err == nil || !strings.Contains(err.Error(), `post filter "cat >/dev/null; exit 3": exit status 3`) {
+			t.Errorf("want the filter's error, got %v", err)
+		}
+		if _, err := os.Stat(args.OutputFilePath); !os.IsNotExist(err) {
+			t.Errorf("want the output to be removed, got %v", err)
+		}
+	})
+}
+
+func TestTimeBudgetLevels(t *testing.T) {
+	start := time.Unix(0, 0)
+	now := start
+	defer func(f func() time.Time) { budgetNow = f }(budgetNow)
+	budgetNow = func() time.Time { return now }
+
+	testCases := []struct {
+		name  string
+		steps []time.Duration
+		level int
+		want  []int
+	}{
+		{
+			name:  "on schedule",
+			steps: []time.Duration{0, time.Second / 2, time.Second / 2, time.Second / 2, time.Second / 2},
+			level: 9,
+			want:  []int{9, 9, 9, 9, 9},
+		},
+		{
+			name:  "behind",
+			steps: []time.Duration{0, 2 * time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second},
+			level: 9,
+			want:  []int{9, 6, 1, -1, -1},
+		},
+		{
+			name:  "catching up",
+			steps: []time.Duration{0, 2 * time.Second, 2 * time.Second, 2 * time.Second, 0, 0, 0, 0},
+			level: 9,
+			want:  []int{9, 6, 1, -1, 1, 6, 9, 9},
+		},
+		{
+			name:  "below the first step",
+			steps: []time.Duration{0, 2 * time.Second, 2 * time.Second},
+			level: 4,
+			want:  []int{4, 4, 1},
+		},
+		{
+			name:  "exhausted",
+			steps: []time.Duration{0, 100 * time.Second, 0, 0},
+			level: 9,
+			want:  []int{9, -1, -1, -1},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			now = start
+			// 100 files of 10 bytes in 100 seconds, reconsidered after each file.
+			b := newTimeBudget(100*time.Second, 1000)
+			var levels []int
+			for _, step := range test.steps {
+				now = now.Add(step)
+				levels = append(levels, b.level(test.level, 10))
+			}
+			if !reflect.DeepEqual(levels, test.want) {
+				t.Errorf("want levels %v, got %v", test.want, levels)
+			}
+		})
+	}
+}
+
+func TestTimeBudget(t *testing.T) {
+	contents := bytes.Repeat([]byte("time budget "), 1000)
+	fs := pathtools.MockFs(map[string][]byte{"a": contents, "b": contents, "c": contents})
+
+	zipWithBudget := func(budget time.Duration, adaptive bool, format Format) (string, error) {
+		decisions := filepath.Join(t.TempDir(), "methods.txt")
+		args := ZipArgs{
+			FileArgs:                NewFileArgsBuilder().File("a").File("b").File("c").FileArgs(),
+			CompressionLevel:        9,
+			TimeBudget:              budget,
+			AdaptiveLevel:           adaptive,
+			Format:                  format,
+			MethodDecisionsFilePath: decisions,
+			Filesystem:              fs,
+			Stderr:                  &bytes.Buffer{},
+		}
+		if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+			return "", err
+		}
+		got, err := ioutil.ReadFile(decisions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got), nil
+	}
+
+	got, err := zipWithBudget(time.Hour, false, ZipFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a\tdeflate\tdeflate\tdeflated\n" +
+		"b\tdeflate\tdeflate\tdeflated\n" +
+		"c\tdeflate\tdeflate\tdeflated\n"
+	if got != want {
+		t.Errorf("long budget: want method decisions:\n%s\ngot:\n%s", want, got)
+	}
+
+	// The first file is compressed before there is a rate to project from.
+	got, err = zipWithBudget(time.Nanosecond, false, ZipFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "a\tdeflate\tdeflate\tdeflated\n" +
+		"b\tdeflate\tstore\ttime budget exhausted\n" +
+		"c\tdeflate\tstore\ttime budget exhausted\n"
+	if got != want {
+		t.Errorf("exhausted budget: want method decisions:\n%s\ngot:\n%s", want, got)
+	}
+
+	if _, err := zipWithBudget(time.Hour, true, ZipFormat); err == nil {
+		t.Error("want error with adaptive levels")
+	}
+	if _, err := zipWithBudget(time.Hour, false, TarFormat); err == nil {
+		t.Error("want error with a tar archive")
+	}
+}
+
+func BenchmarkTimeBudget(b *testing.B) {
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while seven zebras " +
+		"quietly graze near old stone walls under bright morning skies")
+	files := make(map[string][]byte)
+	seed := uint32(1)
+	for i := 0; i < 64; i++ {
+		text := &bytes.Buffer{}
+		for text.Len() < 128*1024 {
+			seed = seed*1103515245 + 12345
+			text.WriteString(words[(seed>>16)%uint32(len(words))])
+			text.WriteByte(" \n"[(seed>>8)%2])
+		}
+		files[fmt.Sprintf("src/%03d.txt", i)] = text.Bytes()
+	}
+	fs := pathtools.MockFs(files)
+
+	zipWithBudget := func(budget time.Duration) (time.Duration, int64) {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().Dir("src").FileArgs(),
+			CompressionLevel: 9,
+			TimeBudget:       budget,
+			Filesystem:       fs,
+			Stderr:           ioutil.Discard,
+		}
+		out := &countWriter{w: ioutil.Discard}
+		start := time.Now()
+		if err := ZipTo(args, out); err != nil {
+			b.Fatal(err)
+		}
+		return time.Since(start), out.count
+	}
+
+	// Budgets are fractions of the time the zip takes without one.
+	unbudgeted, _ := zipWithBudget(0)
+	for _, fraction := range []float64{0, 1, 0.5, 0.25} {
+		budget := time.Duration(fraction * float64(unbudgeted))
+		b.Run(fmt.Sprintf("budget %g", fraction), func(b *testing.B) {
+			var elapsed time.Duration
+			var size int64
+			for i := 0; i < b.N; i++ {
+				e, s := zipWithBudget(budget)
+				elapsed, size = elapsed+e, size+s
+			}
+			if budget > 0 {
+				b.ReportMetric(float64(elapsed)/float64(b.N)/float64(budget), "elapsed/budget")
+			}
+			b.ReportMetric(float64(size)/float64(b.N), "bytes")
+		})
+	}
+}
+
+func TestStoredDataDescriptors(t *testing.T) {
+	stored := []byte("stored")
+	fs := pathtools.MockFs(map[string][]byte{
+		"a":     stored,
+		"b.txt": bytes.Repeat([]byte("deflated "), 100),
+	})
+
+	zipToPipe := func(descriptors bool) []byte {
+		args := ZipArgs{
+			FileArgs:              NewFileArgsBuilder().File("a").File("b.txt").FileArgs(),
+			CompressionLevel:      6,
+			NumParallelJobs:       1,
+			NonDeflatedFiles:      map[string]bool{"a": true},
+			StoredDataDescriptors: descriptors,
+			Filesystem:            fs,
+			Stderr:                &bytes.Buffer{},
+		}
+		// A pipe can't seek, so the zip must be written sequentially.
+		r, w := io.Pipe()
+		done := make(chan []byte)
+		go func() {
+			out, _ := ioutil.ReadAll(r)
+			done <- out
+		}()
+		err := ZipTo(args, w)
+		w.CloseWithError(err)
+		out := <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	for _, descriptors := range []bool{false, true} {
+		out := zipToPipe(descriptors)
+		r, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range r.File {
+			want := f.Method == zip.Deflate || descriptors
+			if got := f.Flags&zip.DataDescriptorFlag != 0; got != want {
+				t.Errorf("descriptors %v: %s: want data descriptor %v, got flags %#x", descriptors,
+					f.Name, want, f.Flags)
+			}
+			if f.Name != "a" {
+				continue
+			}
+			if f.Method != zip.Store {
+				t.Errorf("want a stored, got method %d", f.Method)
+			}
+			// The local header of a stored entry with a data descriptor has no CRC32, and
+			// the descriptor follows the data.
+			offset, _ := f.DataOffset()
+			localCRC := binary.LittleEndian.Uint32(out[offset-int64(len(f.Name))-16:])
+			descriptorCRC := binary.LittleEndian.Uint32(out[offset+int64(len(stored))+4:])
+			if descriptors && (localCRC != 0 || descriptorCRC != f.CRC32) {
+				t.Errorf("want local crc 0 and descriptor crc %#x, got %#x and %#x", f.CRC32,
+					localCRC, descriptorCRC)
+			} else if !descriptors && localCRC != f.CRC32 {
+				t.Errorf("want local crc %#x, got %#x", f.CRC32, localCRC)
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, stored) {
+				t.Errorf("want contents %q, got %q", stored, got)
+			}
+		}
+	}
+}
+
+func TestPlainManifest(t *testing.T) {
+	manifest := []byte("Custom: value\n")
+	fs := pathtools.MockFs(map[string][]byte{
+		"manifest.txt": manifest,
+		"z":            []byte("z"),
+		"a/b":          []byte("b"),
+	})
+
+	args := ZipArgs{
+		FileArgs:           NewFileArgsBuilder().File("z").File("a/b").FileArgs(),
+		CompressionLevel:   6,
+		NumParallelJobs:    1,
+		ManifestSourcePath: "manifest.txt",
+		PlainManifest:      true,
+		Filesystem:         fs,
+		Stderr:             &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries keep their order with the manifest last, and a jar would have sorted
+	// META-INF/ and the manifest first.
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"z", "a/b", jar.ManifestFile}; !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	f := r.File[len(r.File)-1]
+	if len(r.File[0].Extra) != 0 {
+		t.Errorf("want no jar extra field, got %x", r.File[0].Extra)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, manifest) {
+		t.Errorf("want the manifest copied as is %q, got %q", manifest, got)
+	}
+
+	for _, test := range []struct {
+		name string
+		args ZipArgs
+		err  string
+	}{
+		{"jar", ZipArgs{EmulateJar: true}, "can't add a plain manifest to a jar"},
+		{"fix", ZipArgs{FixManifest: true}, "can't fix a plain manifest, it is copied as is"},
+	} {
+		test.args.ManifestSourcePath = "manifest.txt"
+		test.args.PlainManifest = true
+		test.args.Filesystem = fs
+		test.args.Stderr = &bytes.Buffer{}
+		if err := ZipTo(test.args, &bytes.Buffer{}); err == nil || err.Error() != test.err {
+			t.Errorf("%s: want error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestIncludeRootDir(t *testing.T) {
+	dir := t.TempDir()
+	full, empty := filepath.Join(dir, "full"), filepath.Join(dir, "empty")
+	for _, d := range []string{filepath.Join(full, "sub"), empty} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(full, "sub/f"), fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		args     *FileArgsBuilder
+		without  []string
+		withRoot []string
+	}{
+		{
+			name:     "populated",
+			args:     NewFileArgsBuilder().SourcePrefixToStrip(dir).Dir(full),
+			without:  []string{"full/", "full/sub/", "full/sub/f"},
+			withRoot: []string{"full/", "full/sub/", "full/sub/f"},
+		},
+		{
+			name:     "empty",
+			args:     NewFileArgsBuilder().SourcePrefixToStrip(dir).Dir(empty),
+			without:  nil,
+			withRoot: []string{"empty/"},
+		},
+		{
+			name:     "prefixed populated",
+			args:     NewFileArgsBuilder().SourcePrefixToStrip(full).PathPrefixInZip("pre").Dir(full),
+			without:  []string{"pre/", "pre/sub/", "pre/sub/f"},
+			withRoot: []string{"pre/", "pre/sub/", "pre/sub/f"},
+		},
+		{
+			name:     "prefixed empty",
+			args:     NewFileArgsBuilder().SourcePrefixToStrip(empty).PathPrefixInZip("pre").Dir(empty),
+			without:  nil,
+			withRoot: []string{"pre/"},
+		},
+		{
+			name:     "root of the zip",
+			args:     NewFileArgsBuilder().SourcePrefixToStrip(full).Dir(full),
+			without:  []string{"sub/", "sub/f"},
+			withRoot: []string{"sub/", "sub/f"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			for _, includeRoot := range []bool{false, true} {
+				args := ZipArgs{
+					FileArgs:                 test.args.FileArgs(),
+					AddDirectoryEntriesToZip: true,
+					IncludeRootDir:           includeRoot,
+					Stderr:                   &bytes.Buffer{},
+				}
+				buf := &bytes.Buffer{}
+				if err := ZipTo(args, buf); err != nil {
+					t.Fatal(err)
+				}
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, f := range zr.File {
+					got = append(got, f.Name)
+				}
+				want := test.without
+				if includeRoot {
+					want = test.withRoot
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("include root %v: want %q, got %q", includeRoot, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkMap(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.New(rand.NewSource(1)).Read(random)
+	files := map[string][]byte{"large": random}
+	builder := NewFileArgsBuilder().File("large")
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("small%02d", i)
+		files[name] = random[i*50 : i*50+100]
+		builder = builder.File(name)
+	}
+
+	chunkMapFile := filepath.Join(t.TempDir(), "chunks.txt")
+	args := ZipArgs{
+		FileArgs:         builder.FileArgs(),
+		CompressionLevel: 0,
+		ChunkSize:        1000,
+		ChunkMapFilePath: chunkMapFile,
+		Filesystem:       pathtools.MockFs(files),
+		Stderr:           &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	centralDirectory, err := centralDirectoryOffset(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(chunkMapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The chunks are contiguous, no larger than the chunk size, and among the entries only split
+	// inside the large entry, which doesn't fit in a chunk.
+	var offset int64
+	var splits int
+	for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		var c chunk
+		if _, err := fmt.Sscanf(line, "%d\t%d\t%s", &c.offset, &c.size, &c.end); err != nil {
+			t.Fatalf("invalid line %q: %s", line, err)
+		}
+		if c.offset != offset || c.size <= 0 || c.size > args.ChunkSize {
+			t.Errorf("want a chunk at %d of at most %d bytes, got %q", offset, args.ChunkSize, line)
+		}
+		offset = c.offset + c.size
+		if c.end == chunkEndSplit {
+			if c.offset < centralDirectory {
+				splits++
+			}
+		} else if c.end == chunkEndEntry {
+			if sig := binary.LittleEndian.Uint32(buf.Bytes()[offset:]); sig != 0x04034b50 {
+				t.Errorf("want chunk %q to end at a local header, got signature %#x", line, sig)
+			}
+		} else if c.end == chunkEndCentralDirectory && offset != centralDirectory {
+			t.Errorf("want chunk %q to end at the central directory at %d", line, centralDirectory)
+		} else if c.end == chunkEndFile && offset != int64(buf.Len()) {
+			t.Errorf("want chunk %q to end at the end of the zip at %d", line, buf.Len())
+		} else if c.end != chunkEndEntry && c.end != chunkEndCentralDirectory && c.end != chunkEndFile {
+			t.Errorf("invalid end of chunk %q", line)
+		}
+	}
+	if offset != int64(buf.Len()) {
+		t.Errorf("want the chunks to cover the %d bytes of the zip, got %d", buf.Len(), offset)
+	}
+	if want := len(random) / int(args.ChunkSize); splits != want {
+		t.Errorf("want %d splits of the large entry, got %d", want, splits)
+	}
+}
+
+func TestBatchTinyFiles(t *testing.T) {
+	files := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		files[fmt.Sprintf("src/tiny%04d", i)] = bytes.Repeat([]byte(strconv.Itoa(i%300)), 1+i%50)
+	}
+	files["src/empty"] = nil
+	files["src/medium"] = bytes.Repeat([]byte("medium "), 2000)
+	files["src/large"] = bytes.Repeat([]byte("large "), (minParallelFileSize+parallelBlockSize/2)/6)
+	fs := pathtools.MockFs(files)
+
+	zipWithBatches := func(batch int64, cache bool) []byte {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().Dir("src").FileArgs(),
+			CompressionLevel: 6,
+			NumParallelJobs:  2,
+			// Few open files and a short queue make the batches flush before they're full.
+			MaxOpenFiles:   3,
+			QueueDepth:     2,
+			CompressCache:  cache,
+			BatchTinyFiles: batch,
+			Filesystem:     fs,
+			Stderr:         &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	for _, cache := range []bool{false, true} {
+		want := zipWithBatches(0, cache)
+		for _, batch := range []int64{1, 100, 4096} {
+			if got := zipWithBatches(batch, cache); !bytes.Equal(got, want) {
+				t.Errorf("cache %v, batch %d: want the same %d bytes as without batches, got %d different bytes",
+					cache, batch, len(want), len(got))
+			}
+		}
+	}
+}
+
+func BenchmarkBatchTinyFiles(b *testing.B) {
+	const entries = 500000
+	files := make(map[string][]byte, entries)
+	names := make([]string, entries)
+	seed := uint32(1)
+	for i := range names {
+		seed = seed*1103515245 + 12345
+		names[i] = fmt.Sprintf("src/%03d/%d", i%1000, i)
+		files[names[i]] = bytes.Repeat([]byte(strconv.Itoa(i)), 1+int(seed>>16)%40)
+	}
+	fs := pathtools.MockFs(files)
+
+	for _, batch := range []int64{0, 4096} {
+		b.Run(fmt.Sprintf("batch %d", batch), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				// The files are added directly, since globbing the mock filesystem would take
+				// longer than zipping them.
+				z := NewZipWriter(ioutil.Discard, ZipArgs{
+					CompressionLevel: 6,
+					BatchTinyFiles:   batch,
+					Filesystem:       fs,
+					Stderr:           ioutil.Discard,
+				})
+				for _, name := range names {
+					if err := z.Add(name, name, zip.Deflate); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := z.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(entries*b.N)/time.Since(start).Seconds(), "entries/s")
+		})
+	}
+}
+
+func TestErrorOnEmptyGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"full", "empty"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"full/a.txt", "full/b.so"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), fileA, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := func(name string) string { return filepath.Join(dir, name) }
+	builder := func() *FileArgsBuilder { return NewFileArgsBuilder().SourcePrefixToStrip(dir) }
+
+	testCases := []struct {
+		name    string
+		args    *FileArgsBuilder
+		onlyExt []string
+		ignore  bool
+		err     string
+	}{
+		{name: "populated directory", args: builder().Dir(p("full"))},
+		{name: "matching glob", args: builder().File(p("full/*.txt"))},
+		{
+			name: "empty directory",
+			args: builder().Dir(p("empty")),
+			err:  fmt.Sprintf("directory %q matched no files", p("empty")),
 		},
 		{
-			name: "none quoting test case 2",
-			in:   `./cmd \\-C`,
-			out:  []string{"./cmd", `\-C`},
+			name:   "missing directory",
+			args:   builder().Dir(p("missing")),
+			ignore: true,
+			err:    fmt.Sprintf("directory %q matched no files", p("missing")),
 		},
 		{
-			name: "none quoting test case 3",
-			in:   `./cmd \"-C`,
-			out:  []string{"./cmd", `"-C`},
+			name:    "directory without the extension",
+			args:    builder().Dir(p("full")),
+			onlyExt: []string{".jar"},
+			err:     fmt.Sprintf("directory %q matched no files", p("full")),
 		},
 		{
-			name: "double quoting test case 1",
-			in:   `./cmd "'"-C`,
-			out:  []string{"./cmd", `'-C`},
+			name:   "glob matching nothing",
+			args:   builder().File(p("full/*.java")),
+			ignore: true,
+			err:    fmt.Sprintf("glob %q matched no files", p("full/*.java")),
 		},
 		{
-			name: "double quoting test case 2",
-			in:   `./cmd "\\"-C`,
-			out:  []string{"./cmd", `\-C`},
+			// A missing file that isn't a glob is still ignored.
+			name:   "missing file",
+			args:   builder().File(p("full/missing.txt")).File(p("full/a.txt")),
+			ignore: true,
 		},
-		{
-			name: "double quoting test case 3",
-			in:   `./cmd "\""-C`,
-			out:  []string{"./cmd", `"-C`},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs:           test.args.FileArgs(),
+				OnlyExtensions:     test.onlyExt,
+				IgnoreMissingFiles: test.ignore,
+				Stderr:             &bytes.Buffer{},
+			}
+			// Without ErrorOnEmptyGlob they are all zipped.
+			if err := ZipTo(args, &bytes.Buffer{}); err != nil {
+				t.Fatalf("want no error without ErrorOnEmptyGlob, got %s", err)
+			}
+
+			args.ErrorOnEmptyGlob = true
+			err := ZipTo(args, &bytes.Buffer{})
+			if test.err == "" && err != nil {
+				t.Errorf("want no error, got %s", err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestReportAllDuplicates(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"x/a":     fileA,
+		"y/a":     fileB,
+		"z/a":     fileC,
+		"x/b":     fileA,
+		"y/b":     fileB,
+		"x/c":     fileA,
+		"y/c/d":   fileB,
+		"x/e/f":   fileA,
+		"unique":  fileC,
+		"x/g/h/i": fileA,
+	})
+
+	args := ZipArgs{
+		FileArgs: NewFileArgsBuilder().
+			SourcePrefixToStrip("x").File("x/a").File("x/b").File("x/c").Dir("x/e").
+			SourcePrefixToStrip("y").File("y/a").File("y/b").File("y/c/d").
+			SourcePrefixToStrip("z").File("z/a").
+			SourcePrefixToStrip("").File("unique").
+			// The same directory listed twice is not a duplicate.
+			SourcePrefixToStrip("x").File("x/e").File("x/e").
+			FileArgs(),
+		ReportAllDuplicates: true,
+		Filesystem:          fs,
+		Stderr:              &bytes.Buffer{},
+	}
+
+	err := ZipTo(args, &bytes.Buffer{})
+	duplicates, ok := err.(DuplicateDestinationsError)
+	if !ok {
+		t.Fatalf("want DuplicateDestinationsError, got %v", err)
+	}
+	want := []DuplicateDestination{
+		{Dest: "a", Files: []string{"x/a", "y/a", "z/a"}},
+		{Dest: "b", Files: []string{"x/b", "y/b"}},
+		{Dest: "c", Files: []string{"x/c"}, Directory: "y/c/d"},
+	}
+	if !reflect.DeepEqual(duplicates.Duplicates, want) {
+		t.Errorf("want duplicates %v, got %v", want, duplicates.Duplicates)
+	}
+	wantErr := `3 duplicate destinations:
+  "a" has files "x/a", "y/a", "z/a"
+  "b" has files "x/b", "y/b"
+  "c" is both a directory "y/c/d" and files "x/c"`
+	if err.Error() != wantErr {
+		t.Errorf("want error:\n%s\ngot:\n%s", wantErr, err)
+	}
+
+	// Without it, only the first duplicate is reported.
+	args.ReportAllDuplicates = false
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != `destination "a" has two files "x/a" and "y/a"` {
+		t.Errorf("want only the first duplicate, got %v", err)
+	}
+}
+
+func TestMethodFor(t *testing.T) {
+	small := bytes.Repeat([]byte("a"), 100)
+	large := bytes.Repeat([]byte("b"), 10000)
+	fs := pathtools.MockFs(map[string][]byte{
+		"small":   small,
+		"large":   large,
+		"dir/big": large,
+	})
+
+	var calls []string
+	args := ZipArgs{
+		FileArgs:                 NewFileArgsBuilder().File("small").File("large").Dir("dir").FileArgs(),
+		PipeArgs:                 []PipeArg{{Dest: "pipe", Size: int64(len(small))}},
+		Stdin:                    bytes.NewReader(small),
+		AddDirectoryEntriesToZip: true,
+		CompressionLevel:         6,
+		NumParallelJobs:          1,
+		// MethodFor overrides NonDeflatedFiles.
+		NonDeflatedFiles: map[string]bool{"small": true},
+		MethodFor: func(dest string, size int64) uint16 {
+			calls = append(calls, dest)
+			if size > 1000 {
+				return zip.Store
+			}
+			return zip.Deflate
 		},
+		Filesystem: fs,
+		Stderr:     &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			got := ReadRespFile([]byte(testCase.in))
-			if !reflect.DeepEqual(got, testCase.out) {
-				t.Errorf("expected %q got %q", testCase.out, got)
+	methods := make(map[string]uint16)
+	for _, f := range r.File {
+		methods[f.Name] = f.Method
+	}
+	want := map[string]uint16{
+		"small":   zip.Deflate,
+		"large":   zip.Store,
+		"dir/":    zip.Store,
+		"dir/big": zip.Store,
+		"pipe":    zip.Deflate,
+	}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("want methods %v, got %v", want, methods)
+	}
+	// Directories aren't asked about.
+	if want := []string{"small", "large", "dir/big", "pipe"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("want MethodFor called for %q, got %q", want, calls)
+	}
+
+	args.Stdin = bytes.NewReader(small)
+	args.MethodFor = func(string, int64) uint16 { return 93 }
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != `unsupported compression method 93 for "small"` {
+		t.Errorf("want unsupported method error, got %v", err)
+	}
+}
+
+func TestListReader(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"root/a":   fileA,
+		"root/b/c": fileB,
+	})
+
+	for _, test := range []struct {
+		name  string
+		list  string
+		files []string
+	}{
+		{"lf", "root/a\nroot/b/c\n", []string{"a", "b/c"}},
+		{"crlf with blank lines", "root/a\r\n\r\n\nroot/b/c\r\n", []string{"a", "b/c"}},
+		{"empty", "", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			builder := NewFileArgsBuilder()
+			builder.fs = fs
+			args := ZipArgs{
+				FileArgs:   builder.SourcePrefixToStrip("root").ListReader(strings.NewReader(test.list)).FileArgs(),
+				Filesystem: fs,
+				Stderr:     &bytes.Buffer{},
+			}
+			if err := builder.Error(); err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+			r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range r.File {
+				names = append(names, f.Name)
+			}
+			if !reflect.DeepEqual(names, test.files) {
+				t.Errorf("want entries %q, got %q", test.files, names)
+			}
+		})
+	}
+}
+
+func TestExcludePatterns(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{".git/objects", "pyc_only", "deep/sub", "empty", "keep"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a.py", "a.pyc", ".git/config", ".git/objects/x", "pyc_only/b.pyc",
+		"deep/sub/c.pyc", "keep/d.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), fileA, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, walkJobs := range []int{0, 2} {
+		t.Run(fmt.Sprintf("walk jobs %d", walkJobs), func(t *testing.T) {
+			args := ZipArgs{
+				FileArgs: NewFileArgsBuilder().SourcePrefixToStrip(dir).
+					Dir(dir).File(filepath.Join(dir, "a.pyc")).FileArgs(),
+				ExcludePatterns:          []string{"**/*.pyc", "**/.git"},
+				AddDirectoryEntriesToZip: true,
+				WalkJobs:                 walkJobs,
+				Stderr:                   &bytes.Buffer{},
+			}
+			buf := &bytes.Buffer{}
+			if err := ZipTo(args, buf); err != nil {
+				t.Fatal(err)
+			}
+			r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range r.File {
+				names = append(names, f.Name)
+			}
+			sort.Strings(names)
+			// The directories that only had excluded files are skipped, empty ones are kept.
+			if want := []string{"a.py", "empty/", "keep/", "keep/d.txt"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("want entries %q, got %q", want, names)
+			}
+		})
+	}
+
+	args := ZipArgs{
+		FileArgs:        NewFileArgsBuilder().Dir(dir).FileArgs(),
+		ExcludePatterns: []string{"[a"},
+		Stderr:          &bytes.Buffer{},
+	}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || !strings.HasPrefix(err.Error(), `exclude pattern "[a": `) {
+		t.Errorf("want invalid pattern error, got %v", err)
+	}
+}
+
+func TestPreserveTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "d/e"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	times := map[string]time.Time{
+		"a":     time.Date(2019, 5, 6, 7, 8, 10, 0, time.UTC),
+		"old":   time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC),
+		"d/e/b": time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC),
+		"d":     time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for _, f := range []string{"a", "old", "d/e/b"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), fileA, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, mtime := range times {
+		if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zipArgs := func(preserve bool, modTime time.Time, clampOlder bool) ZipArgs {
+		return ZipArgs{
+			FileArgs: NewFileArgsBuilder().SourcePrefixToStrip(dir).
+				File(filepath.Join(dir, "a")).File(filepath.Join(dir, "old")).
+				File(filepath.Join(dir, "d")).File(filepath.Join(dir, "d/e/b")).FileArgs(),
+			AddDirectoryEntriesToZip: true,
+			PreserveTimestamps:       preserve,
+			ModTime:                  modTime,
+			ClampOlderTimestamps:     clampOlder,
+			Stderr:                   &bytes.Buffer{},
+		}
+	}
+
+	zipEntryTimes := func(preserve bool, modTime time.Time, clampOlder bool) map[string]time.Time {
+		args := zipArgs(preserve, modTime, clampOlder)
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]time.Time)
+		for _, f := range r.File {
+			got[f.Name] = f.ModTime()
+		}
+		return got
+	}
+
+	want := map[string]time.Time{
+		"a":   times["a"],
+		"old": minDOSTime,
+		"d/":  times["d"],
+		// d/e is only a parent of d/e/b, so it gets the time of d/e/b.
+		"d/e/":  times["d/e/b"],
+		"d/e/b": times["d/e/b"],
+	}
+	if got := zipEntryTimes(true, time.Time{}, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("want times %v, got %v", want, got)
+	}
+
+	for name, mtime := range zipEntryTimes(false, time.Time{}, false) {
+		if !mtime.Equal(jar.DefaultTime) {
+			t.Errorf("%s: without PreserveTimestamps want %v, got %v", name, jar.DefaultTime, mtime)
+		}
+	}
+
+	// Source times later than ModTime are clamped to it, earlier ones are kept.
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	want["d/e/"], want["d/e/b"] = epoch, epoch
+	if got := zipEntryTimes(true, epoch, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("with ModTime %v want times %v, got %v", epoch, want, got)
+	}
+
+	// With ClampOlderTimestamps the earlier ones are clamped up to it too.
+	for name := range want {
+		want[name] = epoch
+	}
+	if got := zipEntryTimes(true, epoch, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("with ModTime %v and ClampOlderTimestamps want times %v, got %v", epoch, want, got)
+	}
+
+	for _, args := range []ZipArgs{zipArgs(false, epoch, true), zipArgs(true, time.Time{}, true)} {
+		err := ZipTo(args, &bytes.Buffer{})
+		if want := "can't clamp older timestamps"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("want error containing %q, got %v", want, err)
+		}
+	}
+
+	for _, modTime := range []time.Time{epoch, time.Unix(0, 0)} {
+		wantTime := modTime
+		if modTime.Before(minDOSTime) {
+			wantTime = minDOSTime
+		}
+		for name, mtime := range zipEntryTimes(false, modTime, false) {
+			if !mtime.Equal(wantTime) {
+				t.Errorf("%s: with ModTime %v want %v, got %v", name, modTime, wantTime, mtime)
+			}
+		}
+	}
+}
+
+func TestZipToStdout(t *testing.T) {
+	args := ZipArgs{
+		FileArgs:                 fileArgsBuilder().File("a/a/a").File("a/a/b").File("c").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		EmulateJar:               true,
+		CompressionLevel:         9,
+		Filesystem:               mockFs,
+		Stderr:                   &bytes.Buffer{},
+	}
+	want := &bytes.Buffer{}
+	if err := ZipTo(args, want); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &bytes.Buffer{}
+	args.OutputFilePath = StdoutPath
+	args.Stdout = stdout
+	if err := Zip(args); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stdout.Bytes(), want.Bytes()) {
+		t.Errorf("want the zip written to stdout to be the same as with ZipTo")
+	}
+	if _, err := os.Stat(StdoutPath); !os.IsNotExist(err) {
+		t.Errorf("want no file named %q, got %v", StdoutPath, err)
+	}
+
+	// A failure after the zip was started says that it is incomplete.
+	failing := args
+	failing.Stdout = &bytes.Buffer{}
+	failing.ExcludedCRCs = map[uint32]bool{crc32.ChecksumIEEE(fileB): true}
+	if err := Zip(failing); err == nil || !strings.HasSuffix(err.Error(), ", the zip written to stdout is incomplete") {
+		t.Errorf("want an incomplete zip error, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		args ZipArgs
+		err  string
+	}{
+		{"write if changed", ZipArgs{WriteIfChanged: true}, "can't write a zip to stdout only if it changed"},
+		{"checkpoint", ZipArgs{Checkpoint: 1}, "can't checkpoint a zip written to stdout"},
+		{"atomic", ZipArgs{AtomicWrite: true}, "can't write a zip to stdout atomically"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.args.OutputFilePath = StdoutPath
+			test.args.Stdout = &bytes.Buffer{}
+			if err := Zip(test.args); err == nil || err.Error() != test.err {
+				t.Errorf("want error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// zeroReaderAt reads zeros at any offset.
+type zeroReaderAt struct{}
+
+func (zeroReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestForceZip64(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small")
+	if err := ioutil.WriteFile(small, fileA, 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []string{small}
+	sizes := []uint64{uint64(len(fileA))}
+	if !testing.Short() {
+		// A sparse file larger than 4GB needs zip64 without ForceZip64 too.
+		huge := filepath.Join(dir, "huge")
+		f, err := os.Create(huge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Truncate(1<<32 + 10)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, huge)
+		sizes = append(sizes, 1<<32+10)
+	}
+
+	builder := NewFileArgsBuilder().SourcePrefixToStrip(dir)
+	for _, f := range files {
+		builder.File(f)
+	}
+	cdirFile := filepath.Join(dir, "cdir")
+	args := ZipArgs{
+		FileArgs:                 builder.FileArgs(),
+		CompressionLevel:         1,
+		ForceZip64:               true,
+		CentralDirectoryFilePath: cdirFile,
+		Stderr:                   &bytes.Buffer{},
+	}
+	if err := ZipTo(args, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the central directory is read, the entries weren't kept.
+	cdir, err := ioutil.ReadFile(cdirFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := centralDirectoryOffset(cdir); err != nil {
+		t.Fatal(err)
+	}
+	end := cdir[len(cdir)-directoryEndLen:]
+	if records := binary.LittleEndian.Uint16(end[8:]); records != 0xffff {
+		t.Errorf("want the zip64 end of central directory record, got %d records in the end record", records)
+	}
+	zr, err := NewCentralDirectoryReader(cdir, zeroReaderAt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(files) {
+		t.Fatalf("want %d entries, got %d", len(files), len(zr.File))
+	}
+
+	var offset uint64
+	for i, f := range zr.File {
+		if f.CompressedSize != 0xffffffff || f.UncompressedSize != 0xffffffff {
+			t.Errorf("%s: want 32-bit sizes of 0xffffffff, got %#x and %#x", f.Name, f.CompressedSize, f.UncompressedSize)
+		}
+		if f.UncompressedSize64 != sizes[i] {
+			t.Errorf("%s: want size %d, got %d", f.Name, sizes[i], f.UncompressedSize64)
+		}
+
+		want := make([]byte, 28)
+		binary.LittleEndian.PutUint16(want, 0x0001)
+		binary.LittleEndian.PutUint16(want[2:], 24)
+		binary.LittleEndian.PutUint64(want[4:], sizes[i])
+		binary.LittleEndian.PutUint64(want[12:], f.CompressedSize64)
+		binary.LittleEndian.PutUint64(want[20:], offset)
+		if !bytes.HasSuffix(f.Extra, want) {
+			t.Errorf("%s: want zip64 extra %v, got %v", f.Name, want, f.Extra)
+		}
+
+		// Each entry is its local header, its name, its data and its data descriptor if it
+		// has one, which has 64-bit sizes if the entry needs them.
+		offset += 30 + uint64(len(f.Name)) + f.CompressedSize64
+		if f.Flags&zip.DataDescriptorFlag != 0 {
+			offset += 16
+			if sizes[i] >= 0xffffffff {
+				offset += 8
+			}
+		}
+	}
+
+	args.Format = TarFormat
+	args.CentralDirectoryFilePath = ""
+	if err := ZipTo(args, ioutil.Discard); err == nil || err.Error() != "a tar archive has no zip64 records" {
+		t.Errorf("want tar error, got %v", err)
+	}
+}
+
+func TestLevelPatterns(t *testing.T) {
+	// Text that compresses better at higher levels.
+	r := rand.New(rand.NewSource(1))
+	words := []string{"apple", "banana", "cherry", "date", "elderberry", "fig", "grape"}
+	text := &bytes.Buffer{}
+	for text.Len() < 64*1024 {
+		text.WriteString(words[r.Intn(len(words))])
+		text.WriteByte(' ')
+	}
+	fs := pathtools.MockFs(map[string][]byte{
+		"res/image.png": text.Bytes(),
+		"doc.txt":       text.Bytes(),
+		"other":         text.Bytes(),
+	})
+
+	compressedSizes := func(level int, patterns []LevelPattern) map[string]string {
+		args := ZipArgs{
+			FileArgs:         NewFileArgsBuilder().File("res/image.png").File("doc.txt").File("other").FileArgs(),
+			CompressionLevel: level,
+			LevelPatterns:    patterns,
+			NumParallelJobs:  1,
+			Filesystem:       fs,
+			Stderr:           &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes := make(map[string]string)
+		for _, f := range zr.File {
+			method := "deflate"
+			if f.Method == zip.Store {
+				method = "store"
+			}
+			sizes[f.Name] = fmt.Sprintf("%s %d", method, f.CompressedSize64)
+		}
+		return sizes
+	}
+
+	level1 := compressedSizes(1, nil)
+	level9 := compressedSizes(9, nil)
+	if level1["doc.txt"] == level9["doc.txt"] {
+		t.Fatalf("want different sizes at levels 1 and 9, got %s", level1["doc.txt"])
+	}
+	stored := fmt.Sprintf("store %d", text.Len())
+
+	patterns := []LevelPattern{{"**/*.png", 0}, {"*.txt", 9}, {"*", 1}}
+	want := map[string]string{"res/image.png": stored, "doc.txt": level9["doc.txt"], "other": level1["other"]}
+	if got := compressedSizes(5, patterns); !reflect.DeepEqual(got, want) {
+		t.Errorf("want entries %v, got %v", want, got)
+	}
+
+	// Only the entries that match a pattern with a level are deflated at level 0.
+	want = map[string]string{"res/image.png": stored, "doc.txt": level9["doc.txt"], "other": stored}
+	if got := compressedSizes(0, []LevelPattern{{"*.txt", 9}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("want entries %v at level 0, got %v", want, got)
+	}
+
+	for _, test := range []struct {
+		s    string
+		want LevelPattern
+		err  string
+	}{
+		{s: "**/*.png=0", want: LevelPattern{"**/*.png", 0}},
+		{s: "a=b=9", want: LevelPattern{"a=b", 9}},
+		{s: "=9", err: `level pattern "=9" must be of the form pattern=level`},
+		{s: "*.txt", err: `level pattern "*.txt" must be of the form pattern=level`},
+		{s: "*.txt=high", err: `level pattern "*.txt=high" has invalid level "high"`},
+	} {
+		got, err := ParseLevelPattern(test.s)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: want error %q, got %v", test.s, test.err, err)
+			}
+		} else if err != nil || got != test.want {
+			t.Errorf("%q: want %v, got %v, %v", test.s, test.want, got, err)
+		}
+	}
+
+	args := ZipArgs{LevelPatterns: []LevelPattern{{"*.txt", 10}}, Stderr: &bytes.Buffer{}}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != `level pattern "*.txt" has level 10, it must be from 0 to 9` {
+		t.Errorf("want level out of range error, got %v", err)
+	}
+	args = ZipArgs{LevelPatterns: []LevelPattern{{"*.txt", 9}}, AdaptiveLevel: true, Stderr: &bytes.Buffer{}}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != "can't use level patterns with adaptive levels" {
+		t.Errorf("want adaptive level error, got %v", err)
+	}
+}
+
+func TestAppendZips(t *testing.T) {
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	classB := bytes.Repeat([]byte("class b "), 100)
+	prebuilt := &bytes.Buffer{}
+	zw := zip.NewWriter(prebuilt)
+	for _, e := range []struct {
+		name     string
+		contents []byte
+		method   uint16
+	}{
+		{"com/", nil, zip.Store},
+		{"com/b.class", classB, zip.Deflate},
+		{"res/s.txt", []byte("stored"), zip.Store},
+		{"META-INF/MANIFEST.MF", []byte("Manifest-Version: 1.0\n"), zip.Store},
+	} {
+		h := &zip.FileHeader{Name: e.name, Method: e.method}
+		h.SetModTime(modTime)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := pathtools.MockFs(map[string][]byte{
+		"prebuilt.zip":      prebuilt.Bytes(),
+		"loose/com/a.class": fileA,
+		"loose/com/c.class": fileC,
+	})
+	args := ZipArgs{
+		FileArgs:         NewFileArgsBuilder().SourcePrefixToStrip("loose").Dir("loose").FileArgs(),
+		AppendZips:       []string{"prebuilt.zip"},
+		EmulateJar:       true,
+		CompressionLevel: 9,
+		Filesystem:       fs,
+		Stderr:           &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"META-INF/", "META-INF/MANIFEST.MF", "com/", "com/a.class", "com/b.class",
+		"com/c.class", "res/", "res/s.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	orig, err := zip.NewReader(bytes.NewReader(prebuilt.Bytes()), int64(prebuilt.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawData := func(f *zip.File, data []byte) []byte {
+		offset, err := f.DataOffset()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data[offset : offset+int64(f.CompressedSize64)]
+	}
+	for _, f := range zr.File {
+		if f.Name != "com/b.class" {
+			continue
+		}
+		o := orig.File[1]
+		if f.Method != zip.Deflate || f.CRC32 != o.CRC32 || !f.ModTime().Equal(modTime) {
+			t.Errorf("want method %d, CRC32 %08x and time %v, got %d, %08x and %v",
+				zip.Deflate, o.CRC32, modTime, f.Method, f.CRC32, f.ModTime())
+		}
+		if !bytes.Equal(rawData(f, buf.Bytes()), rawData(o, prebuilt.Bytes())) {
+			t.Errorf("compressed data of %s was changed", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, classB) {
+			t.Errorf("wrong contents of %s", f.Name)
+		}
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		args := ZipArgs{
+			FileArgs:   NewFileArgsBuilder().File("com/b.class").FileArgs(),
+			AppendZips: []string{"prebuilt.zip"},
+			Filesystem: pathtools.MockFs(map[string][]byte{"prebuilt.zip": prebuilt.Bytes(), "com/b.class": fileB}),
+			Stderr:     &bytes.Buffer{},
+		}
+		want := `destination "com/b.class" has two files "com/b.class" and "prebuilt.zip!com/b.class"`
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("excluded crc", func(t *testing.T) {
+		crc := crc32.ChecksumIEEE(classB)
+		args := ZipArgs{
+			AppendZips:   []string{"prebuilt.zip"},
+			ExcludedCRCs: map[uint32]bool{crc: true},
+			Filesystem:   fs,
+			Stderr:       &bytes.Buffer{},
+		}
+		want := fmt.Sprintf(`"com/b.class" has excluded CRC32 %08x`, crc)
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		args := ZipArgs{AppendZips: []string{"prebuilt.zip"}, Format: TarFormat, Stderr: &bytes.Buffer{}}
+		want := "can't append the compressed entries of zips to a tar archive"
+		if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != want {
+			t.Errorf("want error %q, got %v", want, err)
+		}
+	})
+}
+
+func TestPipePaths(t *testing.T) {
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, fileB, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := bytes.Repeat([]byte("piped "), 10000)
+	go func() {
+		w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+		w.Write(contents)
+	}()
+
+	args := ZipArgs{
+		PipeArgs: []PipeArg{
+			{Dest: "out/piped", Path: fifo},
+			{Dest: "out/file", Path: file},
+		},
+		CompressionLevel: 9,
+		Prevalidate:      true,
+		DrainTimeout:     10 * time.Second,
+		Stderr:           &bytes.Buffer{},
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"out/piped": contents, "out/file": fileB}
+	if len(zr.File) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[f.Name]) {
+			t.Errorf("want %d bytes in %s, got %d", len(want[f.Name]), f.Name, len(got))
+		}
+	}
+	if piped := zr.File[0]; piped.Method != zip.Deflate {
+		t.Errorf("want %s deflated, got method %d", piped.Name, piped.Method)
+	}
+
+	args = ZipArgs{PipeArgs: []PipeArg{{Dest: "d", Path: dir}}, Prevalidate: true, Stderr: &bytes.Buffer{}}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "is not a file") {
+		t.Errorf("want not a file error for a directory, got %v", err)
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"res/b/icon.png":    fileA,
+		"res/a-b":           fileB,
+		"res/a/strings.xml": fileC,
+		"res/README":        fileB,
+		"lib/x.so":          fileA,
+	})
+
+	zipFiles := func(files ...string) []byte {
+		b := NewFileArgsBuilder()
+		for _, f := range files {
+			b.File(f)
+		}
+		args := ZipArgs{
+			FileArgs:                 b.FileArgs(),
+			CompressionLevel:         9,
+			AddDirectoryEntriesToZip: true,
+			SortEntries:              true,
+			Filesystem:               fs,
+			Stderr:                   &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	first := zipFiles("res/b/icon.png", "res/a-b", "res/a", "res/a/strings.xml", "res/README", "lib/x.so")
+	second := zipFiles("lib/x.so", "res/README", "res/a/strings.xml", "res/a", "res/a-b", "res/b/icon.png")
+	if !bytes.Equal(first, second) {
+		t.Error("zips of the same files in different orders differ")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	want := []string{"lib/", "lib/x.so", "res/", "res/README", "res/a/", "res/a/strings.xml", "res/a-b",
+		"res/b/", "res/b/icon.png"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want order %q, got %q", want, names)
+	}
+
+	args := ZipArgs{SortEntries: true, ClusterByExtension: true, Stderr: &bytes.Buffer{}}
+	if err := ZipTo(args, &bytes.Buffer{}); err == nil || err.Error() != "can't order entries both by name and by extension" {
+		t.Errorf("want extension order error, got %v", err)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	args := ZipArgs{
+		FileArgs:                 NewFileArgsBuilder().File("a/a/a.a").File("a/a/b.b").File("c").FileArgs(),
+		AddDirectoryEntriesToZip: true,
+		OnlyExtensions:           []string{"a", "b"},
+		CompressionLevel:         9,
+		Verbose:                  true,
+		Filesystem:               pathtools.MockFs(map[string][]byte{"a/a/a.a": fileA, "a/a/b.b": fileB, "c": fileC}),
+		Stderr:                   stderr,
+	}
+	buf := &bytes.Buffer{}
+	if err := ZipTo(args, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed uint64
+	for _, f := range zr.File {
+		compressed += f.CompressedSize64
+	}
+	want := "  skipping: c (wrong extension)\n" +
+		"  adding: a/\n" +
+		"  adding: a/a/\n" +
+		"  adding: a/a/a.a\n" +
+		"  adding: a/a/b.b\n" +
+		fmt.Sprintf("4 entries, %d bytes compressed to %d bytes\n", len(fileA)+len(fileB), compressed)
+	if got := stderr.String(); got != want {
+		t.Errorf("want verbose output:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestExplicitEmptyDirectories(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"x/y/z", "w"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	zipEntries := func(directories bool) []*zip.File {
+		args := ZipArgs{
+			FileArgs: NewFileArgsBuilder().SourcePrefixToStrip(dir).
+				File(filepath.Join(dir, "x/y/z")).File(filepath.Join(dir, "w")).FileArgs(),
+			AddDirectoryEntriesToZip: directories,
+			Stderr:                   &bytes.Buffer{},
+		}
+		buf := &bytes.Buffer{}
+		if err := ZipTo(args, buf); err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return zr.File
+	}
+
+	var names []string
+	for _, f := range zipEntries(true) {
+		names = append(names, f.Name)
+		if f.Mode() != os.ModeDir|0700 || !f.ModTime().Equal(jar.DefaultTime) {
+			t.Errorf("%s: want mode %v and time %v, got %v and %v",
+				f.Name, os.ModeDir|0700, jar.DefaultTime, f.Mode(), f.ModTime())
+		}
+	}
+	// The parents of an empty directory get entries too.
+	want := []string{"x/", "x/y/", "x/y/z/", "w/"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("want entries %q, got %q", want, names)
+	}
+
+	if files := zipEntries(false); len(files) != 0 {
+		t.Errorf("without AddDirectoryEntriesToZip want no entries, got %d", len(files))
+	}
+}
+
+func TestVerifyOutput(t *testing.T) {
+	fs := pathtools.MockFs(map[string][]byte{
+		"a":      fileA,
+		"stored": []byte("CORRUPTME"),
+	})
+
+	for _, atomic := range []bool{false, true} {
+		t.Run(fmt.Sprintf("atomic %t", atomic), func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out.zip")
+			args := ZipArgs{
+				FileArgs:         NewFileArgsBuilder().File("a").File("stored").FileArgs(),
+				OutputFilePath:   out,
+				CompressionLevel: 9,
+				NonDeflatedFiles: map[string]bool{"stored": true},
+				NumParallelJobs:  2,
+				AtomicWrite:      atomic,
+				VerifyOutput:     true,
+				Filesystem:       fs,
+				Stderr:           &bytes.Buffer{},
+			}
+			if err := Zip(args); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(out); err != nil {
+				t.Fatal(err)
+			}
+
+			// Change the stored contents behind the zip writer's back.
+			os.Remove(out)
+			args.PostFilter = "sed s/CORRUPTME/corruptme/"
+			err := Zip(args)
+			if err == nil || !strings.Contains(err.Error(), `verifying "stored"`) {
+				t.Errorf("want verification error for stored, got %v", err)
+			}
+			if _, err := os.Stat(out); !os.IsNotExist(err) {
+				t.Errorf("want the output deleted, got %v", err)
 			}
 		})
 	}
+
+	args := ZipArgs{OutputFilePath: StdoutPath, VerifyOutput: true, Stderr: &bytes.Buffer{}}
+	if err := Zip(args); err == nil || err.Error() != "can't verify a zip written to stdout" {
+		t.Errorf("want stdout error, got %v", err)
+	}
 }